@@ -2,8 +2,11 @@ package api
 
 import (
 	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +30,35 @@ func healthResponse(c *gin.Context) {
 	c.Writer.WriteHeader(http.StatusOK)
 }
 
+// storageReads responds with the counters of files read from the archive
+// and the backup
+func storageReads(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(expvar.Get("storage_reads").String()))
+}
+
+// recovery answers requests whose handler panics with 500, like
+// gin.Recovery, except for http.ErrAbortHandler. That is passed on to
+// net/http, which closes the connection of a response that has already
+// started, so that clients see the transfer fail.
+func recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			log.Errorf("panic while serving %s: %v\n%s", c.Request.URL.Path, err, debug.Stack())
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+
+		c.Next()
+	}
+}
+
 // Setup configures the web server and registers the routes
 func Setup() *http.Server {
 	// Set up routing
@@ -35,14 +67,22 @@ func Setup() *http.Server {
 	router := gin.New()
 	router.Use(
 		gin.LoggerWithWriter(gin.DefaultWriter, "/health"),
-		gin.Recovery(),
+		recovery(),
 	)
 
 	router.HandleMethodNotAllowed = true
 
 	router.GET("/metadata/datasets", SelectedMiddleware(), sda.Datasets)
 	router.GET("/metadata/datasets/*dataset", SelectedMiddleware(), sda.Files)
+	router.GET("/metadata/files/:fileid", SelectedMiddleware(), sda.FileMetadata)
 	router.GET("/files/:fileid", SelectedMiddleware(), sda.Download)
+	router.POST("/files/bundle", SelectedMiddleware(), sda.Bundle)
+	router.GET("/files/:fileid/sign", SelectedMiddleware(), sda.SignedURL)
+	router.GET("/datasets/*dataset", SelectedMiddleware(), sda.DatasetArchive)
+	router.GET("/htsget/reads/:id", SelectedMiddleware(), sda.HtsgetReads)
+	router.GET("/htsget/variants/:id", SelectedMiddleware(), sda.HtsgetVariants)
+	router.GET("/ga4gh/drs/v1/objects/*object", SelectedMiddleware(), sda.DrsObject)
+	router.POST("/credentials/s3", SelectedMiddleware(), s3.Credentials)
 	router.GET("/s3/*path", SelectedMiddleware(), s3.Download)
 	router.HEAD("/s3/*path", SelectedMiddleware(), s3.Download)
 	router.GET("/health", healthResponse)
@@ -72,3 +112,22 @@ func Setup() *http.Server {
 
 	return srv
 }
+
+// SetupMetrics configures the server for operator metrics, which listens
+// apart from the API so that it can be kept off the public network. It is
+// nil if no metrics port is configured.
+func SetupMetrics() *http.Server {
+	if config.Config.App.MetricsPort == 0 {
+		return nil
+	}
+
+	router := gin.New()
+	router.Use(recovery())
+	router.GET("/metrics/storage", storageReads)
+
+	return &http.Server{
+		Addr:              config.Config.App.MetricsHost + ":" + fmt.Sprint(config.Config.App.MetricsPort),
+		Handler:           router,
+		ReadHeaderTimeout: 20 * time.Second,
+	}
+}
@@ -2,9 +2,14 @@ package api
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/gin-gonic/gin"
 	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSetup(t *testing.T) {
@@ -25,3 +30,55 @@ func TestSetup(t *testing.T) {
 		t.Errorf("server address was not correctly formed, expected=%s, received=%s", expectedAddress, server.Addr)
 	}
 }
+
+func TestSetupMetrics(t *testing.T) {
+	originalApp := config.Config.App
+	defer func() { config.Config.App = originalApp }()
+
+	config.Config.App.MetricsPort = 0
+	assert.Nil(t, SetupMetrics())
+
+	config.Config.App.MetricsHost = "127.0.0.1"
+	config.Config.App.MetricsPort = 9090
+	server := SetupMetrics()
+	assert.Equal(t, "127.0.0.1:9090", server.Addr)
+
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		return w
+	}
+
+	// The counters are only served by the metrics listener
+	assert.Equal(t, http.StatusNotFound, get(Setup().Handler, "/metrics/storage").Code)
+
+	router := server.Handler
+	w := get(router, "/metrics/storage")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var counters map[string]int64
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &counters))
+
+	// Other variables aren't published
+	assert.Equal(t, http.StatusNotFound, get(router, "/metrics").Code)
+	assert.Equal(t, http.StatusNotFound, get(router, "/debug/vars").Code)
+}
+
+func TestRecovery(t *testing.T) {
+	router := gin.New()
+	router.Use(recovery())
+	router.GET("/panic", func(c *gin.Context) { panic("handler bug") })
+	router.GET("/abort", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+		panic(http.ErrAbortHandler)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// Aborted responses are left to net/http, to close the connection
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+	})
+}
@@ -2,18 +2,24 @@ package middleware
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/neicnordic/sda-download/internal/config"
 	"github.com/neicnordic/sda-download/internal/session"
 	"github.com/neicnordic/sda-download/pkg/auth"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 )
 
 // requestContextKey holds a name for the request context storage key
 // which is used to store and get the permissions after passing middleware
 const requestContextKey = "requestContextKey"
 
+// signableRoutes are the routes that can be accessed with a signed URL
+// instead of a token
+var signableRoutes = []string{"/files/:fileid"}
+
 // TokenMiddleware performs access token verification and validation
 // JWTs are verified and validated by the app, opaque tokens are sent to AAI for verification
 // Successful auth results in list of authorised datasets.
@@ -22,6 +28,42 @@ const requestContextKey = "requestContextKey"
 func TokenMiddleware() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
+		// Signed URLs give access to a single file without a token
+		if c.Query("signature") != "" && slices.Contains(signableRoutes, c.FullPath()) {
+			dataset, err := verifySignedURL(c.Request)
+			if err != nil {
+				log.Debugf("signed URL rejected, %s", err)
+				c.String(http.StatusUnauthorized, err.Error())
+				c.AbortWithStatus(http.StatusUnauthorized)
+
+				return
+			}
+
+			c.Set(requestContextKey, session.Cache{Datasets: []string{dataset}})
+			c.Next()
+
+			return
+		}
+
+		// S3 clients sign their requests with an access key issued by the
+		// S3 credentials endpoint, unless they send the token itself. The
+		// access keys are only valid for the S3 API.
+		if c.GetHeader("X-Amz-Security-Token") == "" && IsSigV4(c.Request) && strings.HasPrefix(c.Request.URL.Path, "/s3/") {
+			datasets, err := verifySigV4(c.Request)
+			if err != nil {
+				log.Debugf("SigV4 request rejected, %s", err)
+				c.String(http.StatusUnauthorized, err.Error())
+				c.AbortWithStatus(http.StatusUnauthorized)
+
+				return
+			}
+
+			c.Set(requestContextKey, session.Cache{Datasets: datasets})
+			c.Next()
+
+			return
+		}
+
 		// Check if dataset permissions are cached to session
 		sessionCookie, err := c.Cookie(config.Config.Session.Name)
 		if err != nil {
@@ -62,6 +104,7 @@ func TokenMiddleware() gin.HandlerFunc {
 			// 404 dataset not found, when listing files from a dataset
 			// 401 unauthorised, when downloading a file
 			cache.Datasets = auth.GetPermissions(*visas)
+			cache.Expires = auth.GetTokenExpiry(token)
 
 			// Start a new session and store datasets under the session key
 			key := session.NewSessionKey()
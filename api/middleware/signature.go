@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neicnordic/sda-download/internal/config"
+)
+
+// SignURL returns the query parameters of a signed URL for path, which gives
+// access to the file at path in dataset until expires. The optional start and
+// end coordinates limit the access to a part of the file.
+func SignURL(path, dataset, start, end string, expires time.Time) url.Values {
+	values := url.Values{}
+	values.Set("dataset", dataset)
+	values.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if start != "" {
+		values.Set("startCoordinate", start)
+	}
+	if end != "" {
+		values.Set("endCoordinate", end)
+	}
+	values.Set("signature", urlSignature(path, values))
+
+	return values
+}
+
+// urlSignature returns the HMAC of the path and the signed query parameters
+// of a URL
+func urlSignature(path string, values url.Values) string {
+	mac := hmac.New(sha256.New, config.Config.App.SigningKey)
+	mac.Write([]byte(strings.Join([]string{
+		path,
+		values.Get("dataset"),
+		values.Get("expires"),
+		values.Get("startCoordinate"),
+		values.Get("endCoordinate"),
+	}, "\n")))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL checks the signature and expiry of a signed URL, returning
+// the dataset that it gives access to
+func verifySignedURL(r *http.Request) (string, error) {
+	values := r.URL.Query()
+	if !hmac.Equal([]byte(values.Get("signature")), []byte(urlSignature(r.URL.Path, values))) {
+		return "", errors.New("invalid signature")
+	}
+
+	expires, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", errors.New("signed URL has expired")
+	}
+
+	return values.Get("dataset"), nil
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenMiddleware_SignedURL(t *testing.T) {
+	originalKey := config.Config.App.SigningKey
+	config.Config.App.SigningKey = []byte("secret")
+	defer func() { config.Config.App.SigningKey = originalKey }()
+
+	var datasets []string
+	router := gin.New()
+	router.GET("/files/:fileid", TokenMiddleware(), func(c *gin.Context) {
+		datasets = GetCacheFromContext(c).Datasets
+	})
+
+	valid := SignURL("/files/file1", "dataset1", "0", "10", time.Now().Add(time.Minute))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/files/file1?"+valid.Encode(), nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"dataset1"}, datasets)
+
+	// Signature for another file
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/files/file2?"+valid.Encode(), nil))
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "invalid signature", w.Body.String())
+
+	// Tampered coordinates
+	tampered := SignURL("/files/file1", "dataset1", "0", "10", time.Now().Add(time.Minute))
+	tampered.Set("endCoordinate", "1000")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/files/file1?"+tampered.Encode(), nil))
+	assert.Equal(t, 401, w.Code)
+
+	expired := SignURL("/files/file1", "dataset1", "", "", time.Now().Add(-time.Minute))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/files/file1?"+expired.Encode(), nil))
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "signed URL has expired", w.Body.String())
+
+	// Routes that can't be signed need a token
+	router.GET("/metadata/files/:fileid", TokenMiddleware(), func(c *gin.Context) {
+		datasets = GetCacheFromContext(c).Datasets
+	})
+	datasets = nil
+	signed := SignURL("/metadata/files/file1", "dataset1", "", "", time.Now().Add(time.Minute))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metadata/files/file1?"+signed.Encode(), nil))
+	assert.Equal(t, 401, w.Code)
+	assert.Nil(t, datasets)
+}
@@ -0,0 +1,216 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neicnordic/sda-download/internal/session"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	// sigV4MaxSkew is the largest accepted difference between the request
+	// time and the server time, as in AWS
+	sigV4MaxSkew = 15 * time.Minute
+	// sigV4MaxExpires is the longest accepted lifetime of a presigned URL
+	sigV4MaxExpires = 7 * 24 * 60 * 60
+	// emptySHA256 is the hex encoded SHA256 of an empty payload
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// IsSigV4 reports whether a request is authenticated with an AWS Signature
+// Version 4, either in the Authorization header or as a presigned URL
+func IsSigV4(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ") ||
+		r.URL.Query().Get("X-Amz-Algorithm") == sigV4Algorithm
+}
+
+// sigV4Auth holds the parts of a SigV4 authenticated request that are needed
+// to verify the signature
+type sigV4Auth struct {
+	credential    string
+	signedHeaders string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	presigned     bool
+}
+
+// parseSigV4 collects the signature details of a request from either the
+// Authorization header or the presigned URL query
+func parseSigV4(r *http.Request) sigV4Auth {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		return sigV4Auth{
+			credential:    query.Get("X-Amz-Credential"),
+			signedHeaders: query.Get("X-Amz-SignedHeaders"),
+			signature:     query.Get("X-Amz-Signature"),
+			amzDate:       query.Get("X-Amz-Date"),
+			payloadHash:   "UNSIGNED-PAYLOAD",
+			presigned:     true,
+		}
+	}
+
+	auth := sigV4Auth{
+		amzDate:     r.Header.Get("X-Amz-Date"),
+		payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	if auth.payloadHash == "" {
+		auth.payloadHash = emptySHA256
+	}
+	// Authorization: AWS4-HMAC-SHA256 Credential=..., SignedHeaders=..., Signature=...
+	fields := strings.TrimPrefix(r.Header.Get("Authorization"), sigV4Algorithm)
+	for _, field := range strings.Split(fields, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Credential":
+			auth.credential = value
+		case "SignedHeaders":
+			auth.signedHeaders = value
+		case "Signature":
+			auth.signature = value
+		}
+	}
+
+	return auth
+}
+
+// verifySigV4 checks the AWS Signature Version 4 of a request against the
+// secret of its access key, returning the datasets bound to the access key
+func verifySigV4(r *http.Request) ([]string, error) {
+	auth := parseSigV4(r)
+
+	// Credential=<access key>/<date>/<region>/s3/aws4_request
+	scope := strings.Split(auth.credential, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return nil, errors.New("malformed credential")
+	}
+	signedHeaders := strings.Split(auth.signedHeaders, ";")
+	if !slices.Contains(signedHeaders, "host") {
+		return nil, errors.New("signed headers must include host")
+	}
+
+	requestTime, err := time.Parse(sigV4TimeFormat, auth.amzDate)
+	if err != nil || scope[1] != auth.amzDate[:8] {
+		return nil, errors.New("invalid request date")
+	}
+	now := time.Now()
+	if auth.presigned {
+		expires, err := strconv.Atoi(r.URL.Query().Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > sigV4MaxExpires {
+			return nil, errors.New("invalid expiry")
+		}
+		if now.After(requestTime.Add(time.Duration(expires)*time.Second)) || requestTime.After(now.Add(sigV4MaxSkew)) {
+			return nil, errors.New("request has expired")
+		}
+	} else if requestTime.Before(now.Add(-sigV4MaxSkew)) || requestTime.After(now.Add(sigV4MaxSkew)) {
+		return nil, errors.New("request time too skewed")
+	}
+
+	credential, exists := session.GetCredential(scope[0])
+	if !exists {
+		return nil, errors.New("invalid access key")
+	}
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		auth.amzDate,
+		strings.Join(scope[1:], "/"),
+		hexSHA256(canonicalRequest(r, signedHeaders, auth.payloadHash)),
+	}, "\n")
+	key := []byte("AWS4" + credential.SecretKey)
+	for _, part := range scope[1:] {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(auth.signature)) {
+		return nil, errors.New("signature does not match")
+	}
+
+	return credential.Datasets, nil
+}
+
+// canonicalRequest formats a request as described in
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	// S3 paths are not normalised or escaped twice, so the escaped path as
+	// sent by the client is used
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	var params []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+	sort.Strings(params)
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		values := r.Header.Values(name)
+		if name == "host" {
+			values = []string{r.Host}
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.Join(trimmed, ","))
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		path,
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// sigV4Escape percent-encodes everything but the unreserved characters
+func sigV4Escape(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+
+	return hex.EncodeToString(sum[:])
+}
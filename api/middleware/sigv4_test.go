@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/internal/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenMiddleware_SigV4(t *testing.T) {
+	originalGetCredential := session.GetCredential
+	session.GetCredential = func(accessKey string) (session.Credential, bool) {
+		if accessKey != "access" {
+			return session.Credential{}, false
+		}
+
+		return session.Credential{SecretKey: "secret", Datasets: []string{"https://doi.example/ty009.sfrrss/600.45asasga"}}, true
+	}
+	defer func() { session.GetCredential = originalGetCredential }()
+
+	var datasets []string
+	router := gin.New()
+	router.GET("/s3/*path", TokenMiddleware(), func(c *gin.Context) {
+		datasets = GetCacheFromContext(c).Datasets
+	})
+	router.GET("/metadata/datasets", TokenMiddleware(), func(c *gin.Context) {
+		datasets = GetCacheFromContext(c).Datasets
+	})
+	signer := v4.NewSigner(credentials.NewStaticCredentials("access", "secret", ""), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	target := "http://example.com/s3/https:/doi.example/ty009.sfrrss/600.45asasga/dir/file%20name.txt?list-type=2&prefix=a%2Fb"
+
+	// Signature in the Authorization header
+	r := httptest.NewRequest("GET", target, nil)
+	_, err := signer.Sign(r, nil, "s3", "us-west-2", time.Now())
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, []string{"https://doi.example/ty009.sfrrss/600.45asasga"}, datasets)
+
+	// Escaped like botocore does
+	r = httptest.NewRequest("GET", strings.Replace(target, "https:", "https%3A", 1), nil)
+	_, err = signer.Sign(r, nil, "s3", "us-west-2", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, serve(router, r).Code)
+
+	// Presigned URL
+	r = httptest.NewRequest("GET", target, nil)
+	_, err = signer.Presign(r, nil, "s3", "us-west-2", time.Minute, time.Now())
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", r.URL.String(), nil))
+	assert.Equal(t, 200, w.Code, w.Body.String())
+
+	// Access keys are only valid for the S3 API, other requests need a token
+	r = httptest.NewRequest("GET", "http://example.com/metadata/datasets", nil)
+	_, err = signer.Sign(r, nil, "s3", "us-west-2", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 400, serve(router, r).Code)
+
+	for name, sign := range map[string]func() *httptest.ResponseRecorder{
+		"tampered path": func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", target, nil)
+			_, _ = signer.Sign(r, nil, "s3", "us-west-2", time.Now())
+			r.URL.Path += "2"
+
+			return serve(router, r)
+		},
+		"wrong secret": func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", target, nil)
+			_, _ = v4.NewSigner(credentials.NewStaticCredentials("access", "guess", "")).Sign(r, nil, "s3", "us-west-2", time.Now())
+
+			return serve(router, r)
+		},
+		"unknown access key": func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", target, nil)
+			_, _ = v4.NewSigner(credentials.NewStaticCredentials("unknown", "secret", "")).Sign(r, nil, "s3", "us-west-2", time.Now())
+
+			return serve(router, r)
+		},
+		"old request": func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", target, nil)
+			_, _ = signer.Sign(r, nil, "s3", "us-west-2", time.Now().Add(-time.Hour))
+
+			return serve(router, r)
+		},
+		"expired presigned URL": func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", target, nil)
+			_, _ = signer.Presign(r, nil, "s3", "us-west-2", time.Minute, time.Now().Add(-2*time.Minute))
+
+			return serve(router, httptest.NewRequest("GET", r.URL.String(), nil))
+		},
+	} {
+		assert.Equal(t, 401, sign().Code, name)
+	}
+}
+
+func serve(router *gin.Engine, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
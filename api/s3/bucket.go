@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"encoding/base32"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/neicnordic/sda-download/internal/config"
+)
+
+// encodedBucketPrefix marks bucket names holding an encoded dataset ID
+const encodedBucketPrefix = "b32-"
+
+// maxLabelLength is the longest DNS label
+const maxLabelLength = 63
+
+// bucketPattern matches the dataset IDs that are usable as bucket names in
+// virtual-hosted-style requests, being a single DNS label
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// bucketEncoding is base32 in lower case, as DNS names are case insensitive
+var bucketEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// encodeBucket returns a DNS compatible bucket name for a dataset. Dataset
+// IDs that are valid DNS labels are used as they are, others, like URLs, are
+// base32 encoded. Long encoded names are split into several labels.
+func encodeBucket(dataset string) string {
+	if bucketPattern.MatchString(dataset) && !strings.HasPrefix(dataset, encodedBucketPrefix) {
+		return dataset
+	}
+
+	encoded := encodedBucketPrefix + bucketEncoding.EncodeToString([]byte(dataset))
+	labels := []string{}
+	for len(encoded) > maxLabelLength {
+		labels = append(labels, encoded[:maxLabelLength])
+		encoded = encoded[maxLabelLength:]
+	}
+
+	return strings.Join(append(labels, encoded), ".")
+}
+
+// decodeBucket returns the dataset ID of an encoded bucket name, or the name
+// itself if it isn't encoded
+func decodeBucket(bucket string) string {
+	if !strings.HasPrefix(strings.ToLower(bucket), encodedBucketPrefix) {
+		return bucket
+	}
+
+	encoded := strings.ToLower(strings.ReplaceAll(bucket[len(encodedBucketPrefix):], ".", ""))
+	dataset, err := bucketEncoding.DecodeString(encoded)
+	if err != nil {
+		return bucket
+	}
+
+	return string(dataset)
+}
+
+// bucketName returns the bucket name that a dataset is listed with, which is
+// encoded when virtual-hosted-style requests are enabled
+func bucketName(dataset string) string {
+	if config.Config.S3.Domain == "" {
+		return dataset
+	}
+
+	return encodeBucket(dataset)
+}
+
+// virtualHostBucket returns the bucket of a virtual-hosted-style request to
+// <bucket>.<domain>, if virtual-hosted-style requests are enabled
+func virtualHostBucket(host string) (string, bool) {
+	domain := config.Config.S3.Domain
+	if domain == "" {
+		return "", false
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.HasSuffix(host, "."+domain) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(host, "."+domain), true
+}
@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeBucket(t *testing.T) {
+	for _, dataset := range []string{
+		"https://doi.example/ty009.sfrrss/600.45asasga",
+		"EGAD00000000001",
+		"b32-dataset",
+		"a",
+	} {
+		bucket := encodeBucket(dataset)
+		assert.True(t, strings.HasPrefix(bucket, encodedBucketPrefix), dataset)
+		for _, label := range strings.Split(bucket, ".") {
+			assert.LessOrEqual(t, len(label), maxLabelLength, dataset)
+			assert.Regexp(t, "^[a-z0-9-]+$", label, dataset)
+		}
+		assert.Equal(t, dataset, decodeBucket(bucket))
+		assert.Equal(t, dataset, decodeBucket(strings.ToUpper(bucket)))
+	}
+
+	assert.Equal(t, "dataset1", encodeBucket("dataset1"))
+	assert.Equal(t, "dataset1", decodeBucket("dataset1"))
+	assert.Equal(t, "b32-!", decodeBucket("b32-!"))
+}
+
+func TestVirtualHostBucket(t *testing.T) {
+	originalDomain := config.Config.S3.Domain
+	defer func() { config.Config.S3.Domain = originalDomain }()
+
+	config.Config.S3.Domain = ""
+	_, ok := virtualHostBucket("dataset1.download.example.org")
+	assert.False(t, ok)
+
+	config.Config.S3.Domain = "download.example.org"
+	for host, expected := range map[string]string{
+		"dataset1.download.example.org":      "dataset1",
+		"Dataset1.Download.Example.org:8443": "dataset1",
+		"b32-aa.bb.download.example.org.":    "b32-aa.bb",
+	} {
+		bucket, ok := virtualHostBucket(host)
+		assert.True(t, ok, host)
+		assert.Equal(t, expected, bucket, host)
+	}
+	for _, host := range []string{"download.example.org", "dataset1.example.org", "localhost:8443"} {
+		_, ok := virtualHostBucket(host)
+		assert.False(t, ok, host)
+	}
+}
+
+func TestParseParams_VirtualHost(t *testing.T) {
+	originalDomain := config.Config.S3.Domain
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	defer func() {
+		config.Config.S3.Domain = originalDomain
+		middleware.GetCacheFromContext = originalGetCacheFromContext
+	}()
+	config.Config.S3.Domain = "download.example.org"
+	middleware.GetCacheFromContext = func(c *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1", "https://url/dataset"}}
+	}
+
+	for _, test := range []struct {
+		host, path, dataset, filename, prefix string
+	}{
+		{"dataset1.download.example.org", "/dir/file.txt", "dataset1", "dir/file.txt", ""},
+		{encodeBucket("https://url/dataset") + ".download.example.org", "/file.txt", "https://url/dataset", "file.txt", ""},
+		{"dataset1.download.example.org", "/?list-type=2&prefix=dir/", "dataset1", "", "dir/"},
+		{"download.example.org", "/" + encodeBucket("https://url/dataset") + "/file.txt", "https://url/dataset", "file.txt", ""},
+		{"dataset2.download.example.org", "/file.txt", "", "", ""},
+	} {
+		w := httptest.NewRecorder()
+		_, router := gin.CreateTestContext(w)
+		router.GET("/*path", func(c *gin.Context) {
+			parseParams(c)
+			assert.Equal(t, test.dataset, c.Param("dataset"), test.host+test.path)
+			assert.Equal(t, test.filename, c.Param("filename"), test.host+test.path)
+			assert.Equal(t, test.prefix, c.Param("prefix"), test.host+test.path)
+		})
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = test.host
+		router.ServeHTTP(w, r)
+	}
+
+	// Unknown buckets are not taken for a list of all buckets
+	w := httptest.NewRecorder()
+	_, router := gin.CreateTestContext(w)
+	router.GET("/*path", Download)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "dataset2.download.example.org"
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "NoSuchBucket")
+}
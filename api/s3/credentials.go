@@ -0,0 +1,68 @@
+package s3
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// Credential is an S3 access key, in the credential_process format of the
+// AWS CLI and SDKs
+type Credential struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Expiration      string
+}
+
+// Credentials issues an S3 access key bound to the datasets of the user, so
+// that SigV4 signing S3 clients can be used without passing the access token.
+func Credentials(c *gin.Context) {
+	// Credentials must not be renewed with themselves, as they would then
+	// outlive the token they were issued for
+	if middleware.IsSigV4(c.Request) {
+		c.String(http.StatusForbidden, "S3 credentials can only be issued for an access token")
+
+		return
+	}
+
+	// The credential expires with the token, if that is earlier
+	expiry := config.Config.S3.CredentialExpiry
+	cache := middleware.GetCacheFromContext(c)
+	if !cache.Expires.IsZero() {
+		expiry = min(expiry, time.Until(cache.Expires))
+	}
+	if expiry <= 0 {
+		c.String(http.StatusUnauthorized, "access token has expired")
+
+		return
+	}
+
+	key := make([]byte, 40)
+	if _, err := rand.Read(key); err != nil {
+		log.Errorf("failed to generate S3 credential, %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+
+		return
+	}
+	accessKey := strings.ToUpper(hex.EncodeToString(key[:10]))
+	secretKey := base64.RawURLEncoding.EncodeToString(key[10:])
+
+	session.SetCredential(accessKey, session.Credential{SecretKey: secretKey, Datasets: cache.Datasets}, expiry)
+
+	c.JSON(http.StatusOK, Credential{
+		Version:         1,
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		Expiration:      time.Now().Add(expiry).UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/session"
+	"github.com/neicnordic/sda-download/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentials(t *testing.T) {
+	originalGetToken := auth.GetToken
+	originalGetVisas := auth.GetVisas
+	originalGetPermissions := auth.GetPermissions
+	originalSessionCache := session.SessionCache
+	originalExpiry := config.Config.S3.CredentialExpiry
+	defer func() {
+		auth.GetToken = originalGetToken
+		auth.GetVisas = originalGetVisas
+		auth.GetPermissions = originalGetPermissions
+		session.SessionCache = originalSessionCache
+		config.Config.S3.CredentialExpiry = originalExpiry
+	}()
+
+	auth.GetToken = func(header http.Header) (string, int, error) {
+		return "token", 200, nil
+	}
+	auth.GetVisas = func(o auth.OIDCDetails, token string) (*auth.Visas, error) {
+		return &auth.Visas{}, nil
+	}
+	auth.GetPermissions = func(visas auth.Visas) []string {
+		return []string{"dataset1"}
+	}
+	session.SessionCache, _ = session.InitialiseSessionCache()
+	config.Config.S3.CredentialExpiry = time.Hour
+
+	var datasets []string
+	router := gin.New()
+	router.POST("/credentials/s3", middleware.TokenMiddleware(), Credentials)
+	router.GET("/s3/*path", middleware.TokenMiddleware(), func(c *gin.Context) {
+		datasets = middleware.GetCacheFromContext(c).Datasets
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/credentials/s3", nil))
+	assert.Equal(t, 200, w.Code)
+
+	var credential Credential
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &credential))
+	assert.Equal(t, 1, credential.Version)
+	assert.Len(t, credential.AccessKeyID, 20)
+	assert.Len(t, credential.SecretAccessKey, 40)
+	expiration, err := time.Parse(time.RFC3339, credential.Expiration)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiration, 5*time.Second)
+
+	// The credential gives the datasets of the token, without the token
+	auth.GetToken = func(header http.Header) (string, int, error) {
+		t.Error("token used for SigV4 request")
+
+		return "", 401, nil
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentials(credential.AccessKeyID, credential.SecretAccessKey, ""))
+	r := httptest.NewRequest("GET", "/s3/dataset1", nil)
+	_, err = signer.Sign(r, nil, "s3", "us-west-2", time.Now())
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"dataset1"}, datasets)
+
+	// but can't be used to issue new credentials, or outside of the S3 API
+	auth.GetToken = originalGetToken
+	r = httptest.NewRequest("POST", "/credentials/s3", nil)
+	_, err = signer.Sign(r, nil, "s3", "us-west-2", time.Now())
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+
+	// Credentials expire with the token
+	tokenExpiry := time.Now().Add(10 * time.Minute)
+	token, _ := jwt.NewBuilder().Expiration(tokenExpiry).Build()
+	signed, _ := jwt.Sign(token, jwt.WithKey(jwa.HS256, []byte("secret")))
+	r = httptest.NewRequest("POST", "/credentials/s3", nil)
+	r.Header.Set("Authorization", "Bearer "+string(signed))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &credential))
+	expiration, err = time.Parse(time.RFC3339, credential.Expiration)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, tokenExpiry, expiration, 5*time.Second)
+
+	token, _ = jwt.NewBuilder().Expiration(time.Now().Add(-time.Minute)).Build()
+	signed, _ = jwt.Sign(token, jwt.WithKey(jwa.HS256, []byte("secret")))
+	r = httptest.NewRequest("POST", "/credentials/s3", nil)
+	r.Header.Set("Authorization", "Bearer "+string(signed))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+}
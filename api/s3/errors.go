@@ -0,0 +1,166 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// s3Error is an S3 error code with its HTTP status and message
+// https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+var (
+	errAccessDenied       = s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInternalError      = s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	errInvalidArgument    = s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	errInvalidPartNumber  = s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber", "The requested partnumber is not satisfiable"}
+	errInvalidRange       = s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+	errInvalidRequest     = s3Error{http.StatusBadRequest, "InvalidRequest", "Cannot specify both Range header and partNumber query parameter"}
+	errNoSuchBucket       = s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey          = s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errPreconditionFailed = s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	errServiceUnavailable = s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", "Service is unable to handle request."}
+)
+
+// ErrorResponse is the body of S3 error responses
+type ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+// writeXML writes an S3 XML response with the given status
+func writeXML(c *gin.Context, status int, response any) {
+	c.Header("Content-Type", "application/xml")
+	c.Status(status)
+
+	// Gin doesn't write the xml header when using c.XML, so we add it manually
+	_, err := c.Writer.Write([]byte(xml.Header))
+	if err != nil {
+		log.Errorf("Failed writing XML header: %v", err)
+		c.Abort()
+
+		return
+	}
+	c.XML(status, response)
+}
+
+// abortWithError ends an S3 request with an S3 error response
+func abortWithError(c *gin.Context, err s3Error) {
+	log.Debugf("S3 request failed with %s", err.code)
+	writeXML(c, err.status, ErrorResponse{
+		Code:     err.code,
+		Message:  err.message,
+		Resource: c.Request.URL.Path,
+	})
+	c.Abort()
+}
+
+// errorForStatus returns the S3 error for an HTTP error status
+func errorForStatus(status int) s3Error {
+	switch status {
+	case http.StatusBadRequest:
+		return errInvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errAccessDenied
+	case http.StatusNotFound:
+		return errNoSuchKey
+	case http.StatusPreconditionFailed:
+		return errPreconditionFailed
+	case http.StatusRequestedRangeNotSatisfiable:
+		return errInvalidRange
+	case http.StatusServiceUnavailable:
+		return errServiceUnavailable
+	default:
+		return errInternalError
+	}
+}
+
+// s3Writer holds back the plain text error responses of a handler, so that
+// they can be replaced by S3 errors, and overrides the headers of successful
+// responses
+type s3Writer struct {
+	gin.ResponseWriter
+	status    int
+	overrides http.Header
+}
+
+// setOverrides sets the header overrides, before the headers are sent
+func (w *s3Writer) setOverrides() {
+	for name, values := range w.overrides {
+		w.Header()[name] = values
+	}
+	w.overrides = nil
+}
+
+func (w *s3Writer) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		w.status = code
+
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *s3Writer) WriteHeaderNow() {
+	if w.status == 0 {
+		w.setOverrides()
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *s3Writer) Write(data []byte) (int, error) {
+	if w.status != 0 {
+		return len(data), nil
+	}
+	w.setOverrides()
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *s3Writer) WriteString(s string) (int, error) {
+	if w.status != 0 {
+		return len(s), nil
+	}
+	w.setOverrides()
+
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *s3Writer) Status() int {
+	if w.status != 0 {
+		return w.status
+	}
+
+	return w.ResponseWriter.Status()
+}
+
+// withS3Response runs a handler that responds with plain text errors, such as
+// sda.Download, and replaces its error responses with S3 errors. Successful
+// responses get the given header overrides.
+func withS3Response(c *gin.Context, handler gin.HandlerFunc, overrides http.Header) {
+	writer := &s3Writer{ResponseWriter: c.Writer, overrides: overrides}
+	c.Writer = writer
+	handler(c)
+	c.Writer = writer.ResponseWriter
+
+	if writer.status == 0 {
+		writer.setOverrides()
+
+		return
+	}
+
+	// Headers of the intended response don't belong to the error
+	for _, header := range []string{"Content-Disposition", "Content-Length", "ETag", "Last-Modified", "Repr-Digest", "x-amz-mp-parts-count"} {
+		c.Writer.Header().Del(header)
+	}
+	abortWithError(c, errorForStatus(writer.status))
+}
@@ -0,0 +1,96 @@
+package s3
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/database"
+	"github.com/neicnordic/sda-download/internal/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload_Errors(t *testing.T) {
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	originalGetDatasetFileInfo := database.GetDatasetFileInfo
+	defer func() {
+		middleware.GetCacheFromContext = originalGetCacheFromContext
+		database.GetDatasetFileInfo = originalGetDatasetFileInfo
+	}()
+	middleware.GetCacheFromContext = func(c *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}}
+	}
+	database.GetDatasetFileInfo = func(datasetID, filePath string) (*database.FileInfo, error) {
+		return nil, sql.ErrNoRows
+	}
+
+	for path, expected := range map[string]s3Error{
+		"/dataset2":           errNoSuchBucket,
+		"/dataset2/file.txt":  errNoSuchBucket,
+		"/dataset1/file.txt":  errNoSuchKey,
+		"/dataset1?max-keys=": errInvalidArgument,
+	} {
+		w := httptest.NewRecorder()
+		_, router := gin.CreateTestContext(w)
+		router.GET("/*path", Download)
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		assert.Equal(t, expected.status, w.Code, path)
+		assert.Equal(t, "application/xml", w.Header().Get("Content-Type"), path)
+		var response ErrorResponse
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &response), path)
+		assert.Equal(t, expected.code, response.Code, path)
+	}
+}
+
+func TestWithS3Response(t *testing.T) {
+	for _, test := range []struct {
+		handler gin.HandlerFunc
+		code    int
+		body    string
+	}{
+		{
+			handler: func(c *gin.Context) {
+				c.Header("Content-Range", "bytes */10")
+				c.String(http.StatusRequestedRangeNotSatisfiable, "requested range not satisfiable")
+			},
+			code: http.StatusRequestedRangeNotSatisfiable,
+			body: xml.Header + "<Error><Code>InvalidRange</Code><Message>The requested range is not satisfiable</Message><Resource>/file</Resource></Error>",
+		},
+		{
+			handler: func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusPreconditionFailed)
+			},
+			code: http.StatusPreconditionFailed,
+			body: xml.Header + "<Error><Code>PreconditionFailed</Code><Message>At least one of the preconditions you specified did not hold</Message><Resource>/file</Resource></Error>",
+		},
+		{
+			handler: func(c *gin.Context) {
+				c.Header("Retry-After", "30")
+				c.String(http.StatusServiceUnavailable, "archive unavailable")
+			},
+			code: http.StatusServiceUnavailable,
+			body: xml.Header + "<Error><Code>ServiceUnavailable</Code><Message>Service is unable to handle request.</Message><Resource>/file</Resource></Error>",
+		},
+		{
+			handler: func(c *gin.Context) {
+				c.Status(http.StatusPartialContent)
+				_, _ = c.Writer.Write([]byte("content"))
+			},
+			code: http.StatusPartialContent,
+			body: "content",
+		},
+	} {
+		w := httptest.NewRecorder()
+		_, router := gin.CreateTestContext(w)
+		router.GET("/file", func(c *gin.Context) { withS3Response(c, test.handler, nil) })
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/file", nil))
+
+		assert.Equal(t, test.code, w.Code)
+		assert.Equal(t, test.body, w.Body.String())
+	}
+}
@@ -0,0 +1,180 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/sda"
+	"github.com/neicnordic/sda-download/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+type Checksum struct {
+	ChecksumSHA256 string `xml:"ChecksumSHA256,omitempty"`
+}
+
+type GetObjectAttributesResponse struct {
+	ETag         string    `xml:"ETag,omitempty"`
+	Checksum     *Checksum `xml:"Checksum,omitempty"`
+	ObjectSize   *int64    `xml:"ObjectSize,omitempty"`
+	StorageClass string    `xml:"StorageClass,omitempty"`
+}
+
+// HeadBucket respondes to an S3 HeadBucket request, which checks that a
+// bucket exists and is accessible. Inaccessible datasets never get here, as
+// their names aren't parsed from the path.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_HeadBucket.html
+func HeadBucket(c *gin.Context) {
+	log.Debugf("S3 HeadBucket request for %s", c.Param("dataset"))
+
+	c.Header("x-amz-bucket-region", "us-west-2")
+	c.Status(http.StatusOK)
+}
+
+// HeadObject respondes to an S3 HeadObject request. The object metadata is
+// taken from the database, so the archive file is never opened.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_HeadObject.html
+func HeadObject(c *gin.Context) {
+	log.Debugf("S3 HeadObject request, context: %v", c.Params)
+
+	fileInfo, lastModified, ok := objectInfo(c)
+	if !ok {
+		return
+	}
+
+	etag := ""
+	if fileInfo.DecryptedFileChecksum != "" {
+		etag = fmt.Sprintf("%q", fileInfo.DecryptedFileChecksum)
+		c.Header("ETag", etag)
+	}
+	c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	switch code := sda.CheckPreconditions(c.Request, etag, lastModified); code {
+	case 0:
+	case http.StatusPreconditionFailed:
+		abortWithError(c, errPreconditionFailed)
+
+		return
+	default:
+		c.AbortWithStatus(code)
+
+		return
+	}
+
+	status := http.StatusOK
+	length := fileInfo.DecryptedFileSize
+	if partNumber := c.Query("partNumber"); partNumber != "" {
+		part, s3err := partRange(partNumber, fileInfo.DecryptedFileSize)
+		if s3err != nil {
+			abortWithError(c, *s3err)
+
+			return
+		}
+		if part.length > 0 {
+			status = http.StatusPartialContent
+			c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", part.start, part.start+part.length-1, fileInfo.DecryptedFileSize))
+		}
+		c.Header("x-amz-mp-parts-count", fmt.Sprint(part.count))
+		length = part.length
+	}
+
+	if checksum := checksumSHA256(fileInfo); checksum != "" {
+		c.Header("x-amz-checksum-sha256", checksum)
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", fmt.Sprint(length))
+	c.Header("Content-Disposition", fmt.Sprintf("filename: %v", fileInfo.FileID))
+	c.Header("Accept-Ranges", "bytes")
+	for name, values := range headerOverrides(c) {
+		c.Writer.Header()[name] = values
+	}
+	c.Status(status)
+}
+
+// GetObjectAttributes respondes to an S3 GetObjectAttributes request, with
+// the attributes listed in the X-Amz-Object-Attributes header.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectAttributes.html
+func GetObjectAttributes(c *gin.Context) {
+	log.Debugf("S3 GetObjectAttributes request, context: %v", c.Params)
+
+	attributes := strings.Split(c.GetHeader("X-Amz-Object-Attributes"), ",")
+	for i := range attributes {
+		attributes[i] = strings.TrimSpace(attributes[i])
+		switch attributes[i] {
+		case "ETag", "Checksum", "ObjectParts", "StorageClass", "ObjectSize":
+		default:
+			abortWithError(c, errInvalidArgument)
+
+			return
+		}
+	}
+
+	fileInfo, lastModified, ok := objectInfo(c)
+	if !ok {
+		return
+	}
+
+	// Files aren't stored in parts, so ObjectParts is never given
+	response := GetObjectAttributesResponse{}
+	for _, attribute := range attributes {
+		switch attribute {
+		case "ETag":
+			response.ETag = fileInfo.DecryptedFileChecksum
+		case "Checksum":
+			if checksum := checksumSHA256(fileInfo); checksum != "" {
+				response.Checksum = &Checksum{ChecksumSHA256: checksum}
+			}
+		case "StorageClass":
+			response.StorageClass = "STANDARD"
+		case "ObjectSize":
+			response.ObjectSize = &fileInfo.DecryptedFileSize
+		}
+	}
+
+	c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	writeXML(c, http.StatusOK, response)
+}
+
+// objectInfo returns the file info of the requested object, or responds with
+// an S3 error if it can't be found
+func objectInfo(c *gin.Context) (*database.FileInfo, time.Time, bool) {
+	fileInfo, err := database.GetDatasetFileInfo(c.Param("dataset"), c.Param("filename")+".c4gh")
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			abortWithError(c, errNoSuchKey)
+		} else {
+			abortWithError(c, errInternalError)
+		}
+
+		return nil, time.Time{}, false
+	}
+
+	lastModified, err := time.Parse(time.RFC3339, fileInfo.LastModified)
+	if err != nil {
+		log.Errorf("failed to parse last modified time: %v", err)
+		abortWithError(c, errInternalError)
+
+		return nil, time.Time{}, false
+	}
+
+	return fileInfo, lastModified, true
+}
+
+// checksumSHA256 returns the SHA256 checksum of the decrypted file in the
+// base64 encoding of the S3 checksum headers, or "" if there is none
+func checksumSHA256(fileInfo *database.FileInfo) string {
+	if !strings.EqualFold(fileInfo.DecryptedFileChecksumType, "SHA256") {
+		return ""
+	}
+	sum, err := hex.DecodeString(fileInfo.DecryptedFileChecksum)
+	if err != nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(sum)
+}
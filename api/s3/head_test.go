@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/database"
+	"github.com/neicnordic/sda-download/internal/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockObject sets up "dataset1" holding "dir/file.txt" until the test ends
+func mockObject(t *testing.T) {
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	originalGetDatasetFileInfo := database.GetDatasetFileInfo
+	t.Cleanup(func() {
+		middleware.GetCacheFromContext = originalGetCacheFromContext
+		database.GetDatasetFileInfo = originalGetDatasetFileInfo
+	})
+
+	middleware.GetCacheFromContext = func(c *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}}
+	}
+	database.GetDatasetFileInfo = func(datasetID, filePath string) (*database.FileInfo, error) {
+		if datasetID != "dataset1" || filePath != "dir/file.txt.c4gh" {
+			return nil, sql.ErrNoRows
+		}
+
+		return &database.FileInfo{
+			FileID:                    "file1",
+			DecryptedFileSize:         32,
+			DecryptedFileChecksum:     "66687aadf862bd776c8fc18b8e9f8e20089714856ee233b3902a591d0d5f2925",
+			DecryptedFileChecksumType: "SHA256",
+			LastModified:              "2023-04-17T14:40:12Z",
+		}, nil
+	}
+}
+
+func serveS3(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	_, router := gin.CreateTestContext(w)
+	router.Handle(method, "/*path", Download)
+	r := httptest.NewRequest(method, path, nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestHeadBucket(t *testing.T) {
+	mockObject(t)
+
+	assert.Equal(t, http.StatusOK, serveS3("HEAD", "/dataset1", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveS3("HEAD", "/dataset2", nil).Code)
+}
+
+func TestHeadObject(t *testing.T) {
+	mockObject(t)
+
+	w := serveS3("HEAD", "/dataset1/dir/file.txt", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "32", w.Header().Get("Content-Length"))
+	assert.Equal(t, `"66687aadf862bd776c8fc18b8e9f8e20089714856ee233b3902a591d0d5f2925"`, w.Header().Get("ETag"))
+	assert.Equal(t, "Zmh6rfhivXdsj8GLjp+OIAiXFIVu4jOzkCpZHQ1fKSU=", w.Header().Get("x-amz-checksum-sha256"))
+	assert.Equal(t, "Mon, 17 Apr 2023 14:40:12 GMT", w.Header().Get("Last-Modified"))
+
+	w = serveS3("HEAD", "/dataset1/dir/file.txt", map[string]string{"If-None-Match": w.Header().Get("ETag")})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	w = serveS3("HEAD", "/dataset1/dir/file.txt", map[string]string{"If-Match": `"other"`})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = serveS3("HEAD", "/dataset1/dir/other.txt", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetObjectAttributes(t *testing.T) {
+	mockObject(t)
+
+	w := serveS3("GET", "/dataset1/dir/file.txt?attributes", map[string]string{"X-Amz-Object-Attributes": "ETag, Checksum,ObjectSize"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, xml.Header+"<GetObjectAttributesResponse>"+
+		"<ETag>66687aadf862bd776c8fc18b8e9f8e20089714856ee233b3902a591d0d5f2925</ETag>"+
+		"<Checksum><ChecksumSHA256>Zmh6rfhivXdsj8GLjp+OIAiXFIVu4jOzkCpZHQ1fKSU=</ChecksumSHA256></Checksum>"+
+		"<ObjectSize>32</ObjectSize>"+
+		"</GetObjectAttributesResponse>", w.Body.String())
+
+	w = serveS3("GET", "/dataset1/dir/file.txt?attributes", map[string]string{"X-Amz-Object-Attributes": "Owner"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/internal/config"
+)
+
+// maxPartNumber is the largest part number of an S3 object
+const maxPartNumber = 10000
+
+// responseOverrides maps the query parameters that override response headers
+// of GetObject requests to the headers they override
+var responseOverrides = map[string]string{
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+	"response-content-language":    "Content-Language",
+	"response-content-type":        "Content-Type",
+	"response-expires":             "Expires",
+}
+
+// headerOverrides returns the response headers set with query parameters
+func headerOverrides(c *gin.Context) http.Header {
+	headers := http.Header{}
+	for param, header := range responseOverrides {
+		if value := c.Query(param); value != "" {
+			headers.Set(header, value)
+		}
+	}
+
+	return headers
+}
+
+// objectPart is a virtual part of an object, as if the object had been
+// uploaded in parts of the configured part size, or in larger parts when
+// the object would otherwise have more than maxPartNumber parts
+type objectPart struct {
+	start  int64
+	length int64
+	count  int
+}
+
+// partRange returns the part of an object of size bytes requested with the
+// partNumber query parameter. Empty objects have a single, empty, part.
+func partRange(partNumber string, size int64) (objectPart, *s3Error) {
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > maxPartNumber {
+		return objectPart{}, &errInvalidArgument
+	}
+
+	partSize := max(config.Config.S3.PartSize, (size+maxPartNumber-1)/maxPartNumber)
+	count := max(1, int((size+partSize-1)/partSize))
+	if number > count {
+		return objectPart{}, &errInvalidPartNumber
+	}
+
+	start := int64(number-1) * partSize
+
+	return objectPart{start: start, length: min(partSize, size-start), count: count}, nil
+}
@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartRange(t *testing.T) {
+	originalPartSize := config.Config.S3.PartSize
+	config.Config.S3.PartSize = 10
+	defer func() { config.Config.S3.PartSize = originalPartSize }()
+
+	part, err := partRange("1", 25)
+	assert.Nil(t, err)
+	assert.Equal(t, objectPart{start: 0, length: 10, count: 3}, part)
+	part, err = partRange("3", 25)
+	assert.Nil(t, err)
+	assert.Equal(t, objectPart{start: 20, length: 5, count: 3}, part)
+	part, err = partRange("1", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, objectPart{start: 0, length: 0, count: 1}, part)
+
+	_, err = partRange("4", 25)
+	assert.Equal(t, &errInvalidPartNumber, err)
+	for _, partNumber := range []string{"0", "a", "10001"} {
+		_, err = partRange(partNumber, 25)
+		assert.Equal(t, &errInvalidArgument, err, partNumber)
+	}
+
+	// Large objects have larger parts, to have at most maxPartNumber parts
+	part, err = partRange("10000", 30*maxPartNumber)
+	assert.Nil(t, err)
+	assert.Equal(t, objectPart{start: 9999 * 30, length: 30, count: 10000}, part)
+	part, err = partRange("9678", 30*maxPartNumber+1)
+	assert.Nil(t, err)
+	assert.Equal(t, objectPart{start: 9677 * 31, length: 14, count: 9678}, part)
+}
+
+func TestHeadObject_Part(t *testing.T) {
+	mockObject(t)
+	originalPartSize := config.Config.S3.PartSize
+	config.Config.S3.PartSize = 10
+	defer func() { config.Config.S3.PartSize = originalPartSize }()
+
+	w := serveS3("HEAD", "/dataset1/dir/file.txt?partNumber=4&response-content-type=text/plain", nil)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes 30-31/32", w.Header().Get("Content-Range"))
+	assert.Equal(t, "4", w.Header().Get("x-amz-mp-parts-count"))
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+
+	w = serveS3("HEAD", "/dataset1/dir/file.txt?partNumber=5", nil)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestWithS3Response_Overrides(t *testing.T) {
+	w := httptest.NewRecorder()
+	_, router := gin.CreateTestContext(w)
+	router.GET("/file", func(c *gin.Context) {
+		withS3Response(c, func(c *gin.Context) {
+			c.Header("Content-Type", "application/octet-stream")
+			c.Header("Content-Disposition", "filename: file1")
+			_, _ = c.Writer.Write([]byte("content"))
+		}, headerOverrides(c))
+	})
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/file?response-content-type=text/plain&response-content-disposition=attachment%3B%20filename%3D%22file.txt%22&response-cache-control=no-cache", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="file.txt"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "content", w.Body.String())
+}
@@ -1,18 +1,23 @@
 package s3
 
 import (
+	"encoding/base64"
 	"encoding/xml"
+	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/neicnordic/sda-download/api/middleware"
 	"github.com/neicnordic/sda-download/api/sda"
 	"github.com/neicnordic/sda-download/internal/database"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 )
 
 type LocationConstraint struct {
@@ -45,34 +50,50 @@ type Object struct {
 	StorageClass      string   `xml:"StorageClass,omitempty"`
 }
 
+type CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
 type ListBucketResult struct {
-	CommonPrefixes []string `xml:"CommonPrefixes>CommonPrefix"`
-	Contents       []Object `xml:"Contents"`
-	Delimiter      string   `xml:"Delimiter,omitempty"`
-	EncodingType   string   `xml:"EncodingType,omitempty"`
-	IsTruncated    bool     `xml:"IsTruncated,omitempty"`
-	Marker         string   `xml:"Marker,omitempty"`
-	MaxKeys        int      `xml:"MaxKeys,omitempty"`
-	Name           string   `xml:"Name"`
-	NextMarker     string   `xml:"NextMarker,omitempty"`
-	Prefix         string   `xml:"Prefix,omitempty"`
+	CommonPrefixes []CommonPrefix `xml:"CommonPrefixes"`
+	Contents       []Object       `xml:"Contents"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	EncodingType   string         `xml:"EncodingType,omitempty"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Marker         string         `xml:"Marker,omitempty"`
+	MaxKeys        int            `xml:"MaxKeys"`
+	Name           string         `xml:"Name"`
+	NextMarker     string         `xml:"NextMarker,omitempty"`
+	Prefix         string         `xml:"Prefix,omitempty"`
+}
+
+type ListBucketV2Result struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	CommonPrefixes        []CommonPrefix `xml:"CommonPrefixes"`
+	Contents              []Object       `xml:"Contents"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	Name                  string         `xml:"Name"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Prefix                string         `xml:"Prefix,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
 }
 
+// maxListKeys is the largest number of keys returned in one list response,
+// as in AWS
+const maxListKeys = 1000
+
 // GetBucketLocation respondes to an S3 GetBucketLocation request. This request
 // only contains the AWS region name as XML.
 // https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLocation.html
 func GetBucketLocation(c *gin.Context) {
 	log.Debug("S3 GetBucketLocation request")
 
-	// Gin doesn't write the xml header when using c.XML, so we add it manually
-	_, err := c.Writer.Write([]byte(xml.Header))
-	if err != nil {
-		log.Errorf("Failed writing XML header: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-
-		return
-	}
-	c.XML(http.StatusAccepted, LocationConstraint{
+	writeXML(c, http.StatusOK, LocationConstraint{
 		XMLns:    "http://s3.amazonaws.com/doc/2006-03-01/",
 		Location: "us-west-2",
 	})
@@ -84,39 +105,34 @@ func GetBucketLocation(c *gin.Context) {
 func ListBuckets(c *gin.Context) {
 	log.Debug("S3 ListBuckets request")
 
-	// Gin doesn't write the xml header when using c.XML, so we add it manually
-	_, err := c.Writer.Write([]byte(xml.Header))
-	if err != nil {
-		log.Errorf("Failed writing XML header: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-
-		return
-	}
-
 	buckets := []Bucket{}
 	cache := middleware.GetCacheFromContext(c)
 	for _, dataset := range cache.Datasets {
 		datasetInfo, err := database.GetDatasetInfo(dataset)
 		if err != nil {
 			log.Errorf("Failed to get dataset information: %v", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+			abortWithError(c, errInternalError)
+
+			return
 		}
 		// TODO: Add real creation date
 		buckets = append(buckets, Bucket{
-			Name:         datasetInfo.DatasetID,
+			Name:         bucketName(datasetInfo.DatasetID),
 			CreationDate: datasetInfo.CreatedAt,
 		})
 	}
 
-	c.XML(http.StatusAccepted, ListAllMyBucketsResult{
+	writeXML(c, http.StatusOK, ListAllMyBucketsResult{
 		Buckets: buckets,
 		Owner:   Owner{DisplayName: "", ID: ""},
 	})
 }
 
-// ListObjects respondes to an S3 ListObjects request. This request
-// lists the contents of an S3 bucket. We use this to return dataset content.
+// ListObjects respondes to an S3 ListObjects or ListObjectsV2 request. This
+// request lists the contents of an S3 bucket. We use this to return dataset
+// content.
 // https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjects.html
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
 func ListObjects(c *gin.Context) {
 	log.Debug("S3 ListObjects request")
 
@@ -132,60 +148,204 @@ func ListObjects(c *gin.Context) {
 		}
 	}
 	if !allowed {
-		c.AbortWithStatus(http.StatusNotFound)
+		abortWithError(c, errNoSuchBucket)
 
 		return
 	}
 
-	files, err := database.GetFiles(dataset)
+	maxKeys := maxListKeys
+	if value, ok := c.GetQuery("max-keys"); ok {
+		var err error
+		maxKeys, err = strconv.Atoi(value)
+		if err != nil || maxKeys < 0 {
+			abortWithError(c, errInvalidArgument)
+
+			return
+		}
+		maxKeys = min(maxKeys, maxListKeys)
+	}
+	v2 := c.Query("list-type") == "2"
+	marker := c.Query("marker")
+	if v2 {
+		marker = c.Query("start-after")
+		if token := c.Query("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				abortWithError(c, errInvalidArgument)
+
+				return
+			}
+			marker = string(decoded)
+		}
+	}
+
+	list, err := listObjects(dataset, c.Param("prefix"), c.Query("delimiter"), marker, maxKeys)
 	if err != nil {
-		log.Errorf("Failed getting dataset files: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		log.Errorf("Failed listing dataset objects: %v", err)
+		abortWithError(c, errInternalError)
 
 		return
 	}
 
-	// We return the full upload path, as file key
-	objects := []Object{}
-	for _, file := range files {
-		key := strings.TrimSuffix(file.FilePath, ".c4gh")
-		// The first part of the upload path is the user id, which should be
-		// removed
-		parts := strings.Split(key, "/")
-		if len(parts) > 1 {
-			parts = parts[1:]
+	// Keys are url encoded on request, to allow characters that XML can't hold
+	encodingType := c.Query("encoding-type")
+	encode := func(s string) string { return s }
+	if encodingType == "url" {
+		encode = url.QueryEscape
+		for i := range list.contents {
+			list.contents[i].Key = encode(list.contents[i].Key)
+		}
+		for i := range list.prefixes {
+			list.prefixes[i].Prefix = encode(list.prefixes[i].Prefix)
 		}
-		key = strings.Join(parts, "/")
+	}
 
-		if !strings.HasPrefix(key, c.Param("prefix")) {
-			continue
+	if v2 {
+		result := ListBucketV2Result{
+			Name:              bucketName(dataset),
+			CommonPrefixes:    list.prefixes,
+			Contents:          list.contents,
+			ContinuationToken: c.Query("continuation-token"),
+			Delimiter:         encode(c.Query("delimiter")),
+			EncodingType:      encodingType,
+			IsTruncated:       list.truncated,
+			KeyCount:          len(list.contents) + len(list.prefixes),
+			MaxKeys:           maxKeys,
+			Prefix:            encode(c.Param("prefix")),
+			StartAfter:        encode(c.Query("start-after")),
 		}
-		lastModified, err := time.Parse(time.RFC3339, file.LastModified)
-		if err != nil {
-			log.Errorf("failed to parse last modified time: %v", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
+		if list.truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(list.next))
+		}
+		writeXML(c, http.StatusOK, result)
 
-			return
+		return
+	}
+
+	result := ListBucketResult{
+		Name:           bucketName(dataset),
+		CommonPrefixes: list.prefixes,
+		Contents:       list.contents,
+		Delimiter:      encode(c.Query("delimiter")),
+		EncodingType:   encodingType,
+		IsTruncated:    list.truncated,
+		Marker:         encode(marker),
+		MaxKeys:        maxKeys,
+		Prefix:         encode(c.Param("prefix")),
+	}
+	if list.truncated {
+		result.NextMarker = encode(list.next)
+	}
+	writeXML(c, http.StatusOK, result)
+}
+
+// objectList is one page of a bucket listing
+type objectList struct {
+	prefix    string
+	delimiter string
+	marker    string
+	maxKeys   int
+
+	contents  []Object
+	prefixes  []CommonPrefix
+	truncated bool
+	// next is the last key or common prefix of the page, which the next
+	// page starts after
+	next string
+}
+
+// listObjects returns at most maxKeys of the objects of a dataset with
+// prefix that come after marker. With a delimiter, the keys that contain
+// the delimiter after the prefix are rolled up into common prefixes, like
+// folders. The objects are read from the database in pages of maxKeys+1,
+// which is one more than fits in the list, so that it's known if the list is
+// truncated.
+func listObjects(dataset, prefix, delimiter, marker string, maxKeys int) (objectList, error) {
+	list := objectList{prefix: prefix, delimiter: delimiter, marker: marker, maxKeys: maxKeys, contents: []Object{}}
+	if maxKeys == 0 {
+		return list, nil
+	}
+
+	after := list.after(marker)
+	for {
+		objects, err := database.GetObjectsPage(dataset, database.ObjectFilter{After: after, Prefix: prefix, Limit: maxKeys + 1})
+		if err != nil {
+			return list, err
 		}
-		objects = append(objects, Object{
-			Key:          key,
-			Size:         int(file.DecryptedFileSize),
-			LastModified: lastModified.Format(http.TimeFormat),
-		})
+		for _, object := range objects {
+			if err := list.add(object); err != nil {
+				return list, err
+			}
+			if list.truncated {
+				return list, nil
+			}
+		}
+		// Pages that are rolled up into common prefixes don't fill the
+		// list, so listing continues with the next page
+		if len(objects) <= maxKeys {
+			return list, nil
+		}
+		after = list.after(objects[len(objects)-1].Key)
 	}
+}
 
-	// Gin doesn't write the xml header when using c.XML, so we add it manually
-	_, err = c.Writer.Write([]byte(xml.Header))
-	if err != nil {
-		log.Errorf("Failed writing XML header: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+// entry returns the common prefix that a key is rolled up into, or the key
+// itself if it isn't rolled up
+func (list *objectList) entry(key string) (string, bool) {
+	if list.delimiter == "" || !strings.HasPrefix(key, list.prefix) {
+		return key, false
+	}
+	i := strings.Index(key[len(list.prefix):], list.delimiter)
+	if i < 0 {
+		return key, false
+	}
 
-		return
+	return key[:len(list.prefix)+i+len(list.delimiter)], true
+}
+
+// after returns the key that the listing continues after, once key has been
+// listed. Keys rolled up into a common prefix are all skipped, as the prefix
+// followed by the largest rune comes after them.
+func (list *objectList) after(key string) string {
+	if entry, rolled := list.entry(key); rolled {
+		return max(key, entry+string(utf8.MaxRune))
+	}
+
+	return key
+}
+
+// add adds an object to the list, as a key or a common prefix, or marks the
+// list as truncated if it is full
+func (list *objectList) add(object *database.ObjectInfo) error {
+	entry, rolled := list.entry(object.Key)
+	// Common prefixes are listed once, and skipped when used as marker
+	if entry <= list.marker || entry == list.next {
+		return nil
+	}
+
+	if len(list.contents)+len(list.prefixes) == list.maxKeys {
+		list.truncated = true
+
+		return nil
+	}
+	list.next = entry
+	if rolled {
+		list.prefixes = append(list.prefixes, CommonPrefix{Prefix: entry})
+
+		return nil
+	}
+
+	lastModified, err := time.Parse(time.RFC3339, object.LastModified)
+	if err != nil {
+		return fmt.Errorf("failed to parse last modified time: %w", err)
 	}
-	c.XML(http.StatusAccepted, ListBucketResult{
-		Name:     dataset,
-		Contents: objects,
+	list.contents = append(list.contents, Object{
+		Key:          object.Key,
+		Size:         int(object.DecryptedFileSize),
+		LastModified: lastModified.Format(http.TimeFormat),
 	})
+
+	return nil
 }
 
 // GetObject respondes to an S3 GetObject request. This request returns S3
@@ -197,15 +357,28 @@ func GetObject(c *gin.Context) {
 	log.Debugf("S3 GetObject request, context: %v", c.Params)
 
 	// Get file info for the given file path (or abort)
-	fileInfo, err := database.GetDatasetFileInfo(c.Param("dataset"), c.Param("filename")+".c4gh")
-	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			c.AbortWithStatus(http.StatusNotFound)
-		} else {
-			c.AbortWithStatus(http.StatusInternalServerError)
+	fileInfo, _, ok := objectInfo(c)
+	if !ok {
+		return
+	}
+
+	// Parts are served as ranges of the file
+	if partNumber := c.Query("partNumber"); partNumber != "" {
+		if c.GetHeader("Range") != "" {
+			abortWithError(c, errInvalidRequest)
+
+			return
 		}
+		part, s3err := partRange(partNumber, fileInfo.DecryptedFileSize)
+		if s3err != nil {
+			abortWithError(c, *s3err)
 
-		return
+			return
+		}
+		if part.length > 0 {
+			c.Request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.start, part.start+part.length-1))
+		}
+		c.Header("x-amz-mp-parts-count", strconv.Itoa(part.count))
 	}
 
 	// Set a param so that Download knows to add S3 headers
@@ -214,8 +387,8 @@ func GetObject(c *gin.Context) {
 	// set the fileID so that download knows what file to download
 	c.Params = append(c.Params, gin.Param{Key: "fileid", Value: fileInfo.FileID})
 
-	// Download the file
-	sda.Download(c)
+	// Download the file, with errors in S3 format
+	withS3Response(c, sda.Download, headerOverrides(c))
 }
 
 // parseParams attempts to split the "path" param from the router into a dataset
@@ -223,14 +396,55 @@ func GetObject(c *gin.Context) {
 // which can include slashes, so finding the separation between filename and
 // dataset name is done by comparing to accessible datasets.
 func parseParams(c *gin.Context) *gin.Context {
+	cache := middleware.GetCacheFromContext(c)
+	prefix, list := c.GetQuery("prefix")
+
+	// Virtual-hosted-style requests give the bucket in the host name, and the
+	// whole path is the key
+	if bucket, ok := virtualHostBucket(c.Request.Host); ok {
+		c.Params = append(c.Params, gin.Param{Key: "bucket", Value: bucket})
+		dataset := decodeBucket(bucket)
+		if !slices.Contains(cache.Datasets, dataset) {
+			return c
+		}
+
+		c.Params = append(c.Params, gin.Param{Key: "dataset", Value: dataset})
+		if list {
+			c.Params = append(c.Params, gin.Param{Key: "prefix", Value: prefix})
+		} else {
+			c.Params = append(c.Params, gin.Param{Key: "filename", Value: strings.TrimPrefix(c.Param("path"), "/")})
+		}
 
-	// When doing list requests from s3cmd, the tool will assume that the first
-	// slash delimits the bucket, and the rest is the prefix. We use this to
-	// "restore" the path in case the prefix param is set.
-	path := c.Param("path") + c.Query("prefix")
+		return c
+	}
+
+	dataset, remainder := matchDataset(c.Param("path"), cache.Datasets)
+	if list && (dataset == "" || remainder != "") {
+		// When doing list requests from s3cmd, the tool will assume that the
+		// first slash delimits the bucket, and the rest is the prefix. We use
+		// this to "restore" the path in case the prefix param is set.
+		dataset, prefix = matchDataset(c.Param("path")+prefix, cache.Datasets)
+	}
+	if dataset == "" {
+		return c
+	}
+
+	c.Params = append(c.Params, gin.Param{Key: "dataset", Value: dataset})
+	if list {
+		c.Params = append(c.Params, gin.Param{Key: "prefix", Value: prefix})
+	} else {
+		c.Params = append(c.Params, gin.Param{Key: "filename", Value: strings.TrimSuffix(remainder, "/")})
+	}
+
+	return c
+}
 
-	// Trim slashes from the path, as the dataset names don't have slashes
-	path = strings.Trim(path, "/")
+// matchDataset finds the dataset that a path starts with, returning the
+// dataset and the rest of the path
+func matchDataset(path string, datasets []string) (string, string) {
+	// Trim leading slashes from the path, as the dataset names don't start
+	// with slashes
+	path = strings.TrimLeft(path, "/")
 
 	path, err := url.QueryUnescape(path)
 	if err != nil {
@@ -244,30 +458,25 @@ func parseParams(c *gin.Context) *gin.Context {
 		path = string(protocolPattern.ReplaceAll([]byte(path), []byte("$1/$2")))
 	}
 
-	cache := middleware.GetCacheFromContext(c)
-	for _, dataset := range cache.Datasets {
-		// check that the path starts with the dataset name, but also that the
-		// path is only the dataset, or that the following character is a slash.
-		// This prevents wrong matches in cases like when one dataset name is a
-		// prefix of another one, like "dataset1", and "dataset10".
-		if strings.HasPrefix(path, dataset) && (len(path) == len(dataset) || path[len(dataset)] == '/') {
-			c.Params = append(c.Params, gin.Param{Key: "dataset", Value: dataset})
-			remainder := ""
-			if len(path) > len(dataset) {
-				remainder = path[len(dataset)+1:]
-			}
-
-			key := "filename"
-			if c.Query("prefix") != "" {
-				key = "prefix"
+	for _, dataset := range datasets {
+		// Datasets can also be given with their DNS compatible bucket names
+		for _, name := range []string{dataset, encodeBucket(dataset)} {
+			// check that the path starts with the dataset name, but also that the
+			// path is only the dataset, or that the following character is a slash.
+			// This prevents wrong matches in cases like when one dataset name is a
+			// prefix of another one, like "dataset1", and "dataset10".
+			if strings.HasPrefix(path, name) && (len(path) == len(name) || path[len(name)] == '/') {
+				remainder := ""
+				if len(path) > len(name) {
+					remainder = path[len(name)+1:]
+				}
+
+				return dataset, remainder
 			}
-			c.Params = append(c.Params, gin.Param{Key: key, Value: remainder})
-
-			break
 		}
 	}
 
-	return c
+	return "", ""
 }
 
 // Download is the main entry function for the S3 functionality. It parses the
@@ -287,17 +496,26 @@ func Download(c *gin.Context) {
 	case strings.Contains(c.Request.URL.String(), "?location"):
 		GetBucketLocation(c)
 
+	case c.Param("dataset") != "" && c.Param("filename") == "" && c.Request.Method == http.MethodHead:
+		HeadBucket(c)
+
 	case c.Param("dataset") != "" && c.Param("filename") == "":
 		ListObjects(c)
 
-	case c.Param("dataset") == "":
-		ListBuckets(c)
+	case c.Param("filename") != "" && c.Request.Method == http.MethodHead:
+		HeadObject(c)
+
+	case c.Param("filename") != "" && c.Request.URL.Query().Has("attributes"):
+		GetObjectAttributes(c)
 
 	case c.Param("filename") != "":
 		GetObject(c)
 
+	case c.Param("bucket") == "" && strings.Trim(c.Param("path"), "/") == "" && c.Query("prefix") == "":
+		ListBuckets(c)
+
 	default:
-		log.Warningf("Got unknown S3 request: %v", c.Request)
-		c.AbortWithStatus(http.StatusBadRequest)
+		log.Debugf("S3 request for unknown bucket: %v", c.Param("path"))
+		abortWithError(c, errNoSuchBucket)
 	}
 }
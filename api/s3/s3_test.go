@@ -3,9 +3,11 @@ package s3
 import (
 	"database/sql"
 	"encoding/xml"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
@@ -119,51 +121,14 @@ func (suite *S3TestSuite) TestListBuckets() {
 func (suite *S3TestSuite) TestListByPrefix() {
 
 	// Setup a mock database to handle queries
-	fileInfo := &database.FileInfo{
-		FileID:                    "file1",
-		DatasetID:                 "dataset1",
-		DisplayFileName:           "file.txt",
-		FilePath:                  "dir/file.txt",
-		FileName:                  "urn:file1",
-		FileSize:                  60,
-		DecryptedFileSize:         32,
-		DecryptedFileChecksum:     "hash",
-		DecryptedFileChecksumType: "sha256",
-		Status:                    "ready",
-		CreatedAt:                 "a while ago",
-		LastModified:              "2023-04-17T14:40:12.567Z",
-	}
 	query := `
-		SELECT files.stable_id AS id,
-			datasets.stable_id AS dataset_id,
-			reverse\(split_part\(reverse\(files.submission_file_path::text\), '/'::text, 1\)\) AS display_file_name,
-			files.submission_file_path AS file_path,
-			files.archive_file_path AS file_name,
-			files.archive_file_size AS file_size,
-			files.decrypted_file_size,
-			sha.checksum AS decrypted_file_checksum,
-			sha.type AS decrypted_file_checksum_type,
-			log.event AS status,
-			files.created_at,
-			files.last_modified
-		FROM sda.files
-		JOIN sda.file_dataset ON file_id = files.id
-		JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
-		LEFT JOIN \(SELECT file_id, \(ARRAY_AGG\(event ORDER BY started_at DESC\)\)\[1\] AS event FROM sda.file_event_log GROUP BY file_id\) log ON files.id = log.file_id
-		LEFT JOIN \(SELECT file_id, checksum, type FROM sda.checksums WHERE source = 'UNENCRYPTED'\) sha ON files.id = sha.file_id
-		WHERE datasets.stable_id = \$1;
+		SELECT key, decrypted_file_size, last_modified FROM \(
+			SELECT regexp_replace\(regexp_replace\(files.submission_file_path, '\\.c4gh\$', ''\), '\^\[\^/\]\*/', ''\) AS key,
 		`
 	suite.Mock.ExpectQuery(query).
-		WithArgs("dataset1").
-		WillReturnRows(sqlmock.NewRows([]string{"file_id", "dataset_id",
-			"display_file_name", "file_path", "file_name", "file_size",
-			"decrypted_file_size", "decrypted_file_checksum",
-			"decrypted_file_checksum_type", "file_status", "created_at",
-			"last_modified"}).AddRow(fileInfo.FileID, fileInfo.DatasetID,
-			fileInfo.DisplayFileName, fileInfo.FilePath, fileInfo.FileName,
-			fileInfo.FileSize, fileInfo.DecryptedFileSize,
-			fileInfo.DecryptedFileChecksum, fileInfo.DecryptedFileChecksumType,
-			fileInfo.Status, fileInfo.CreatedAt, fileInfo.LastModified))
+		WithArgs("dataset1", "", "fi%", 1001).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "decrypted_file_size", "last_modified"}).
+			AddRow("file.txt", 32, "2023-04-17T14:40:12.567Z"))
 
 	// Send a request through the middleware to get files for the dataset and
 	// prefix
@@ -180,13 +145,16 @@ func (suite *S3TestSuite) TestListByPrefix() {
 	defer response.Body.Close()
 
 	expected := xml.Header +
-		"<ListBucketResult><CommonPrefixes></CommonPrefixes><Contents>" +
+		"<ListBucketResult><Contents>" +
 		"<Key>file.txt</Key>" +
 		"<LastModified>Mon, 17 Apr 2023 14:40:12 GMT</LastModified>" +
 		"<Owner></Owner>" +
 		"<Size>32</Size>" +
 		"</Contents>" +
+		"<IsTruncated>false</IsTruncated>" +
+		"<MaxKeys>1000</MaxKeys>" +
 		"<Name>dataset1</Name>" +
+		"<Prefix>fi</Prefix>" +
 		"</ListBucketResult>"
 
 	assert.Equal(suite.T(), expected, string(body), "Wrong object list from S3")
@@ -198,51 +166,14 @@ func (suite *S3TestSuite) TestListByPrefix() {
 func (suite *S3TestSuite) TestListObjects() {
 
 	// Setup a mock database to handlequeries
-	fileInfo := &database.FileInfo{
-		FileID:                    "file1",
-		DatasetID:                 "dataset1",
-		DisplayFileName:           "file.txt",
-		FilePath:                  "dir/file.txt",
-		FileName:                  "urn:file1",
-		FileSize:                  60,
-		DecryptedFileSize:         32,
-		DecryptedFileChecksum:     "hash",
-		DecryptedFileChecksumType: "sha256",
-		Status:                    "ready",
-		CreatedAt:                 "a while ago",
-		LastModified:              "2023-04-17T14:40:12.567Z",
-	}
 	query := `
-		SELECT files.stable_id AS id,
-			datasets.stable_id AS dataset_id,
-			reverse\(split_part\(reverse\(files.submission_file_path::text\), '/'::text, 1\)\) AS display_file_name,
-			files.submission_file_path AS file_path,
-			files.archive_file_path AS file_name,
-			files.archive_file_size AS file_size,
-			files.decrypted_file_size,
-			sha.checksum AS decrypted_file_checksum,
-			sha.type AS decrypted_file_checksum_type,
-			log.event AS status,
-			files.created_at,
-			files.last_modified
-		FROM sda.files
-		JOIN sda.file_dataset ON file_id = files.id
-		JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
-		LEFT JOIN \(SELECT file_id, \(ARRAY_AGG\(event ORDER BY started_at DESC\)\)\[1\] AS event FROM sda.file_event_log GROUP BY file_id\) log ON files.id = log.file_id
-		LEFT JOIN \(SELECT file_id, checksum, type FROM sda.checksums WHERE source = 'UNENCRYPTED'\) sha ON files.id = sha.file_id
-		WHERE datasets.stable_id = \$1;
+		SELECT key, decrypted_file_size, last_modified FROM \(
+			SELECT regexp_replace\(regexp_replace\(files.submission_file_path, '\\.c4gh\$', ''\), '\^\[\^/\]\*/', ''\) AS key,
 		`
 	suite.Mock.ExpectQuery(query).
-		WithArgs("dataset1").
-		WillReturnRows(sqlmock.NewRows([]string{"file_id", "dataset_id",
-			"display_file_name", "file_path", "file_name", "file_size",
-			"decrypted_file_size", "decrypted_file_checksum",
-			"decrypted_file_checksum_type", "file_status", "created_at",
-			"last_modified"}).AddRow(fileInfo.FileID, fileInfo.DatasetID,
-			fileInfo.DisplayFileName, fileInfo.FilePath, fileInfo.FileName,
-			fileInfo.FileSize, fileInfo.DecryptedFileSize,
-			fileInfo.DecryptedFileChecksum, fileInfo.DecryptedFileChecksumType,
-			fileInfo.Status, fileInfo.CreatedAt, fileInfo.LastModified))
+		WithArgs("dataset1", "", "", 1001).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "decrypted_file_size", "last_modified"}).
+			AddRow("file.txt", 32, "2023-04-17T14:40:12.567Z"))
 
 	// Send a request through the middleware to get datasets
 
@@ -258,12 +189,14 @@ func (suite *S3TestSuite) TestListObjects() {
 	defer response.Body.Close()
 
 	expected := xml.Header +
-		"<ListBucketResult><CommonPrefixes></CommonPrefixes><Contents>" +
+		"<ListBucketResult><Contents>" +
 		"<Key>file.txt</Key>" +
 		"<LastModified>Mon, 17 Apr 2023 14:40:12 GMT</LastModified>" +
 		"<Owner></Owner>" +
 		"<Size>32</Size>" +
 		"</Contents>" +
+		"<IsTruncated>false</IsTruncated>" +
+		"<MaxKeys>1000</MaxKeys>" +
 		"<Name>dataset1</Name>" +
 		"</ListBucketResult>"
 
@@ -279,6 +212,7 @@ func (suite *S3TestSuite) TestParseParams() {
 		Path     string
 		Dataset  string
 		Filename string
+		Prefix   string
 	}
 
 	testParams := []paramTest{
@@ -290,6 +224,9 @@ func (suite *S3TestSuite) TestParseParams() {
 		{Path: "/https:/url/dataset/dir/file.txt", Dataset: "https://url/dataset", Filename: "dir/file.txt"},
 		{Path: "/https%3A%2F%2Furl%2Fdataset/file.txt", Dataset: "https://url/dataset", Filename: "file.txt"},
 		{Path: "/https%3A%2Furl%2Fdataset/file.txt", Dataset: "https://url/dataset", Filename: "file.txt"},
+		{Path: "/dataset1?prefix=dir/", Dataset: "dataset1", Prefix: "dir/"},
+		{Path: "/dataset1/?list-type=2&prefix=0", Dataset: "dataset1", Prefix: "0"},
+		{Path: "/https:?prefix=/url/dataset/dir/", Dataset: "https://url/dataset", Prefix: "dir/"},
 	}
 
 	for _, params := range testParams {
@@ -300,6 +237,7 @@ func (suite *S3TestSuite) TestParseParams() {
 
 			assert.Equal(suite.T(), params.Dataset, c.Param("dataset"), "Failed to parse dataset name")
 			assert.Equal(suite.T(), params.Filename, c.Param("filename"), "Failed to parse file name")
+			assert.Equal(suite.T(), params.Prefix, c.Param("prefix"), "Failed to parse prefix")
 			c.AbortWithStatus(http.StatusAccepted)
 		}
 
@@ -319,3 +257,125 @@ func (suite *S3TestSuite) TestParseParams() {
 	}
 
 }
+
+// objectsPage returns a GetObjectsPage for the sorted keys that counts the
+// pages read
+func objectsPage(keys []string, pages *int) func(string, database.ObjectFilter) ([]*database.ObjectInfo, error) {
+	return func(datasetID string, filter database.ObjectFilter) ([]*database.ObjectInfo, error) {
+		*pages++
+		objects := []*database.ObjectInfo{}
+		for _, key := range keys {
+			if key > filter.After && strings.HasPrefix(key, filter.Prefix) && len(objects) < filter.Limit {
+				objects = append(objects, &database.ObjectInfo{Key: key, DecryptedFileSize: 1, LastModified: "2023-04-17T14:40:12Z"})
+			}
+		}
+
+		return objects, nil
+	}
+}
+
+func TestListObjectsPages(t *testing.T) {
+	originalGetObjectsPage := database.GetObjectsPage
+	defer func() { database.GetObjectsPage = originalGetObjectsPage }()
+	pages := 0
+	database.GetObjectsPage = objectsPage([]string{"a", "dir/b", "dir/c", "dir/sub/d", "dir2/e", "f"}, &pages)
+
+	keys := func(list objectList, err error) []string {
+		assert.NoError(t, err)
+		names := []string{}
+		for _, object := range list.contents {
+			names = append(names, object.Key)
+		}
+		for _, prefix := range list.prefixes {
+			names = append(names, prefix.Prefix+"*")
+		}
+
+		return names
+	}
+
+	list, err := listObjects("dataset1", "", "", "", 1000)
+	assert.NoError(t, err)
+	assert.Len(t, list.contents, 6)
+	assert.False(t, list.truncated)
+
+	assert.Equal(t, []string{"a", "f", "dir/*", "dir2/*"}, keys(listObjects("dataset1", "", "/", "", 1000)))
+	assert.Equal(t, []string{"dir/b", "dir/c", "dir/sub/*"}, keys(listObjects("dataset1", "dir/", "/", "", 1000)))
+
+	// Pages continue after the last key or common prefix, and pages from
+	// the database that are rolled up are skipped past
+	pages = 0
+	list, err = listObjects("dataset1", "", "/", "", 2)
+	assert.Equal(t, []string{"a", "dir/*"}, keys(list, err))
+	assert.True(t, list.truncated)
+	assert.Equal(t, "dir/", list.next)
+	assert.Equal(t, 2, pages)
+	list, err = listObjects("dataset1", "", "/", list.next, 2)
+	assert.Equal(t, []string{"f", "dir2/*"}, keys(list, err))
+	assert.False(t, list.truncated)
+
+	list, err = listObjects("dataset1", "dir/", "", "dir/b", 2)
+	assert.Equal(t, []string{"dir/c", "dir/sub/d"}, keys(list, err))
+	assert.False(t, list.truncated)
+
+	// Empty pages are not truncated
+	pages = 0
+	list, err = listObjects("dataset1", "", "", "", 0)
+	assert.Equal(t, []string{}, keys(list, err))
+	assert.False(t, list.truncated)
+	assert.Equal(t, 0, pages)
+
+	database.GetObjectsPage = func(datasetID string, filter database.ObjectFilter) ([]*database.ObjectInfo, error) {
+		return nil, errors.New("database error")
+	}
+	_, err = listObjects("dataset1", "", "", "", 2)
+	assert.EqualError(t, err, "database error")
+}
+
+func TestListObjectsV2(t *testing.T) {
+	originalGetObjectsPage := database.GetObjectsPage
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	defer func() {
+		database.GetObjectsPage = originalGetObjectsPage
+		middleware.GetCacheFromContext = originalGetCacheFromContext
+	}()
+	pages := 0
+	database.GetObjectsPage = objectsPage([]string{"a", "dir/b b", "dir/c", "e"}, &pages)
+	middleware.GetCacheFromContext = func(c *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}}
+	}
+
+	list := func(query string) ListBucketV2Result {
+		w := httptest.NewRecorder()
+		_, router := gin.CreateTestContext(w)
+		router.GET("/*path", Download)
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/dataset1?list-type=2&"+query, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var result ListBucketV2Result
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+
+		return result
+	}
+
+	result := list("delimiter=/&max-keys=2&encoding-type=url")
+	assert.Equal(t, 2, result.KeyCount)
+	assert.True(t, result.IsTruncated)
+	assert.Equal(t, "a", result.Contents[0].Key)
+	assert.Equal(t, []CommonPrefix{{Prefix: "dir%2F"}}, result.CommonPrefixes)
+	assert.Equal(t, "url", result.EncodingType)
+
+	result = list("delimiter=/&max-keys=2&continuation-token=" + result.NextContinuationToken)
+	assert.Equal(t, 1, result.KeyCount)
+	assert.False(t, result.IsTruncated)
+	assert.Equal(t, "e", result.Contents[0].Key)
+
+	result = list("prefix=dir/&start-after=dir/b")
+	assert.Equal(t, "dir/", result.Prefix)
+	assert.Equal(t, 2, result.KeyCount)
+	assert.Equal(t, "dir/b b", result.Contents[0].Key)
+
+	result = list("max-keys=0")
+	assert.Equal(t, 0, result.KeyCount)
+	assert.False(t, result.IsTruncated)
+	assert.Empty(t, result.NextContinuationToken)
+}
@@ -0,0 +1,229 @@
+package sda
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/crypt4gh/streaming"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveWriter is the common interface for writing tar and zip streams
+type archiveWriter interface {
+	// addFile starts a new archive entry, returning a writer for its contents
+	addFile(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+// tarArchive writes files to a tar stream
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) addFile(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modified,
+		Format:   tar.FormatPAX,
+	})
+
+	return t.Writer, err
+}
+
+// zipArchive writes files to a zip stream, entries are deflated and ZIP64
+// records are used where needed for large files. The sizes of streamed
+// entries are only known afterwards, and stored entries with data descriptors
+// can't be read by streaming unzippers, so entries are always deflated.
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) addFile(name string, _ int64, modified time.Time) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+}
+
+// newArchiveWriter returns an archiveWriter for the requested format, along
+// with the content type and file extension of the archive
+func newArchiveWriter(format string, writer io.Writer) (archiveWriter, string, string, error) {
+	switch format {
+	case "", "tar":
+		return tarArchive{tar.NewWriter(writer)}, "application/x-tar", "tar", nil
+	case "zip":
+		return zipArchive{zip.NewWriter(writer)}, "application/zip", "zip", nil
+	default:
+		return nil, "", "", fmt.Errorf("unsupported archive format %s", format)
+	}
+}
+
+// archiveEntryName returns the name of a file inside a downloaded archive,
+// which is the upload path without the uploading user and the .c4gh suffix
+func archiveEntryName(file *database.FileInfo) string {
+	name := strings.TrimSuffix(file.FilePath, ".c4gh")
+
+	// The first part of the upload path is the user id, which should be
+	// removed
+	parts := strings.Split(name, "/")
+	if len(parts) > 1 {
+		parts = parts[1:]
+	}
+	name = strings.Join(parts, "/")
+
+	// Never let entries point outside of the extraction directory
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = strings.TrimSuffix(file.DisplayFileName, ".c4gh")
+	}
+
+	return name
+}
+
+// archiveFileName returns a file name for the archive of a dataset
+func archiveFileName(dataset, extension string) string {
+	var pattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+	return fmt.Sprintf("%s.%s", strings.Trim(pattern.ReplaceAllString(dataset, "_"), "_"), extension)
+}
+
+// decryptedFile is the decrypted stream of a file in the archive storage
+type decryptedFile struct {
+	*streaming.Crypt4GHReader
+	archiveFile io.Closer
+}
+
+// Close closes both the decrypting stream and the archive file
+func (d *decryptedFile) Close() error {
+	d.Crypt4GHReader.Close()
+
+	return d.archiveFile.Close()
+}
+
+// openDecryptedFile opens a file in the archive storage for reading its
+// decrypted content
+func openDecryptedFile(ctx context.Context, fileDetails *database.FileDownload) (*decryptedFile, error) {
+	archiveFile, err := Backend.NewFileReader(ctx, fileDetails.ArchivePath)
+	if err != nil {
+		return nil, fmt.Errorf("archive error, %w", err)
+	}
+
+	c4ghr, err := streaming.NewCrypt4GHReader(io.MultiReader(bytes.NewReader(fileDetails.Header), archiveFile), *config.Config.App.Crypt4GHKey, nil)
+	if err != nil {
+		archiveFile.Close()
+
+		return nil, fmt.Errorf("file stream error, %w", err)
+	}
+
+	return &decryptedFile{Crypt4GHReader: c4ghr, archiveFile: archiveFile}, nil
+}
+
+// writeArchiveEntry decrypts a file from the archive storage and writes it as
+// an entry of the archive stream. It tells if the entry was started, in which
+// case an error leaves the archive incomplete.
+func writeArchiveEntry(ctx context.Context, aw archiveWriter, fileID string, fileDetails *database.FileDownload, name string) (bool, error) {
+	decrypted, err := openDecryptedFile(ctx, fileDetails)
+	if err != nil {
+		return false, err
+	}
+	defer decrypted.Close()
+
+	size := int64(fileDetails.DecryptedSize)
+	var reader io.ReadSeeker = decrypted
+	if fileDetails.DecryptedChecksum != "" {
+		verifier, err := newVerifyingReader(decrypted, size, fileDetails.DecryptedChecksum, fileDetails.DecryptedChecksumType)
+		if err != nil {
+			log.Warnf("file %s can't be verified while streaming, %s", fileID, err)
+		} else {
+			reader = verifier
+		}
+	}
+
+	modified, err := time.Parse(time.RFC3339, fileDetails.LastModified)
+	if err != nil {
+		modified = time.Now()
+	}
+
+	entry, err := aw.addFile(name, size, modified)
+	if err != nil {
+		return true, err
+	}
+
+	_, err = io.CopyN(entry, reader, size)
+
+	return true, err
+}
+
+// DatasetArchive streams all files of a dataset, decrypted, as a tar or zip
+// archive
+func DatasetArchive(c *gin.Context) {
+
+	// get dataset parameter
+	dataset := c.Param("dataset")
+
+	if !strings.HasSuffix(dataset, "/archive") {
+		c.String(http.StatusNotFound, "API path not found, maybe /archive is missing")
+
+		return
+	}
+
+	// remove / prefix and /archive suffix
+	dataset = strings.TrimPrefix(dataset, "/")
+	dataset = strings.TrimSuffix(dataset, "/archive")
+	dataset = addDatasetScheme(dataset, c.Query("scheme"))
+
+	// Get dataset files
+	files, code, err := getFiles(dataset, c)
+	if err != nil {
+		c.String(code, err.Error())
+
+		return
+	}
+
+	aw, contentType, extension, err := newArchiveWriter(c.Query("format"), c.Writer)
+	if err != nil {
+		c.String(http.StatusBadRequest, "format must be tar or zip")
+
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveFileName(dataset, extension)))
+	c.Status(http.StatusOK)
+
+	for _, file := range files {
+		log.Debugf("adding file %s to archive of dataset %s", file.FileID, sanitizeString(dataset))
+		fileDetails, err := database.GetFile(file.FileID)
+		if err == nil {
+			_, err = writeArchiveEntry(c.Request.Context(), aw, file.FileID, fileDetails, archiveEntryName(file))
+		}
+		if err != nil {
+			// The response has already started, so the only way to signal
+			// the error is to close the connection without finishing the
+			// archive
+			log.Errorf("failed to add file %s to archive of dataset %s, %s", file.FileID, sanitizeString(dataset), err)
+			abortResponse()
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		log.Errorf("failed to finish archive of dataset %s, %s", sanitizeString(dataset), err)
+		abortResponse()
+	}
+}
@@ -0,0 +1,125 @@
+package sda
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neicnordic/sda-download/internal/database"
+)
+
+func TestArchiveEntryName(t *testing.T) {
+	assert.Equal(t, "dir/file.txt", archiveEntryName(&database.FileInfo{FilePath: "user/dir/file.txt.c4gh"}))
+	assert.Equal(t, "file.txt", archiveEntryName(&database.FileInfo{FilePath: "file.txt.c4gh"}))
+	assert.Equal(t, "etc/passwd", archiveEntryName(&database.FileInfo{FilePath: "user/../../etc/passwd"}))
+	assert.Equal(t, "display.txt", archiveEntryName(&database.FileInfo{FilePath: "user/", DisplayFileName: "display.txt.c4gh"}))
+}
+
+func requestDatasetArchive(path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/datasets"+path, nil)
+
+	return serve(DatasetArchive, r, gin.Param{Key: "dataset", Value: r.URL.Path[len("/datasets"):]})
+}
+
+func TestDatasetArchive_Tar(t *testing.T) {
+
+	data := []byte("this is a test file")
+	mockFileDownload(t, data)
+	mockDatasetFiles(t)
+
+	w := requestDatasetArchive("/dataset1/archive")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-tar", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="dataset1.tar"`, w.Header().Get("Content-Disposition"))
+
+	tr := tar.NewReader(w.Body)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, header.Name)
+		content, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+	}
+	assert.Equal(t, []string{"dir/first.txt", "second.txt"}, names)
+}
+
+func TestDatasetArchive_Zip(t *testing.T) {
+
+	data := []byte("this is a test file")
+	mockFileDownload(t, data)
+	mockDatasetFiles(t)
+
+	w := requestDatasetArchive("/dataset1/archive?format=zip")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, zr.File, 2)
+	for _, f := range zr.File {
+		assert.Equal(t, zip.Deflate, f.Method)
+		r, err := f.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, data, content)
+	}
+}
+
+func TestDatasetArchive_Fail(t *testing.T) {
+
+	// The first file is larger than the write buffer, so that it is sent
+	// before the second one fails
+	data := bytes.Repeat([]byte("this is a test file"), 1000)
+	mockFileDownload(t, data)
+	mockDatasetFiles(t)
+
+	w := requestDatasetArchive("/dataset1/files")
+	assert.Equal(t, 404, w.Code)
+
+	w = requestDatasetArchive("/dataset2/archive")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "dataset not found", w.Body.String())
+
+	w = requestDatasetArchive("/dataset1/archive?format=rar")
+	assert.Equal(t, 400, w.Code)
+
+	// A file failing mid-stream closes the connection before the archive is
+	// finished
+	getFile := database.GetFile
+	mock(t, &database.GetFile, func(fileID string) (*database.FileDownload, error) {
+		if fileID == "file2" {
+			return nil, errors.New("database error")
+		}
+
+		return getFile(fileID)
+	})
+
+	response, body, err := fetch(DatasetArchive, "/datasets/*dataset", "GET", "/datasets/dataset1/archive", nil)
+	if !assert.NotNil(t, response) {
+		return
+	}
+	assert.Equal(t, 200, response.StatusCode)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "transfer of a failed archive ended cleanly")
+
+	// The first file was sent, but the end of archive marker of two zero
+	// blocks never was
+	tr := tar.NewReader(bytes.NewReader(body))
+	_, err = tr.Next()
+	assert.NoError(t, err)
+	_, err = io.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.False(t, bytes.HasSuffix(body, make([]byte, 1024)))
+}
@@ -0,0 +1,149 @@
+package sda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// bundleManifestName is the name of the entry listing the outcome for each
+// requested file, which is the last entry of a complete bundle
+const bundleManifestName = "manifest.json"
+
+// bundleManifestEntry is the outcome of adding a file to a bundle
+type bundleManifestEntry struct {
+	FileID string `json:"fileId"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// maxBundleRequestSize is the largest request body accepted for a bundle
+const maxBundleRequestSize = 1 << 20
+
+// bundleFile looks up a requested file, checking that the user has
+// permission to it, and returns it or a message for the manifest
+func bundleFile(fileID string, datasets []string) (*database.FileDownload, string) {
+	dataset, err := database.CheckFilePermission(fileID)
+	if err != nil {
+		return nil, "file not found"
+	}
+
+	if !find(dataset, datasets) {
+		log.Debugf("user requested file %s in bundle, but does not have permissions for dataset %s", sanitizeString(fileID), sanitizeString(dataset))
+
+		return nil, "unauthorised"
+	}
+
+	fileDetails, err := database.GetFile(fileID)
+	if err != nil {
+		log.Errorf("database query failed for file %s, reason %s", sanitizeString(fileID), err)
+
+		return nil, "database error"
+	}
+
+	return fileDetails, ""
+}
+
+// Bundle streams a selection of files, decrypted, as a tar or zip archive.
+// Files that can't be added are reported in a manifest at the end of the
+// archive instead of failing the whole request.
+func Bundle(c *gin.Context) {
+	var fileIDs []string
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBundleRequestSize)
+	if err := json.NewDecoder(c.Request.Body).Decode(&fileIDs); err != nil || len(fileIDs) == 0 {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.String(http.StatusRequestEntityTooLarge, "request body too large")
+
+			return
+		}
+		c.String(http.StatusBadRequest, "request body must be a JSON list of file IDs")
+
+		return
+	}
+	if maxFiles := config.Config.App.BundleMaxFiles; maxFiles > 0 && len(fileIDs) > maxFiles {
+		c.String(http.StatusBadRequest, fmt.Sprintf("at most %d files can be bundled", maxFiles))
+
+		return
+	}
+
+	aw, contentType, extension, err := newArchiveWriter(c.Query("format"), c.Writer)
+	if err != nil {
+		c.String(http.StatusBadRequest, "format must be tar or zip")
+
+		return
+	}
+
+	// Get datasets from request context, parsed previously by token middleware
+	cache := middleware.GetCacheFromContext(c)
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "bundle."+extension))
+	c.Status(http.StatusOK)
+
+	manifest := []bundleManifestEntry{}
+	seen := map[string]bool{}
+	names := map[string]bool{bundleManifestName: true}
+	for _, fileID := range fileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+
+		fileDetails, message := bundleFile(fileID, cache.Datasets)
+		if fileDetails == nil {
+			manifest = append(manifest, bundleManifestEntry{FileID: fileID, Status: "failed", Error: message})
+
+			continue
+		}
+
+		// Files with the same path in different datasets are put in a
+		// directory named by their file ID
+		name := archiveEntryName(&database.FileInfo{FilePath: fileDetails.FilePath})
+		if name == "" {
+			name = fileID
+		}
+		if names[name] {
+			name = fileID + "/" + name
+		}
+		names[name] = true
+
+		started, err := writeArchiveEntry(c.Request.Context(), aw, fileID, fileDetails, name)
+		if err != nil {
+			log.Errorf("failed to add file %s to bundle, %s", sanitizeString(fileID), err)
+			// A partly written entry can't be taken back, so the only way to
+			// signal the error is to close the connection without finishing
+			// the archive
+			if started {
+				abortResponse()
+			}
+			manifest = append(manifest, bundleManifestEntry{FileID: fileID, Name: name, Status: "failed", Error: "file could not be read"})
+
+			continue
+		}
+
+		manifest = append(manifest, bundleManifestEntry{FileID: fileID, Name: name, Status: "ok"})
+	}
+
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	entry, err := aw.addFile(bundleManifestName, int64(len(data)), time.Now())
+	if err == nil {
+		_, err = entry.Write(data)
+	}
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		log.Errorf("failed to finish bundle, %s", err)
+		abortResponse()
+	}
+}
@@ -0,0 +1,158 @@
+package sda
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+)
+
+func requestBundle(path, body string) *httptest.ResponseRecorder {
+	return serve(Bundle, httptest.NewRequest("POST", path, strings.NewReader(body)))
+}
+
+func TestBundle(t *testing.T) {
+
+	data := []byte("this is a test file")
+	mockFileDownload(t, data)
+	mockBundlePaths(t)
+
+	mock(t, &database.CheckFilePermission, func(fileID string) (string, error) {
+		switch fileID {
+		case "file1", "file2":
+			return "dataset1", nil
+		case "file3":
+			return "dataset2", nil
+		default:
+			return "", errors.New("no rows")
+		}
+	})
+
+	w := requestBundle("/files/bundle", `["file2", "file3", "file4", "file1", "file2"]`)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-tar", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="bundle.tar"`, w.Header().Get("Content-Disposition"))
+
+	tr := tar.NewReader(w.Body)
+	var names []string
+	var manifest []bundleManifestEntry
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, header.Name)
+		content, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		if header.Name == bundleManifestName {
+			assert.NoError(t, json.Unmarshal(content, &manifest))
+
+			continue
+		}
+		assert.Equal(t, data, content)
+	}
+	assert.Equal(t, []string{"second.txt", "dir/first.txt", bundleManifestName}, names)
+	assert.Equal(t, []bundleManifestEntry{
+		{FileID: "file2", Name: "second.txt", Status: "ok"},
+		{FileID: "file3", Status: "failed", Error: "unauthorised"},
+		{FileID: "file4", Status: "failed", Error: "file not found"},
+		{FileID: "file1", Name: "dir/first.txt", Status: "ok"},
+	}, manifest)
+}
+
+func TestBundle_FailedFile(t *testing.T) {
+
+	data := []byte("this is a test file")
+	mockFileDownload(t, data)
+	mockBundlePaths(t)
+
+	// file1 is missing from the archive, so it fails before its entry is
+	// added, while a checksum mismatch fails file2 after its entry is added
+	checksumMismatch := false
+	getFile := database.GetFile
+	mock(t, &database.GetFile, func(fileID string) (*database.FileDownload, error) {
+		fileDetails, err := getFile(fileID)
+		if fileID == "file1" {
+			fileDetails.ArchivePath = "missing"
+		}
+		if fileID == "file2" && checksumMismatch {
+			fileDetails.DecryptedChecksum = strings.Repeat("0", 64)
+		}
+
+		return fileDetails, err
+	})
+
+	for _, format := range []string{"tar", "zip"} {
+		checksumMismatch = false
+		w := requestBundle("/files/bundle?format="+format, `["file1", "file2"]`)
+		assert.Equal(t, 200, w.Code)
+
+		contents := map[string][]byte{}
+		if format == "tar" {
+			tr := tar.NewReader(w.Body)
+			for {
+				header, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				assert.NoError(t, err)
+				contents[header.Name], _ = io.ReadAll(tr)
+			}
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			assert.NoError(t, err)
+			for _, f := range zr.File {
+				r, _ := f.Open()
+				contents[f.Name], _ = io.ReadAll(r)
+			}
+		}
+
+		assert.Equal(t, data, contents["second.txt"], format)
+		assert.NotContains(t, contents, "dir/first.txt", format)
+
+		var manifest []bundleManifestEntry
+		assert.NoError(t, json.Unmarshal(contents[bundleManifestName], &manifest))
+		assert.Equal(t, []bundleManifestEntry{
+			{FileID: "file1", Name: "dir/first.txt", Status: "failed", Error: "file could not be read"},
+			{FileID: "file2", Name: "second.txt", Status: "ok"},
+		}, manifest, format)
+
+		// A file failing after its entry was added closes the connection
+		// without finishing the archive
+		checksumMismatch = true
+		_, body, err := fetch(Bundle, "/files/bundle", "POST", "/files/bundle?format="+format, strings.NewReader(`["file2"]`))
+		assert.Error(t, err, format)
+		assert.NotContains(t, string(body), bundleManifestName, format)
+	}
+}
+
+func TestBundle_BadRequest(t *testing.T) {
+	w := requestBundle("/files/bundle", `{"files": ["file1"]}`)
+	assert.Equal(t, 400, w.Code)
+
+	w = requestBundle("/files/bundle", `[]`)
+	assert.Equal(t, 400, w.Code)
+
+	w = requestBundle("/files/bundle?format=rar", `["file1"]`)
+	assert.Equal(t, 400, w.Code)
+
+	// Large requests are refused
+	w = requestBundle("/files/bundle", `["`+strings.Repeat("a", maxBundleRequestSize)+`"]`)
+	assert.Equal(t, 413, w.Code)
+
+	mock(t, &config.Config.App.BundleMaxFiles, 2)
+	w = requestBundle("/files/bundle", `["file1", "file2", "file3"]`)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "at most 2 files can be bundled", w.Body.String())
+}
@@ -0,0 +1,73 @@
+package sda
+
+import (
+	"crypto/md5" // #nosec md5 checksums may be stored for older files
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// errChecksumMismatch is returned when streamed data doesn't match the
+// checksum stored for the file
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// newChecksumHash returns a hash for a checksum type as stored in the
+// sda.checksums table
+func newChecksumHash(checksumType string) (hash.Hash, error) {
+	switch strings.ToUpper(checksumType) {
+	case "SHA256":
+		return sha256.New(), nil
+	case "SHA384":
+		return sha512.New384(), nil
+	case "SHA512":
+		return sha512.New(), nil
+	case "MD5":
+		return md5.New(), nil // #nosec
+	default:
+		return nil, fmt.Errorf("unsupported checksum type %s", checksumType)
+	}
+}
+
+// verifyingReader hashes the data read from a file stream and checks it
+// against the stored checksum when the end of the file is reached. On a
+// mismatch the last part of the file is withheld and errChecksumMismatch is
+// returned, so that a client never gets the complete corrupted file.
+// Seeking is passed through, which is only valid before any data is read.
+type verifyingReader struct {
+	io.ReadSeeker
+	hash     hash.Hash
+	checksum string
+	size     int64
+	read     int64
+}
+
+// newVerifyingReader returns a verifyingReader for a file of the given size
+// and checksum
+func newVerifyingReader(reader io.ReadSeeker, size int64, checksum, checksumType string) (*verifyingReader, error) {
+	h, err := newChecksumHash(checksumType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifyingReader{ReadSeeker: reader, hash: h, checksum: checksum, size: size}, nil
+}
+
+// Read implements io.Reader for the verifyingReader
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadSeeker.Read(p)
+	v.hash.Write(p[:n])
+	v.read += int64(n)
+
+	if v.read >= v.size || err == io.EOF {
+		if !strings.EqualFold(hex.EncodeToString(v.hash.Sum(nil)), v.checksum) {
+			return 0, errChecksumMismatch
+		}
+	}
+
+	return n, err
+}
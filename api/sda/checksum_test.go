@@ -0,0 +1,40 @@
+package sda
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyingReader(t *testing.T) {
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for checksumType, checksum := range map[string]string{
+		"SHA256": fmt.Sprintf("%x", sha256.Sum256(data)),
+		"md5":    fmt.Sprintf("%X", md5.Sum(data)), // #nosec
+	} {
+		verifier, err := newVerifyingReader(bytes.NewReader(data), int64(len(data)), checksum, checksumType)
+		assert.NoError(t, err)
+		read, err := io.ReadAll(verifier)
+		assert.NoError(t, err, "verification failed for %s", checksumType)
+		assert.Equal(t, data, read)
+	}
+
+	// Corrupted data is detected before the last part is returned
+	corrupted := bytes.Clone(data)
+	corrupted[42] = 'x'
+	verifier, err := newVerifyingReader(bytes.NewReader(corrupted), int64(len(corrupted)), fmt.Sprintf("%x", sha256.Sum256(data)), "SHA256")
+	assert.NoError(t, err)
+	read, err := io.ReadAll(io.LimitReader(verifier, int64(len(data))))
+	assert.ErrorIs(t, err, errChecksumMismatch)
+	assert.Less(t, len(read), len(data))
+
+	_, err = newVerifyingReader(bytes.NewReader(data), int64(len(data)), "abc", "CRC32")
+	assert.Error(t, err)
+}
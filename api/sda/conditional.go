@@ -0,0 +1,107 @@
+package sda
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// CheckPreconditions evaluates the conditional headers of a request against
+// the entity tag and modification time of the requested file, in the order
+// given in RFC 7232 section 6. It returns the status code to respond with when
+// a condition fails, or 0 if the request should be served. The file must
+// exist, and an empty etag or a zero lastModified means it has no such
+// validator.
+func CheckPreconditions(r *http.Request, etag string, lastModified time.Time) int {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := headerTime(r, "If-Unmodified-Since"); ok && !lastModified.IsZero() {
+		if lastModified.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchETag(ifNoneMatch, etag, true) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				return http.StatusNotModified
+			}
+
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := headerTime(r, "If-Modified-Since"); ok && !lastModified.IsZero() {
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !lastModified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// ifRangeMatches reports whether the Range header of a request should be
+// used, which is the case unless an If-Range header is given that doesn't
+// match the current version of the file (RFC 7233 section 3.2).
+func ifRangeMatches(r *http.Request, etag string, lastModified time.Time) bool {
+	ifRange := textproto.TrimString(r.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	// If-Range holds either a strong entity tag or a date
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && !strings.HasPrefix(ifRange, "W/") && ifRange == etag
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+
+	return lastModified.Truncate(time.Second).Equal(t)
+}
+
+// matchETag reports whether the quoted entity tag etag is in the list of
+// entity tags in header, or header is "*", which matches any existing file
+// even without an entity tag (RFC 7232 section 3.1). Weak comparison ignores
+// the weak indicator, while strong comparison never matches weak tags.
+func matchETag(header, etag string, weak bool) bool {
+	if textproto.TrimString(header) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = textproto.TrimString(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerTime parses an HTTP date from the named request header
+func headerTime(r *http.Request, name string) (time.Time, bool) {
+	value := r.Header.Get(name)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
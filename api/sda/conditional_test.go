@@ -0,0 +1,82 @@
+package sda
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+
+	etag := `"abc123"`
+	lastModified := time.Date(2023, 4, 17, 14, 40, 12, 567, time.UTC)
+	before := lastModified.Add(-time.Hour).Format(http.TimeFormat)
+	after := lastModified.Add(time.Hour).Format(http.TimeFormat)
+
+	type preconditionTest struct {
+		Method   string
+		Headers  map[string]string
+		Expected int
+	}
+
+	tests := []preconditionTest{
+		{Method: "GET", Headers: map[string]string{}, Expected: 0},
+		{Method: "GET", Headers: map[string]string{"If-Match": `"abc123"`}, Expected: 0},
+		{Method: "GET", Headers: map[string]string{"If-Match": `"other", "abc123"`}, Expected: 0},
+		{Method: "GET", Headers: map[string]string{"If-Match": "*"}, Expected: 0},
+		{Method: "GET", Headers: map[string]string{"If-Match": `W/"abc123"`}, Expected: http.StatusPreconditionFailed},
+		{Method: "GET", Headers: map[string]string{"If-Match": `"other"`}, Expected: http.StatusPreconditionFailed},
+		{Method: "GET", Headers: map[string]string{"If-Unmodified-Since": after}, Expected: 0},
+		{Method: "GET", Headers: map[string]string{"If-Unmodified-Since": before}, Expected: http.StatusPreconditionFailed},
+		{Method: "GET", Headers: map[string]string{"If-None-Match": `"abc123"`}, Expected: http.StatusNotModified},
+		{Method: "HEAD", Headers: map[string]string{"If-None-Match": `W/"abc123"`}, Expected: http.StatusNotModified},
+		{Method: "GET", Headers: map[string]string{"If-None-Match": `"other"`}, Expected: 0},
+		{Method: "GET", Headers: map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, Expected: http.StatusNotModified},
+		{Method: "GET", Headers: map[string]string{"If-Modified-Since": before}, Expected: 0},
+		// If-None-Match takes precedence over If-Modified-Since
+		{Method: "GET", Headers: map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, Expected: 0},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.Method, "/files/file1", nil)
+		for k, v := range test.Headers {
+			r.Header.Set(k, v)
+		}
+		assert.Equal(t, test.Expected, CheckPreconditions(r, etag, lastModified), "wrong result for %v", test.Headers)
+	}
+
+	// Without an entity tag, tags never match but "*" still matches the file
+	r := httptest.NewRequest("GET", "/files/file1", nil)
+	r.Header.Set("If-Match", `"abc123"`)
+	assert.Equal(t, http.StatusPreconditionFailed, CheckPreconditions(r, "", lastModified))
+	r.Header.Set("If-Match", "*")
+	assert.Equal(t, 0, CheckPreconditions(r, "", lastModified))
+	r.Header.Del("If-Match")
+	r.Header.Set("If-None-Match", "*")
+	assert.Equal(t, http.StatusNotModified, CheckPreconditions(r, "", lastModified))
+}
+
+func TestIfRangeMatches(t *testing.T) {
+
+	etag := `"abc123"`
+	lastModified := time.Date(2023, 4, 17, 14, 40, 12, 567, time.UTC)
+
+	tests := map[string]bool{
+		"":                                   true,
+		`"abc123"`:                           true,
+		`W/"abc123"`:                         false,
+		`"other"`:                            false,
+		lastModified.Format(http.TimeFormat): true,
+		lastModified.Add(time.Hour).Format(http.TimeFormat): false,
+		"not a date": false,
+	}
+
+	for header, expected := range tests {
+		r := httptest.NewRequest("GET", "/files/file1", nil)
+		r.Header.Set("If-Range", header)
+		assert.Equal(t, expected, ifRangeMatches(r, etag, lastModified), "wrong result for %s", header)
+	}
+}
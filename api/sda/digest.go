@@ -0,0 +1,117 @@
+package sda
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// digestAlgorithms maps the checksum types of the sda.checksums table to the
+// algorithm names used in the HTTP digest fields (RFC 9530)
+var digestAlgorithms = map[string]string{
+	"SHA256": "sha-256",
+	"SHA512": "sha-512",
+}
+
+// reprDigest returns the Repr-Digest field value for a file with the given
+// stored checksum, or an empty string if the checksum type has no digest
+// algorithm or the client's Want-Repr-Digest preferences exclude it
+func reprDigest(want, checksum, checksumType string) string {
+	algorithm, ok := digestAlgorithms[strings.ToUpper(checksumType)]
+	if !ok {
+		return ""
+	}
+	if want != "" && parseWantDigest(want)[algorithm] == 0 {
+		return ""
+	}
+
+	sum, err := hex.DecodeString(checksum)
+	if err != nil {
+		return ""
+	}
+
+	return formatDigest(algorithm, sum)
+}
+
+// contentDigestHash returns the algorithm name and a hash for computing the
+// Content-Digest of a response, picking the algorithm with the highest
+// preference in the client's Want-Content-Digest field. A nil hash means the
+// client accepts none of the supported algorithms.
+func contentDigestHash(want string) (string, hash.Hash) {
+	if want == "" {
+		return "sha-256", sha256.New()
+	}
+
+	preferences := parseWantDigest(want)
+	algorithm := ""
+	for _, candidate := range []string{"sha-256", "sha-512"} {
+		if preferences[candidate] > preferences[algorithm] {
+			algorithm = candidate
+		}
+	}
+
+	switch algorithm {
+	case "sha-256":
+		return algorithm, sha256.New()
+	case "sha-512":
+		return algorithm, sha512.New()
+	default:
+		return "", nil
+	}
+}
+
+// parseWantDigest parses a Want-Repr-Digest or Want-Content-Digest field into
+// a map of algorithm preferences, where 0 means not acceptable
+func parseWantDigest(want string) map[string]int {
+	preferences := map[string]int{}
+	for _, member := range strings.Split(want, ",") {
+		key, value, found := strings.Cut(textproto.TrimString(member), "=")
+		key = strings.ToLower(textproto.TrimString(key))
+		if key == "" {
+			continue
+		}
+
+		// A member without a value is a boolean true
+		preference := 1
+		if found {
+			p, err := strconv.Atoi(textproto.TrimString(value))
+			if err != nil || p < 0 {
+				continue
+			}
+			preference = p
+		}
+		preferences[key] = preference
+	}
+
+	return preferences
+}
+
+// formatDigest formats a digest as a member of a digest field, i.e. the
+// algorithm name and the digest as a structured field byte sequence
+func formatDigest(algorithm string, sum []byte) string {
+	return fmt.Sprintf("%s=:%s:", algorithm, base64.StdEncoding.EncodeToString(sum))
+}
+
+// acceptsTrailers reports whether the client has signalled that it wants
+// trailer fields, either with "TE: trailers" or by asking for a content digest
+func acceptsTrailers(r *http.Request) bool {
+	if r.Header.Get("Want-Content-Digest") != "" {
+		return true
+	}
+	for _, te := range r.Header.Values("TE") {
+		for _, value := range strings.Split(te, ",") {
+			if strings.EqualFold(textproto.TrimString(value), "trailers") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
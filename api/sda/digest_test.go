@@ -0,0 +1,56 @@
+package sda
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReprDigest(t *testing.T) {
+
+	sum := sha256.Sum256([]byte("data"))
+	checksum := fmt.Sprintf("%x", sum)
+	expected := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+	assert.Equal(t, expected, reprDigest("", checksum, "SHA256"))
+	assert.Equal(t, expected, reprDigest("sha-512=3, sha-256=10", checksum, "sha256"))
+	assert.Equal(t, "", reprDigest("sha-512=3, sha-256=0", checksum, "SHA256"))
+	assert.Equal(t, "", reprDigest("", checksum, "MD5"))
+	assert.Equal(t, "", reprDigest("", "not hex", "SHA256"))
+}
+
+func TestContentDigestHash(t *testing.T) {
+
+	algorithm, h := contentDigestHash("")
+	assert.Equal(t, "sha-256", algorithm)
+	assert.NotNil(t, h)
+
+	algorithm, h = contentDigestHash("sha-256=1, sha-512=3")
+	assert.Equal(t, "sha-512", algorithm)
+	assert.NotNil(t, h)
+
+	algorithm, h = contentDigestHash("unixsum=5")
+	assert.Equal(t, "", algorithm)
+	assert.Nil(t, h)
+}
+
+func TestParseWantDigest(t *testing.T) {
+	assert.Equal(t, map[string]int{"sha-256": 10, "sha-512": 3, "md5": 1}, parseWantDigest("SHA-256=10, sha-512=3, md5, crc=x"))
+}
+
+func TestAcceptsTrailers(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "/files/file1", nil)
+	assert.False(t, acceptsTrailers(r))
+
+	r.Header.Set("TE", "gzip, trailers")
+	assert.True(t, acceptsTrailers(r))
+
+	r = httptest.NewRequest("GET", "/files/file1", nil)
+	r.Header.Set("Want-Content-Digest", "sha-256=1")
+	assert.True(t, acceptsTrailers(r))
+}
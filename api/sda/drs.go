@@ -0,0 +1,239 @@
+package sda
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// drsAccessID is the id of the only access method of DRS blob objects, which
+// is a download through the /files endpoint
+const drsAccessID = "files"
+
+// drsChecksum is a checksum of a DRS object
+type drsChecksum struct {
+	Checksum string `json:"checksum"`
+	Type     string `json:"type"`
+}
+
+// drsAccessMethod is a way to fetch the data of a DRS object
+type drsAccessMethod struct {
+	Type     string `json:"type"`
+	AccessID string `json:"access_id"`
+}
+
+// drsContentsObject is an object contained in a DRS bundle
+type drsContentsObject struct {
+	Name   string   `json:"name"`
+	ID     string   `json:"id"`
+	DrsURI []string `json:"drs_uri"`
+}
+
+// drsObject is a DRS blob (file) or bundle (dataset)
+type drsObject struct {
+	ID            string              `json:"id"`
+	Name          string              `json:"name"`
+	SelfURI       string              `json:"self_uri"`
+	Size          int64               `json:"size"`
+	CreatedTime   string              `json:"created_time"`
+	UpdatedTime   string              `json:"updated_time,omitempty"`
+	MimeType      string              `json:"mime_type,omitempty"`
+	Checksums     []drsChecksum       `json:"checksums"`
+	AccessMethods []drsAccessMethod   `json:"access_methods,omitempty"`
+	Contents      []drsContentsObject `json:"contents,omitempty"`
+}
+
+// drsAccessURL is the URL for fetching the data of a DRS object
+type drsAccessURL struct {
+	URL string `json:"url"`
+}
+
+// drsFail responds with a DRS error
+func drsFail(c *gin.Context, code int, message string) {
+	c.JSON(code, gin.H{"msg": message, "status_code": code})
+}
+
+// drsURI returns the DRS URI of an object served by this host
+func drsURI(c *gin.Context, objectID string) string {
+	return fmt.Sprintf("drs://%s/%s", c.Request.Host, url.PathEscape(objectID))
+}
+
+// drsChecksumType converts a checksum type of the sda.checksums table to the
+// IANA hash name used by DRS, e.g. SHA256 to sha-256
+func drsChecksumType(checksumType string) string {
+	checksumType = strings.ToLower(checksumType)
+	if strings.HasPrefix(checksumType, "sha") && !strings.HasPrefix(checksumType, "sha-") {
+		return "sha-" + checksumType[3:]
+	}
+
+	return checksumType
+}
+
+// DrsObject serves the GA4GH DRS v1 objects and access endpoints, where files
+// are blob objects and datasets are bundle objects
+func DrsObject(c *gin.Context) {
+	objectID := strings.TrimPrefix(c.Param("object"), "/")
+
+	accessID := ""
+	if i := strings.LastIndex(objectID, "/access/"); i >= 0 {
+		objectID, accessID = objectID[:i], objectID[i+len("/access/"):]
+	}
+	if objectID == "" {
+		drsFail(c, http.StatusNotFound, "object not found")
+
+		return
+	}
+
+	// Get datasets from request context, parsed previously by token middleware
+	cache := middleware.GetCacheFromContext(c)
+	if find(objectID, cache.Datasets) {
+		if accessID != "" {
+			drsFail(c, http.StatusNotFound, "bundles have no access methods")
+
+			return
+		}
+		drsBundle(c, objectID)
+
+		return
+	}
+
+	// Check user has permissions for this file (as part of a dataset)
+	dataset, err := database.CheckFilePermission(objectID)
+	if err != nil {
+		drsFail(c, http.StatusNotFound, "object not found")
+
+		return
+	}
+	if !find(dataset, cache.Datasets) {
+		log.Debugf("user requested DRS object, but does not have permissions for dataset %s", dataset)
+		drsFail(c, http.StatusForbidden, "unauthorised")
+
+		return
+	}
+
+	if accessID != "" {
+		if accessID != drsAccessID {
+			drsFail(c, http.StatusNotFound, "access method not found")
+
+			return
+		}
+
+		// The access URL is signed, so that the token isn't passed on
+		expiry := signedURLExpiry(c, config.Config.App.SignedURLExpiry)
+		if expiry <= 0 {
+			drsFail(c, http.StatusUnauthorized, "access token has expired")
+
+			return
+		}
+		c.JSON(http.StatusOK, drsAccessURL{URL: signedFileURL(c, objectID, dataset, "", "", time.Now().Add(expiry))})
+
+		return
+	}
+
+	drsBlob(c, objectID, dataset)
+}
+
+// drsBlob serves the DRS object of a file
+func drsBlob(c *gin.Context, fileID, dataset string) {
+	file, err := database.GetFileMetadata(fileID)
+	if err != nil {
+		log.Errorf("could not retrieve metadata for file %s, reason %s", fileID, err)
+		drsFail(c, http.StatusInternalServerError, "database error")
+
+		return
+	}
+
+	checksums, err := database.GetFileChecksums(fileID)
+	if err != nil {
+		drsFail(c, http.StatusInternalServerError, "database error")
+
+		return
+	}
+
+	object := drsObject{
+		ID:          fileID,
+		Name:        path.Base(archiveEntryName(&file.FileInfo)),
+		SelfURI:     drsURI(c, fileID),
+		Size:        file.DecryptedFileSize,
+		CreatedTime: file.CreatedAt,
+		UpdatedTime: file.LastModified,
+		MimeType:    "application/octet-stream",
+		Checksums:   []drsChecksum{},
+		AccessMethods: []drsAccessMethod{{
+			Type:     requestScheme(c),
+			AccessID: drsAccessID,
+		}},
+	}
+	for _, checksum := range checksums {
+		object.Checksums = append(object.Checksums, drsChecksum{Checksum: checksum.Checksum, Type: drsChecksumType(checksum.Type)})
+	}
+
+	c.JSON(http.StatusOK, object)
+}
+
+// drsBundle serves the DRS object of a dataset, containing its files
+func drsBundle(c *gin.Context, dataset string) {
+	info, err := database.GetDatasetInfo(dataset)
+	if err != nil {
+		log.Errorf("database query failed for dataset %s, reason %s", sanitizeString(dataset), err)
+		drsFail(c, http.StatusNotFound, "object not found")
+
+		return
+	}
+	files, err := database.GetFiles(dataset)
+	if err != nil {
+		log.Errorf("database query failed for dataset %s, reason %s", sanitizeString(dataset), err)
+		drsFail(c, http.StatusInternalServerError, "database error")
+
+		return
+	}
+
+	object := drsObject{
+		ID:          dataset,
+		Name:        dataset,
+		SelfURI:     drsURI(c, dataset),
+		CreatedTime: info.CreatedAt,
+		Checksums:   []drsChecksum{},
+		Contents:    []drsContentsObject{},
+	}
+
+	// The checksum of a bundle is the checksum of the sorted and concatenated
+	// checksums of its contents, so it can only be given if all files have a
+	// sha-256 checksum
+	var checksums []string
+	var updated time.Time
+	for _, file := range files {
+		object.Size += file.DecryptedFileSize
+		object.Contents = append(object.Contents, drsContentsObject{
+			Name:   archiveEntryName(file),
+			ID:     file.FileID,
+			DrsURI: []string{drsURI(c, file.FileID)},
+		})
+		if drsChecksumType(file.DecryptedFileChecksumType) == "sha-256" {
+			checksums = append(checksums, strings.ToLower(file.DecryptedFileChecksum))
+		}
+		if modified, err := time.Parse(time.RFC3339, file.LastModified); err == nil && modified.After(updated) {
+			updated = modified
+			object.UpdatedTime = file.LastModified
+		}
+	}
+	if len(checksums) == len(files) {
+		sort.Strings(checksums)
+		sum := sha256.Sum256([]byte(strings.Join(checksums, "")))
+		object.Checksums = append(object.Checksums, drsChecksum{Checksum: hex.EncodeToString(sum[:]), Type: "sha-256"})
+	}
+
+	c.JSON(http.StatusOK, object)
+}
@@ -0,0 +1,116 @@
+package sda
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/session"
+)
+
+func requestDrs(object string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/ga4gh/drs/v1/objects/"+object, nil)
+	r.Header.Set("Authorization", "Bearer token")
+
+	return serve(DrsObject, r, gin.Param{Key: "object", Value: "/" + object})
+}
+
+func TestDrsObject_Blob(t *testing.T) {
+	mockDrs(t)
+
+	w := requestDrs("file1")
+	assert.Equal(t, 200, w.Code)
+
+	var object drsObject
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &object))
+	assert.Equal(t, drsObject{
+		ID:            "file1",
+		Name:          "first.txt",
+		SelfURI:       "drs://example.com/file1",
+		Size:          10,
+		CreatedTime:   "2023-04-17T14:40:12Z",
+		UpdatedTime:   "2023-04-18T14:40:12Z",
+		MimeType:      "application/octet-stream",
+		Checksums:     []drsChecksum{{Checksum: "bb", Type: "sha-256"}, {Checksum: "cc", Type: "md5"}},
+		AccessMethods: []drsAccessMethod{{Type: "http", AccessID: "files"}},
+	}, object)
+
+	w = requestDrs("file1/access/files")
+	assert.Equal(t, 200, w.Code)
+	var access map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &access))
+	assert.NotContains(t, access, "headers")
+	signed, err := url.Parse(access["url"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "/files/file1", signed.Path)
+	assert.Equal(t, "dataset1", signed.Query().Get("dataset"))
+	assert.NotEmpty(t, signed.Query().Get("signature"))
+
+	// The access URL doesn't outlive the token
+	mock(t, &middleware.GetCacheFromContext, func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}, Expires: time.Now().Add(-time.Minute)}
+	})
+	w = requestDrs("file1/access/files")
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestDrsObject_Bundle(t *testing.T) {
+	mockDrs(t)
+
+	w := requestDrs("dataset1")
+	assert.Equal(t, 200, w.Code)
+
+	var object drsObject
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &object))
+	sum := sha256.Sum256([]byte("aabb"))
+	assert.Equal(t, drsObject{
+		ID:          "dataset1",
+		Name:        "dataset1",
+		SelfURI:     "drs://example.com/dataset1",
+		Size:        30,
+		CreatedTime: "2023-04-01T00:00:00Z",
+		UpdatedTime: "2023-04-19T14:40:12Z",
+		Checksums:   []drsChecksum{{Checksum: hex.EncodeToString(sum[:]), Type: "sha-256"}},
+		Contents: []drsContentsObject{
+			{Name: "dir/first.txt", ID: "file1", DrsURI: []string{"drs://example.com/file1"}},
+			{Name: "second.txt", ID: "file2", DrsURI: []string{"drs://example.com/file2"}},
+		},
+	}, object)
+}
+
+func TestDrsObject_Fail(t *testing.T) {
+	mockDrs(t)
+
+	for _, test := range []struct {
+		object string
+		code   int
+	}{
+		{"file4", 404},
+		{"file3", 403},
+		{"file3/access/files", 403},
+		{"file1/access/s3", 404},
+		{"dataset1/access/files", 404},
+		{"", 404},
+	} {
+		w := requestDrs(test.object)
+		assert.Equal(t, test.code, w.Code, test.object)
+
+		var response map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, float64(test.code), response["status_code"], test.object)
+	}
+}
+
+func TestDrsChecksumType(t *testing.T) {
+	assert.Equal(t, "sha-256", drsChecksumType("SHA256"))
+	assert.Equal(t, "sha-512", drsChecksumType("sha512"))
+	assert.Equal(t, "md5", drsChecksumType("MD5"))
+}
@@ -0,0 +1,347 @@
+package sda
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+	"github.com/neicnordic/sda-download/internal/htsget"
+	log "github.com/sirupsen/logrus"
+)
+
+// htsgetContentType is the content type of htsget tickets and errors
+const htsgetContentType = "application/vnd.ga4gh.htsget.v1.3.0+json; charset=utf-8"
+
+// htsgetFormat is a file format served by the htsget endpoints
+type htsgetFormat struct {
+	endpoint  string
+	extension string
+	// index file suffixes, in order of preference
+	indexes []string
+}
+
+// htsgetFormats lists the formats of the htsget reads and variants endpoints
+var htsgetFormats = map[string]htsgetFormat{
+	"BAM":  {endpoint: "reads", extension: ".bam", indexes: []string{".bai", ".csi"}},
+	"CRAM": {endpoint: "reads", extension: ".cram", indexes: []string{".crai"}},
+	"VCF":  {endpoint: "variants", extension: ".vcf.gz", indexes: []string{".tbi", ".csi"}},
+	"BCF":  {endpoint: "variants", extension: ".bcf", indexes: []string{".csi"}},
+}
+
+// htsgetDefaultFormats are the formats used when a request has no format
+// and it can't be told from the file name
+var htsgetDefaultFormats = map[string]string{
+	"reads":    "BAM",
+	"variants": "VCF",
+}
+
+// htsgetURL is a part of the data of an htsget ticket
+type htsgetURL struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Class   string            `json:"class,omitempty"`
+}
+
+// htsgetTicket lists the URLs to fetch for an htsget request
+type htsgetTicket struct {
+	Format string      `json:"format"`
+	URLs   []htsgetURL `json:"urls"`
+}
+
+// htsgetError is the body of htsget error responses
+type htsgetError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// htsgetQuery holds the parameters of an htsget request
+type htsgetQuery struct {
+	format        string
+	class         string
+	referenceName string
+	start, end    int64
+}
+
+// HtsgetReads serves htsget tickets for BAM and CRAM files
+func HtsgetReads(c *gin.Context) {
+	htsgetTicketHandler(c, "reads")
+}
+
+// HtsgetVariants serves htsget tickets for VCF and BCF files
+func HtsgetVariants(c *gin.Context) {
+	htsgetTicketHandler(c, "variants")
+}
+
+// htsgetFail responds with an htsget error
+func htsgetFail(c *gin.Context, code int, errorType, message string) {
+	c.JSON(code, gin.H{"htsget": htsgetError{Error: errorType, Message: message}})
+}
+
+// htsgetTicketHandler serves an htsget ticket, pointing to ranges of the file
+// download endpoint that hold the requested region
+func htsgetTicketHandler(c *gin.Context, endpoint string) {
+	c.Header("Content-Type", htsgetContentType)
+	fileID := c.Param("id")
+
+	// Check user has permissions for this file (as part of a dataset)
+	dataset, err := database.CheckFilePermission(fileID)
+	if err != nil {
+		htsgetFail(c, http.StatusNotFound, "NotFound", "file not found")
+
+		return
+	}
+	cache := middleware.GetCacheFromContext(c)
+	if !find(dataset, cache.Datasets) {
+		log.Debugf("user requested htsget ticket, but does not have permissions for dataset %s", dataset)
+		htsgetFail(c, http.StatusForbidden, "PermissionDenied", "unauthorised")
+
+		return
+	}
+
+	file, err := database.GetFile(fileID)
+	if err != nil {
+		log.Errorf("could not retrieve details for file %s, reason %s", fileID, err)
+		htsgetFail(c, http.StatusInternalServerError, "InternalError", "database error")
+
+		return
+	}
+
+	query, errorType, err := parseHtsgetQuery(c, endpoint, file.FilePath)
+	if err != nil {
+		htsgetFail(c, http.StatusBadRequest, errorType, err.Error())
+
+		return
+	}
+
+	// The ticket URLs are signed, so that clients don't have to pass the
+	// token on to wherever they fetch the data from
+	expiry := signedURLExpiry(c, config.Config.App.SignedURLExpiry)
+	if expiry <= 0 {
+		htsgetFail(c, http.StatusUnauthorized, "InvalidAuthentication", "access token has expired")
+
+		return
+	}
+	target := signedFileURL(c, fileID, dataset, "", "", time.Now().Add(expiry))
+	ticket := htsgetTicket{Format: query.format}
+
+	// The whole file is served without looking at the index
+	if query.class == "" && query.referenceName == "" {
+		ticket.URLs = []htsgetURL{{URL: target}}
+		c.JSON(http.StatusOK, gin.H{"htsget": ticket})
+
+		return
+	}
+
+	index, names, cramVersion, err := readHtsgetIndex(c.Request.Context(), dataset, file, query.format)
+	if err != nil {
+		log.Errorf("failed to read index for file %s, %s", fileID, err)
+		htsgetFail(c, http.StatusNotFound, "NotFound", "no usable index found for file")
+
+		return
+	}
+
+	var ranges []htsget.ByteRange
+	switch query.referenceName {
+	case "":
+	case "*":
+		ranges = index.UnmappedRanges()
+	default:
+		refID := -1
+		for i, name := range names {
+			if name == query.referenceName {
+				refID = i
+
+				break
+			}
+		}
+		if refID < 0 {
+			htsgetFail(c, http.StatusNotFound, "NotFound", "reference not found")
+
+			return
+		}
+		ranges = index.Ranges(refID, query.start, query.end)
+	}
+
+	rangeURL := func(r htsget.ByteRange, class string) htsgetURL {
+		return htsgetURL{URL: target, Headers: map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", r.Start, r.End-1)}, Class: class}
+	}
+
+	fileSize := int64(file.DecryptedSize)
+	end := index.HeaderEnd()
+	if end > 0 {
+		ticket.URLs = append(ticket.URLs, rangeURL(htsget.ByteRange{Start: 0, End: end}, "header"))
+	}
+	for _, r := range ranges {
+		ticket.URLs = append(ticket.URLs, rangeURL(r, "body"))
+		end = r.End
+	}
+
+	// The data has to end with the end of file marker, unless it's already
+	// included in the last range
+	if end < fileSize {
+		switch {
+		case query.format == "CRAM" && cramVersion >= 3:
+			ticket.URLs = append(ticket.URLs, rangeURL(htsget.ByteRange{Start: fileSize - htsget.CRAMEOFSize, End: fileSize}, "body"))
+		case query.format != "CRAM":
+			ticket.URLs = append(ticket.URLs, htsgetURL{URL: "data:;base64," + base64.StdEncoding.EncodeToString(htsget.BGZFEOF), Class: "body"})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"htsget": ticket})
+}
+
+// parseHtsgetQuery validates the query parameters of an htsget request,
+// returning the htsget error type along with any error
+func parseHtsgetQuery(c *gin.Context, endpoint string, filePath string) (htsgetQuery, string, error) {
+	query := htsgetQuery{
+		format:        strings.ToUpper(c.Query("format")),
+		class:         c.Query("class"),
+		referenceName: c.Query("referenceName"),
+	}
+
+	if query.format == "" {
+		query.format = htsgetDefaultFormats[endpoint]
+		for name, format := range htsgetFormats {
+			if strings.HasSuffix(strings.TrimSuffix(filePath, ".c4gh"), format.extension) {
+				query.format = name
+			}
+		}
+	}
+	if format, ok := htsgetFormats[query.format]; !ok || format.endpoint != endpoint {
+		return query, "UnsupportedFormat", fmt.Errorf("format %s is not supported", query.format)
+	}
+
+	if query.class != "" && query.class != "header" {
+		return query, "InvalidInput", errors.New("class must be header")
+	}
+
+	start, end := c.Query("start"), c.Query("end")
+	if query.class == "header" && (query.referenceName != "" || start != "" || end != "") {
+		return query, "InvalidInput", errors.New("header requests can't have a region")
+	}
+	if (start != "" || end != "") && (query.referenceName == "" || query.referenceName == "*") {
+		return query, "InvalidInput", errors.New("start and end require a referenceName")
+	}
+
+	var err error
+	if start != "" {
+		if query.start, err = strconv.ParseInt(start, 10, 64); err != nil || query.start < 0 {
+			return query, "InvalidInput", errors.New("invalid start")
+		}
+	}
+	if end != "" {
+		if query.end, err = strconv.ParseInt(end, 10, 64); err != nil || query.end < 0 {
+			return query, "InvalidInput", errors.New("invalid end")
+		}
+		if query.start > query.end {
+			return query, "InvalidRange", errors.New("start is greater than end")
+		}
+	}
+
+	return query, "", nil
+}
+
+// withoutUser removes the first part of an upload path, which is the user id
+func withoutUser(filePath string) string {
+	parts := strings.Split(filePath, "/")
+	if len(parts) > 1 {
+		parts = parts[1:]
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// findHtsgetIndex looks up the index file of a file in its dataset,
+// returning the index file and its suffix
+func findHtsgetIndex(dataset string, file *database.FileDownload, format string) (*database.FileInfo, string, error) {
+	name := withoutUser(strings.TrimSuffix(file.FilePath, ".c4gh"))
+	for _, suffix := range htsgetFormats[format].indexes {
+		for _, candidate := range []string{name + suffix, strings.TrimSuffix(name, htsgetFormats[format].extension) + suffix} {
+			indexFile, err := database.GetDatasetFileInfo(dataset, candidate+".c4gh")
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("database error, %w", err)
+			}
+			// The path is matched as a pattern, so other paths may match too
+			if withoutUser(indexFile.FilePath) == candidate+".c4gh" {
+				return indexFile, suffix, nil
+			}
+		}
+	}
+
+	return nil, "", errors.New("index file not found")
+}
+
+// readHtsgetIndex finds and reads the index of a file in its dataset,
+// returning the index, the reference names and for CRAM files the major
+// version of the format
+func readHtsgetIndex(ctx context.Context, dataset string, file *database.FileDownload, format string) (htsget.Index, []string, int, error) {
+	indexFile, suffix, err := findHtsgetIndex(dataset, file, format)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	indexDetails, err := database.GetFile(indexFile.FileID)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("database error, %w", err)
+	}
+	indexStream, err := openDecryptedFile(ctx, indexDetails)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer indexStream.Close()
+
+	fileSize := int64(file.DecryptedSize)
+	var index htsget.Index
+	switch suffix {
+	case ".bai":
+		index, err = htsget.ReadBAI(indexStream, fileSize)
+	case ".tbi":
+		index, err = htsget.ReadTBI(indexStream, fileSize)
+	case ".csi":
+		index, err = htsget.ReadCSI(indexStream, fileSize)
+	case ".crai":
+		index, err = htsget.ReadCRAI(indexStream, fileSize)
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if names, ok := index.(htsget.Names); ok && names.ReferenceNames() != nil {
+		return index, names.ReferenceNames(), 0, nil
+	}
+
+	// The reference names are read from the header of the file itself
+	stream, err := openDecryptedFile(ctx, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer stream.Close()
+
+	var names []string
+	var version int
+	switch format {
+	case "BAM":
+		names, err = htsget.ReadBAMReferences(stream)
+	case "CRAM":
+		names, version, err = htsget.ReadCRAMReferences(stream)
+	case "VCF":
+		names, err = htsget.ReadVCFReferences(stream)
+	case "BCF":
+		names, err = htsget.ReadBCFReferences(stream)
+	}
+
+	return index, names, version, err
+}
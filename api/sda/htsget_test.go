@@ -0,0 +1,104 @@
+package sda
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neicnordic/sda-download/internal/htsget"
+)
+
+// requestHtsget sends an htsget request, returning the status code and the
+// decoded response
+func requestHtsget(t *testing.T, handler gin.HandlerFunc, target string) (int, map[string]json.RawMessage) {
+	r := httptest.NewRequest("GET", target, nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w := serve(handler, r, gin.Param{Key: "id", Value: "file1"})
+	assert.Equal(t, htsgetContentType, w.Header().Get("Content-Type"))
+
+	var response map[string]map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	return w.Code, response["htsget"]
+}
+
+func TestHtsget(t *testing.T) {
+	mockHtsgetFiles(t)
+
+	eof := htsgetURL{URL: "data:;base64," + base64.StdEncoding.EncodeToString(htsget.BGZFEOF), Class: "body"}
+	ranged := func(byteRange, class string) htsgetURL {
+		return htsgetURL{
+			URL:     "http://example.com/files/file1",
+			Headers: map[string]string{"Range": byteRange},
+			Class:   class,
+		}
+	}
+
+	for _, test := range []struct {
+		query string
+		urls  []htsgetURL
+	}{
+		{"", []htsgetURL{{URL: "http://example.com/files/file1"}}},
+		{"?referenceName=chr1&start=0&end=100", []htsgetURL{ranged("bytes=0-99", "header"), ranged("bytes=100-299", "body"), eof}},
+		{"?referenceName=chr2", []htsgetURL{ranged("bytes=0-99", "header"), ranged("bytes=300-499", "body")}},
+		{"?referenceName=*", []htsgetURL{ranged("bytes=0-99", "header"), ranged("bytes=400-499", "body")}},
+		{"?class=header", []htsgetURL{ranged("bytes=0-99", "header"), eof}},
+	} {
+		code, response := requestHtsget(t, HtsgetReads, "/htsget/reads/file1"+test.query)
+		assert.Equal(t, 200, code, test.query)
+		assert.Equal(t, `"BAM"`, string(response["format"]), test.query)
+
+		var urls []htsgetURL
+		assert.NoError(t, json.Unmarshal(response["urls"], &urls))
+		// The file URLs are signed, instead of passing on the token
+		for i, u := range urls {
+			if strings.HasPrefix(u.URL, "data:") {
+				continue
+			}
+			signed, err := url.Parse(u.URL)
+			assert.NoError(t, err)
+			assert.Equal(t, "dataset1", signed.Query().Get("dataset"), test.query)
+			assert.NotEmpty(t, signed.Query().Get("signature"), test.query)
+			signed.RawQuery = ""
+			urls[i].URL = signed.String()
+		}
+		assert.Equal(t, test.urls, urls, test.query)
+	}
+}
+
+func TestHtsget_Fail(t *testing.T) {
+	mockHtsgetFiles(t)
+
+	for _, test := range []struct {
+		handler   gin.HandlerFunc
+		query     string
+		code      int
+		errorType string
+	}{
+		{HtsgetReads, "?referenceName=chr3", 404, "NotFound"},
+		{HtsgetReads, "?format=CRAM&referenceName=chr1", 404, "NotFound"},
+		{HtsgetReads, "?format=VCF", 400, "UnsupportedFormat"},
+		{HtsgetVariants, "", 400, "UnsupportedFormat"},
+		{HtsgetReads, "?class=body", 400, "InvalidInput"},
+		{HtsgetReads, "?class=header&referenceName=chr1", 400, "InvalidInput"},
+		{HtsgetReads, "?start=10", 400, "InvalidInput"},
+		{HtsgetReads, "?referenceName=chr1&start=-1", 400, "InvalidInput"},
+		{HtsgetReads, "?referenceName=chr1&start=20&end=10", 400, "InvalidRange"},
+	} {
+		code, response := requestHtsget(t, test.handler, "/htsget/file1"+test.query)
+		assert.Equal(t, test.code, code, test.query)
+		assert.Equal(t, `"`+test.errorType+`"`, string(response["error"]), test.query)
+	}
+
+	// A file in a dataset the user has no access to
+	mockDatasets(t, "dataset2")
+	code, response := requestHtsget(t, HtsgetReads, "/htsget/reads/file1")
+	assert.Equal(t, 403, code)
+	assert.Equal(t, `"PermissionDenied"`, string(response["error"]))
+}
@@ -0,0 +1,167 @@
+package sda
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of metadata listings besides JSON
+const (
+	mimeNDJSON = "application/x-ndjson"
+	mimeCSV    = "text/csv"
+	mimeTSV    = "text/tab-separated-values"
+)
+
+// fileColumns are the CSV and TSV columns of file listings, named as the
+// JSON fields
+var fileColumns = []string{"fileId", "datasetId", "displayFileName", "filePath", "fileName",
+	"fileSize", "decryptedFileSize", "decryptedFileChecksum", "decryptedFileChecksumType",
+	"fileStatus", "createdAt", "lastModified"}
+
+// fileRecord returns the CSV and TSV fields of a file
+func fileRecord(fi *database.FileInfo) []string {
+	return []string{fi.FileID, fi.DatasetID, fi.DisplayFileName, fi.FilePath, fi.FileName,
+		fmt.Sprint(fi.FileSize), fmt.Sprint(fi.DecryptedFileSize), fi.DecryptedFileChecksum,
+		fi.DecryptedFileChecksumType, fi.Status, fi.CreatedAt, fi.LastModified}
+}
+
+// listingFormat returns the format of a listing accepted by the client.
+// JSON is used unless another format is asked for.
+func listingFormat(c *gin.Context) string {
+	if c.Request == nil || c.Request.Header.Get("Accept") == "" {
+		return gin.MIMEJSON
+	}
+
+	format := c.NegotiateFormat(gin.MIMEJSON, mimeNDJSON, mimeCSV, mimeTSV)
+	if format == "" {
+		return gin.MIMEJSON
+	}
+
+	return format
+}
+
+// rowWriter writes the rows of a listing as NDJSON, CSV or TSV. The response
+// is started with the first row, so that errors before it can still be
+// responded with.
+type rowWriter struct {
+	c       *gin.Context
+	format  string
+	columns []string
+	csv     *csv.Writer
+	started bool
+}
+
+func newRowWriter(c *gin.Context, format string, columns []string) *rowWriter {
+	w := &rowWriter{c: c, format: format, columns: columns}
+	if format != mimeNDJSON {
+		w.csv = csv.NewWriter(c.Writer)
+		if format == mimeTSV {
+			w.csv.Comma = '\t'
+		}
+	}
+
+	return w
+}
+
+// start writes the response headers and the header row of CSV and TSV
+func (w *rowWriter) start() error {
+	w.started = true
+	w.c.Header("Content-Type", w.format+"; charset=utf-8")
+	w.c.Status(http.StatusOK)
+	if w.csv != nil {
+		return w.csv.Write(w.columns)
+	}
+
+	return nil
+}
+
+// write writes a row, given as a JSON value for NDJSON and as a record for
+// CSV and TSV
+func (w *rowWriter) write(value any, record []string) error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if w.csv != nil {
+		return w.csv.Write(record)
+	}
+
+	return json.NewEncoder(w.c.Writer).Encode(value)
+}
+
+// close ends the listing, which may be empty
+func (w *rowWriter) close() error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if w.csv != nil {
+		w.csv.Flush()
+
+		return w.csv.Error()
+	}
+
+	return nil
+}
+
+// datasetColumns are the CSV and TSV columns of expanded dataset listings.
+// The file status breakdown is only given in JSON and NDJSON.
+var datasetColumns = []string{"datasetId", "createdAt", "releasedAt", "lastModified",
+	"fileCount", "totalFileSize", "totalDecryptedFileSize"}
+
+// datasetRecord returns the CSV and TSV fields of dataset details
+func datasetRecord(d *database.DatasetDetails) []string {
+	return []string{d.DatasetID, d.CreatedAt, d.ReleasedAt, d.LastModified,
+		fmt.Sprint(d.FileCount), fmt.Sprint(d.TotalFileSize), fmt.Sprint(d.TotalDecryptedFileSize)}
+}
+
+// writeRows writes a listing in a row format
+func writeRows[T any](c *gin.Context, format string, columns []string, rows []T, record func(T) []string) {
+	w := newRowWriter(c, format, columns)
+	for _, row := range rows {
+		if err := w.write(row, record(row)); err != nil {
+			log.Errorf("failed to write listing, reason: %v", err)
+			abortResponse()
+		}
+	}
+	if err := w.close(); err != nil {
+		log.Errorf("failed to write listing, reason: %v", err)
+		abortResponse()
+	}
+}
+
+// streamFiles writes the files of a dataset in a row format as they are read
+// from the database
+func streamFiles(c *gin.Context, format string, datasetID string, filter database.FileFilter) {
+	cache := middleware.GetCacheFromContext(c)
+	if !find(datasetID, cache.Datasets) {
+		c.String(http.StatusNotFound, "dataset not found")
+
+		return
+	}
+
+	w := newRowWriter(c, format, fileColumns)
+	err := database.StreamFiles(datasetID, filter, func(fi *database.FileInfo) error {
+		return w.write(fi, fileRecord(fi))
+	})
+	if err == nil {
+		err = w.close()
+	}
+	if err != nil {
+		log.Errorf("failed to stream files of dataset %s, reason: %v", sanitizeString(datasetID), err)
+		if w.started {
+			// The client must not take a truncated listing for a whole one
+			abortResponse()
+		}
+		c.String(http.StatusInternalServerError, "database error")
+	}
+}
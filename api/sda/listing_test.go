@@ -0,0 +1,145 @@
+package sda
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neicnordic/sda-download/internal/database"
+)
+
+// requestListing runs a listing handler with the given Accept header
+func requestListing(handler gin.HandlerFunc, target, dataset, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	if dataset == "" {
+		return serve(handler, r)
+	}
+
+	return serve(handler, r, gin.Param{Key: "dataset", Value: dataset})
+}
+
+func TestListingFormat(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                      gin.MIMEJSON,
+		"*/*":                                   gin.MIMEJSON,
+		"text/html":                             gin.MIMEJSON,
+		"application/x-ndjson":                  mimeNDJSON,
+		"text/csv, application/json;q=0.5":      mimeCSV,
+		"text/html, text/tab-separated-values":  mimeTSV,
+		"application/json, text/csv;q=0.9, */*": gin.MIMEJSON,
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/metadata/datasets", nil)
+		c.Request.Header.Set("Accept", accept)
+		assert.Equal(t, expected, listingFormat(c), accept)
+	}
+}
+
+func TestDatasets_Formats(t *testing.T) {
+	mockListing(t)
+
+	w := requestListing(Datasets, "/metadata/datasets", "", "application/x-ndjson")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-ndjson; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "\"dataset1\"\n\"https://doi.org/abc/123\"\n", w.Body.String())
+
+	w = requestListing(Datasets, "/metadata/datasets", "", "text/csv")
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "datasetId\ndataset1\nhttps://doi.org/abc/123\n", w.Body.String())
+}
+
+func TestFiles_Stream(t *testing.T) {
+	mockListing(t)
+
+	w := requestListing(Files, "/metadata/datasets/dataset1/files", "/dataset1/files", "text/csv")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "fileId,datasetId,displayFileName,filePath,fileName,fileSize,decryptedFileSize,decryptedFileChecksum,decryptedFileChecksumType,fileStatus,createdAt,lastModified\n"+
+		"file1,dataset1,file1.txt,dir/file1.txt,,200,100,,,ready,,\n"+
+		"file2,dataset1,\"file, 2.txt\",\"dir/file, 2.txt\",,300,200,,,ready,,\n", w.Body.String())
+
+	w = requestListing(Files, "/metadata/datasets/dataset1/files?name=file1.txt", "/dataset1/files", "text/tab-separated-values")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "fileId\tdatasetId\tdisplayFileName\tfilePath\tfileName\tfileSize\tdecryptedFileSize\tdecryptedFileChecksum\tdecryptedFileChecksumType\tfileStatus\tcreatedAt\tlastModified\n"+
+		"file1\tdataset1\tfile1.txt\tdir/file1.txt\t\t200\t100\t\t\tready\t\t\n", w.Body.String())
+
+	w = requestListing(Files, "/metadata/datasets/dataset1/files?name=none", "/dataset1/files", "application/x-ndjson")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/x-ndjson; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "", w.Body.String())
+
+	w = requestListing(Files, "/metadata/datasets/abc/123/files?scheme=https", "/doi.org/abc/123/files", "application/x-ndjson")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"fileId":"file1","datasetId":"https://doi.org/abc/123","displayFileName":"file1.txt","filePath":"dir/file1.txt","fileName":"","fileSize":200,"decryptedFileSize":100,"decryptedFileChecksum":"","decryptedFileChecksumType":"","fileStatus":"ready","createdAt":"","lastModified":""}`+"\n"+
+		`{"fileId":"file2","datasetId":"https://doi.org/abc/123","displayFileName":"file, 2.txt","filePath":"dir/file, 2.txt","fileName":"","fileSize":300,"decryptedFileSize":200,"decryptedFileChecksum":"","decryptedFileChecksumType":"","fileStatus":"ready","createdAt":"","lastModified":""}`+"\n", w.Body.String())
+
+	w = requestListing(Files, "/metadata/datasets/dataset2/files", "/dataset2/files", "text/csv")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "dataset not found", w.Body.String())
+}
+
+func TestFiles_StreamDatabaseError(t *testing.T) {
+	mockListing(t)
+
+	database.StreamFiles = func(datasetID string, filter database.FileFilter, each func(*database.FileInfo) error) error {
+		return errors.New("something went wrong")
+	}
+
+	w := requestListing(Files, "/metadata/datasets/dataset1/files", "/dataset1/files", "text/csv")
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "database error", w.Body.String())
+}
+
+func TestFiles_StreamDatabaseErrorAfterFirstRow(t *testing.T) {
+	mockListing(t)
+	streamFiles := database.StreamFiles
+	database.StreamFiles = func(datasetID string, filter database.FileFilter, each func(*database.FileInfo) error) error {
+		calls := 0
+
+		return streamFiles(datasetID, filter, func(fi *database.FileInfo) error {
+			if calls++; calls > 1 {
+				return errors.New("something went wrong")
+			}
+
+			return each(fi)
+		})
+	}
+
+	for _, accept := range []string{"text/csv", "application/x-ndjson"} {
+		handler := func(c *gin.Context) {
+			c.Request.Header.Set("Accept", accept)
+			Files(c)
+		}
+		_, body, err := fetch(handler, "/metadata/datasets/*dataset", "GET", "/metadata/datasets/dataset1/files", nil)
+		assert.Error(t, err, accept)
+		assert.NotContains(t, string(body), "file2", accept)
+	}
+}
+
+func TestFiles_PagedFormat(t *testing.T) {
+	mock(t, &getFilesPage, func(datasetID string, filter database.FileFilter, ctx *gin.Context) ([]*database.FileInfo, int, error) {
+		return []*database.FileInfo{{FileID: "file1"}, {FileID: "file2"}}, 200, nil
+	})
+
+	w := requestListing(Files, "/metadata/datasets/dataset1/files?limit=1", "/dataset1/files", "application/x-ndjson")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `<http://example.com/metadata/datasets/dataset1/files?limit=1&page_token=ZmlsZTE>; rel="next"`, w.Header().Get("Link"))
+	assert.Equal(t, `{"fileId":"file1","datasetId":"","displayFileName":"","filePath":"","fileName":"","fileSize":0,"decryptedFileSize":0,"decryptedFileChecksum":"","decryptedFileChecksumType":"","fileStatus":"","createdAt":"","lastModified":""}`+"\n", w.Body.String())
+}
+
+func TestDatasets_ExpandInfoFormats(t *testing.T) {
+	mockDatasetDetails(t)
+
+	w := requestListing(Datasets, "/metadata/datasets?expand=info", "", "text/csv")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "datasetId,createdAt,releasedAt,lastModified,fileCount,totalFileSize,totalDecryptedFileSize\n"+
+		"dataset1,2023-01-01T10:00:00Z,2023-02-01T10:00:00Z,2023-01-15T10:00:00Z,3,552,96\n"+
+		"https://doi.org/abc/123,2023-01-01T10:00:00Z,2023-02-01T10:00:00Z,2023-01-15T10:00:00Z,3,552,96\n", w.Body.String())
+}
@@ -0,0 +1,358 @@
+package sda
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	"github.com/neicnordic/crypt4gh/streaming"
+
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+	"github.com/neicnordic/sda-download/internal/session"
+	"github.com/neicnordic/sda-download/internal/storage"
+)
+
+// mock replaces a mockable function or setting with value, and restores the
+// original when the test ends
+func mock[T any](t *testing.T, target *T, value T) {
+	t.Helper()
+
+	original := *target
+	*target = value
+	t.Cleanup(func() { *target = original })
+}
+
+// serve runs a handler for a request, with the given path parameters
+func serve(handler gin.HandlerFunc, r *http.Request, params ...gin.Param) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = r
+	c.Params = params
+
+	handler(c)
+
+	return w
+}
+
+// fetch sends a request to a handler behind a real server, where failed
+// responses end with a closed connection, and returns the response, its body
+// and the error of reading the body
+func fetch(handler gin.HandlerFunc, route, method, target string, body io.Reader) (*http.Response, []byte, error) {
+	router := gin.New()
+	router.Handle(method, route, handler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	r, _ := http.NewRequest(method, server.URL+target, body)
+	response, err := server.Client().Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+
+	return response, content, err
+}
+
+// mockDatasets gives the user access to the datasets
+func mockDatasets(t *testing.T, datasets ...string) {
+	t.Helper()
+
+	mock(t, &middleware.GetCacheFromContext, func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: datasets}
+	})
+}
+
+// createArchiveFile encrypts data for the given archive key and stores the
+// body as name in a posix archive directory, returning the header
+func createArchiveFile(t *testing.T, archiveKey [32]byte, archive, name string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	c4ghWriter, err := streaming.NewCrypt4GHWriterWithoutPrivateKey(&buf, [][32]byte{keys.DerivePublicKey(archiveKey)}, nil)
+	if err != nil {
+		t.Fatalf("failed to create crypt4gh writer, %v", err)
+	}
+	if _, err = c4ghWriter.Write(data); err != nil {
+		t.Fatalf("failed to write crypt4gh data, %v", err)
+	}
+	c4ghWriter.Close()
+
+	header, err := headers.ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("failed to read crypt4gh header, %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(archive, name), buf.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write archive file, %v", err)
+	}
+
+	return header
+}
+
+// mockArchive stores the files, encrypted, in a posix archive used as the
+// Backend, and returns their headers
+func mockArchive(t *testing.T, files map[string][]byte) map[string][]byte {
+	t.Helper()
+
+	_, archiveKey, _ := keys.GenerateKeyPair()
+	mock(t, &config.Config.App.Crypt4GHKey, &archiveKey)
+
+	archive := t.TempDir()
+	fileHeaders := map[string][]byte{}
+	for name, data := range files {
+		fileHeaders[name] = createArchiveFile(t, archiveKey, archive, name, data)
+	}
+	backend, _ := storage.NewBackend(storage.Conf{Type: "posix", Posix: struct{ Location string }{Location: archive}})
+	mock[storage.Reader](t, &Backend, backend)
+
+	return fileHeaders
+}
+
+// mockFileDownload sets up downloading data as "file1", and any other file
+// ID, from "dataset1"
+func mockFileDownload(t *testing.T, data []byte) {
+	t.Helper()
+
+	header := mockArchive(t, map[string][]byte{"file1": data})["file1"]
+	archiveSize, _ := Backend.GetFileSize(context.Background(), "file1")
+
+	mockDatasets(t, "dataset1")
+	mock(t, &database.CheckFilePermission, func(fileID string) (string, error) {
+		return "dataset1", nil
+	})
+	mock(t, &database.GetFile, func(fileID string) (*database.FileDownload, error) {
+		fileDetails := &database.FileDownload{
+			ArchivePath:           "file1",
+			ArchiveSize:           int(archiveSize),
+			DecryptedSize:         len(data),
+			DecryptedChecksum:     fmt.Sprintf("%x", sha256.Sum256(data)),
+			DecryptedChecksumType: "SHA256",
+			LastModified:          "2023-04-17T14:40:12.567Z",
+			Header:                header,
+		}
+
+		return fileDetails, nil
+	})
+}
+
+// mockDatasetFiles lists two files, "file1" and "file2", in any dataset
+func mockDatasetFiles(t *testing.T) {
+	t.Helper()
+
+	mock(t, &database.GetFiles, func(datasetID string) ([]*database.FileInfo, error) {
+		return []*database.FileInfo{
+			{FileID: "file1", FilePath: "user/dir/first.txt.c4gh", LastModified: "2023-04-17T14:40:12.567Z"},
+			{FileID: "file2", FilePath: "user/second.txt.c4gh", LastModified: "2023-04-17T14:40:12.567Z"},
+		}, nil
+	})
+}
+
+// mockBundlePaths sets the upload paths of file1 and file2 in the details
+// given by database.GetFile
+func mockBundlePaths(t *testing.T) {
+	t.Helper()
+
+	paths := map[string]string{"file1": "user/dir/first.txt.c4gh", "file2": "user/second.txt.c4gh"}
+	getFile := database.GetFile
+	mock(t, &database.GetFile, func(fileID string) (*database.FileDownload, error) {
+		fileDetails, err := getFile(fileID)
+		if err == nil {
+			fileDetails.FilePath = paths[fileID]
+		}
+
+		return fileDetails, err
+	})
+}
+
+// mockDrs sets up "dataset1" holding "file1" and "file2", where the user
+// also has access to "dataset2"
+func mockDrs(t *testing.T) {
+	t.Helper()
+
+	mockDatasets(t, "dataset1", "dataset2")
+	mock(t, &config.Config.App.SigningKey, []byte("secret"))
+	mock(t, &config.Config.App.SignedURLExpiry, time.Hour)
+	mock(t, &database.CheckFilePermission, func(fileID string) (string, error) {
+		switch fileID {
+		case "file1", "file2":
+			return "dataset1", nil
+		case "file3":
+			return "dataset3", nil
+		default:
+			return "", errors.New("no rows")
+		}
+	})
+	files := []*database.FileInfo{
+		{
+			FileID: "file1", FilePath: "user/dir/first.txt.c4gh", DecryptedFileSize: 10,
+			DecryptedFileChecksum: "BB", DecryptedFileChecksumType: "SHA256",
+			CreatedAt: "2023-04-17T14:40:12Z", LastModified: "2023-04-18T14:40:12Z",
+		},
+		{
+			FileID: "file2", FilePath: "user/second.txt.c4gh", DecryptedFileSize: 20,
+			DecryptedFileChecksum: "aa", DecryptedFileChecksumType: "SHA256",
+			CreatedAt: "2023-04-17T14:40:12Z", LastModified: "2023-04-19T14:40:12Z",
+		},
+	}
+	mock(t, &database.GetFiles, func(datasetID string) ([]*database.FileInfo, error) {
+		return files, nil
+	})
+	mock(t, &database.GetFileMetadata, func(fileID string) (*database.FileMetadata, error) {
+		for _, file := range files {
+			if file.FileID == fileID {
+				return &database.FileMetadata{FileInfo: *file, Datasets: []string{"dataset1"}}, nil
+			}
+		}
+
+		return nil, errors.New("no rows")
+	})
+	mock(t, &database.GetFileChecksums, func(fileID string) ([]database.Checksum, error) {
+		return []database.Checksum{{Checksum: "bb", Type: "SHA256"}, {Checksum: "cc", Type: "MD5"}}, nil
+	})
+	mock(t, &database.GetDatasetInfo, func(datasetID string) (*database.DatasetInfo, error) {
+		return &database.DatasetInfo{DatasetID: datasetID, CreatedAt: "2023-04-01T00:00:00Z"}, nil
+	})
+}
+
+// littleEndian encodes values as binary data for test files
+func littleEndian(values ...any) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			buf.WriteString(s)
+
+			continue
+		}
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+	}
+
+	return buf.Bytes()
+}
+
+// mockHtsgetFiles sets up a BAM file "file1" with the BAI index "file2" in
+// "dataset1"
+func mockHtsgetFiles(t *testing.T) {
+	t.Helper()
+
+	var bam bytes.Buffer
+	gz := gzip.NewWriter(&bam)
+	_, _ = gz.Write(littleEndian("BAM\x01", int32(0), int32(2), int32(5), "chr1\x00", int32(100), int32(5), "chr2\x00", int32(200)))
+	gz.Close()
+
+	v := func(block, offset uint64) uint64 { return block<<16 | offset }
+	bai := littleEndian("BAI\x01", int32(2),
+		int32(2),
+		uint32(4681), int32(1), v(100, 0), v(200, 50),
+		uint32(4682), int32(1), v(200, 50), v(300, 0),
+		int32(2), v(100, 0), v(200, 50),
+		int32(1), uint32(0), int32(1), v(300, 0), v(400, 10),
+		int32(0))
+
+	headers := mockArchive(t, map[string][]byte{"file1": bam.Bytes(), "file2": bai})
+	files := map[string]*database.FileInfo{
+		"file1": {FileID: "file1", FilePath: "user/sample.bam.c4gh", DecryptedFileSize: 500},
+		"file2": {FileID: "file2", FilePath: "user/sample.bam.bai.c4gh", DecryptedFileSize: int64(len(bai))},
+	}
+
+	mockDatasets(t, "dataset1")
+	mock(t, &config.Config.App.SigningKey, []byte("secret"))
+	mock(t, &config.Config.App.SignedURLExpiry, time.Hour)
+	mock(t, &database.CheckFilePermission, func(fileID string) (string, error) {
+		if _, ok := headers[fileID]; !ok {
+			return "", errors.New("no rows")
+		}
+
+		return "dataset1", nil
+	})
+	mock(t, &database.GetDatasetFileInfo, func(datasetID, filePath string) (*database.FileInfo, error) {
+		for _, file := range files {
+			if file.FilePath == "user/"+filePath {
+				return file, nil
+			}
+		}
+
+		return nil, sql.ErrNoRows
+	})
+	mock(t, &database.GetFile, func(fileID string) (*database.FileDownload, error) {
+		archiveSize, err := Backend.GetFileSize(context.Background(), fileID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &database.FileDownload{
+			ArchivePath:   fileID,
+			ArchiveSize:   int(archiveSize),
+			DecryptedSize: int(files[fileID].DecryptedFileSize),
+			Header:        headers[fileID],
+			FilePath:      files[fileID].FilePath,
+		}, nil
+	})
+}
+
+// mockListing sets up a dataset1 with two files, streamed from the database
+func mockListing(t *testing.T) {
+	t.Helper()
+
+	mockDatasets(t, "dataset1", "https://doi.org/abc/123")
+	mock(t, &database.StreamFiles, func(datasetID string, filter database.FileFilter, each func(*database.FileInfo) error) error {
+		for _, fi := range []*database.FileInfo{
+			{FileID: "file1", DatasetID: datasetID, DisplayFileName: "file1.txt", FilePath: "dir/file1.txt", FileSize: 200, DecryptedFileSize: 100, Status: "ready"},
+			{FileID: "file2", DatasetID: datasetID, DisplayFileName: "file, 2.txt", FilePath: "dir/file, 2.txt", FileSize: 300, DecryptedFileSize: 200, Status: "ready"},
+		} {
+			if filter.NameGlob == "" || filter.NameGlob == fi.DisplayFileName {
+				if err := each(fi); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// mockDatasetDetails sets up details for the datasets in the database
+func mockDatasetDetails(t *testing.T) {
+	t.Helper()
+
+	mockDatasets(t, "dataset1", "https://doi.org/abc/123", "dataset2")
+	mock(t, &database.GetDatasetDetails, func(datasetIDs []string) ([]*database.DatasetDetails, error) {
+		details := []*database.DatasetDetails{}
+		for _, datasetID := range datasetIDs {
+			switch datasetID {
+			case "broken":
+				return nil, errors.New("something went wrong")
+			case "dataset2":
+				continue
+			}
+			details = append(details, &database.DatasetDetails{
+				DatasetInfo:            database.DatasetInfo{DatasetID: datasetID, CreatedAt: "2023-01-01T10:00:00Z"},
+				ReleasedAt:             "2023-02-01T10:00:00Z",
+				LastModified:           "2023-01-15T10:00:00Z",
+				FileCount:              3,
+				TotalFileSize:          552,
+				TotalDecryptedFileSize: 96,
+				FileStatus:             map[string]int64{"ready": 3},
+			})
+		}
+
+		return details, nil
+	})
+}
@@ -0,0 +1,213 @@
+package sda
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errUnsatisfiableRange is returned when none of the requested ranges
+// overlap the file
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+// httpRange is a byte range of a file, as requested in a Range header
+type httpRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range header value for the range
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header as described in RFC 7233 for a file of the
+// given size. An error is returned for malformed headers, which should then be
+// ignored, and errUnsatisfiableRange if no requested range overlaps the file.
+// The returned ranges are sorted and overlapping ranges are merged, so that
+// they can be served from a stream that only seeks forward.
+func parseRange(header string, size int64) ([]httpRange, error) {
+	const unit = "bytes="
+	if !strings.HasPrefix(header, unit) {
+		return nil, errors.New("invalid range unit")
+	}
+
+	var ranges []httpRange
+	noOverlap := false
+	for _, spec := range strings.Split(header[len(unit):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, errors.New("invalid range")
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+
+		var r httpRange
+		if first == "" {
+			// A suffix range, -N means the last N bytes of the file
+			if last == "" || last[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if n == 0 {
+				noOverlap = true
+
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if start >= size {
+				noOverlap = true
+
+				continue
+			}
+			r.start = start
+			r.length = size - start
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errors.New("invalid range")
+				}
+				if end < size-1 {
+					r.length = end - start + 1
+				}
+			}
+		}
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap || size == 0 {
+			return nil, errUnsatisfiableRange
+		}
+
+		return nil, errors.New("invalid range")
+	}
+
+	return mergeRanges(ranges), nil
+}
+
+// mergeRanges sorts ranges by start and merges ranges that overlap or are
+// adjacent to each other
+func mergeRanges(ranges []httpRange) []httpRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := []httpRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		current := &merged[len(merged)-1]
+		if r.start > current.start+current.length {
+			merged = append(merged, r)
+
+			continue
+		}
+		if end := r.start + r.length; end > current.start+current.length {
+			current.length = end - current.start
+		}
+	}
+
+	return merged
+}
+
+// sendRanges writes the given ranges of the stream as the parts of a
+// multipart/byteranges body
+func sendRanges(reader io.ReadSeeker, mw *multipart.Writer, ranges []httpRange, size int64) error {
+	for _, r := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {r.contentRange(size)},
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = sendStream(reader, part, r.start, r.start+r.length); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// archiveStream is a crypt4gh header followed by the body of an archive
+// file, as one seekable stream. A crypt4gh reader on it seeks in the archive
+// file to the segment it needs, instead of reading all segments before it.
+type archiveStream struct {
+	header  []byte
+	body    io.ReadSeeker
+	pos     int64
+	bodyPos int64
+}
+
+func newArchiveStream(header []byte, body io.ReadSeeker) *archiveStream {
+	return &archiveStream{header: header, body: body}
+}
+
+// Read implements io.Reader for the archiveStream
+func (a *archiveStream) Read(p []byte) (int, error) {
+	headerSize := int64(len(a.header))
+	if a.pos < headerSize {
+		n := copy(p, a.header[a.pos:])
+		a.pos += int64(n)
+
+		return n, nil
+	}
+
+	if a.pos-headerSize != a.bodyPos {
+		offset, err := a.body.Seek(a.pos-headerSize, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		a.bodyPos = offset
+	}
+
+	n, err := a.body.Read(p)
+	a.pos += int64(n)
+	a.bodyPos += int64(n)
+
+	return n, err
+}
+
+// Seek implements io.Seeker for the archiveStream
+func (a *archiveStream) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += a.pos
+	case io.SeekEnd:
+		size, err := a.body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return a.pos, err
+		}
+		a.bodyPos = size
+		pos += int64(len(a.header)) + size
+	default:
+		return a.pos, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return a.pos, errors.New("negative position")
+	}
+	a.pos = pos
+
+	return a.pos, nil
+}
@@ -0,0 +1,137 @@
+package sda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/streaming"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+
+	type rangeTest struct {
+		Header   string
+		Size     int64
+		Expected []httpRange
+		Error    bool
+	}
+
+	testRanges := []rangeTest{
+		{Header: "bytes=0-9", Size: 100, Expected: []httpRange{{0, 10}}},
+		{Header: "bytes=90-", Size: 100, Expected: []httpRange{{90, 10}}},
+		{Header: "bytes=-10", Size: 100, Expected: []httpRange{{90, 10}}},
+		{Header: "bytes=-200", Size: 100, Expected: []httpRange{{0, 100}}},
+		{Header: "bytes=50-200", Size: 100, Expected: []httpRange{{50, 50}}},
+		{Header: "bytes=0-0,-1", Size: 100, Expected: []httpRange{{0, 1}, {99, 1}}},
+		{Header: "bytes=20-29, 0-9", Size: 100, Expected: []httpRange{{0, 10}, {20, 10}}},
+		{Header: "bytes=0-9,5-14,15-19", Size: 100, Expected: []httpRange{{0, 20}}},
+		{Header: "bytes=0-9,200-", Size: 100, Expected: []httpRange{{0, 10}}},
+		{Header: "bytes=9-0", Size: 100, Error: true},
+		{Header: "bytes=a-b", Size: 100, Error: true},
+		{Header: "bytes=10", Size: 100, Error: true},
+		{Header: "items=0-9", Size: 100, Error: true},
+	}
+
+	for _, test := range testRanges {
+		ranges, err := parseRange(test.Header, test.Size)
+		if test.Error {
+			assert.Error(t, err, "expected error for %s", test.Header)
+			assert.NotErrorIs(t, err, errUnsatisfiableRange, "wrong error for %s", test.Header)
+
+			continue
+		}
+		assert.NoError(t, err, "unexpected error for %s", test.Header)
+		assert.Equal(t, test.Expected, ranges, "wrong ranges for %s", test.Header)
+	}
+
+	for _, header := range []string{"bytes=100-", "bytes=200-300", "bytes=-0"} {
+		_, err := parseRange(header, 100)
+		assert.ErrorIs(t, err, errUnsatisfiableRange, "expected unsatisfiable range for %s", header)
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	assert.Equal(t, "bytes 0-9/100", httpRange{0, 10}.contentRange(100))
+	assert.Equal(t, "bytes 99-99/100", httpRange{99, 1}.contentRange(100))
+}
+
+func TestArchiveStream(t *testing.T) {
+	stream := newArchiveStream([]byte("abc"), bytes.NewReader([]byte("defgh")))
+
+	data, err := io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(data))
+
+	pos, err := stream.Seek(2, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), pos)
+	data, err = io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "cdefgh", string(data))
+
+	pos, err = stream.Seek(-2, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), pos)
+	data, err = io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "gh", string(data))
+
+	_, err = stream.Seek(-9, io.SeekCurrent)
+	assert.Error(t, err)
+}
+
+// countingSeeker counts the bytes read from a ReadSeeker
+type countingSeeker struct {
+	io.ReadSeeker
+	read int
+}
+
+func (c *countingSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.read += n
+
+	return n, err
+}
+
+func TestArchiveStream_Crypt4GHSeek(t *testing.T) {
+	_, archiveKey, _ := keys.GenerateKeyPair()
+	archive := t.TempDir()
+
+	// Five segments of 64 KiB, and a bit
+	data := make([]byte, 5*65536+100)
+	_, _ = rand.Read(data)
+	header := createArchiveFile(t, archiveKey, archive, "file1", data)
+
+	file, err := os.Open(filepath.Join(archive, "file1"))
+	assert.NoError(t, err)
+	defer file.Close()
+	body := &countingSeeker{ReadSeeker: file}
+
+	c4ghr, err := streaming.NewCrypt4GHReader(newArchiveStream(header, body), archiveKey, nil)
+	assert.NoError(t, err)
+	defer c4ghr.Close()
+
+	// Only the last segment is read from the archive file
+	_, err = c4ghr.Seek(int64(len(data)-200), io.SeekStart)
+	assert.NoError(t, err)
+	tail, err := io.ReadAll(c4ghr)
+	assert.NoError(t, err)
+	assert.Equal(t, data[len(data)-200:], tail)
+	assert.LessOrEqual(t, body.read, 2*(65536+28))
+
+	// Seeking back reads the first segment again
+	body.read = 0
+	_, err = c4ghr.Seek(10, io.SeekStart)
+	assert.NoError(t, err)
+	start := make([]byte, 10)
+	_, err = io.ReadFull(c4ghr, start)
+	assert.NoError(t, err)
+	assert.Equal(t, data[10:20], start)
+	assert.Equal(t, 65536+28, body.read)
+}
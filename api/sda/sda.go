@@ -2,9 +2,12 @@ package sda
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -12,6 +15,8 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
 	"github.com/neicnordic/crypt4gh/streaming"
 	"github.com/neicnordic/sda-download/api/middleware"
 	"github.com/neicnordic/sda-download/internal/config"
@@ -20,7 +25,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var Backend storage.Backend
+var Backend storage.Reader
 
 func sanitizeString(str string) string {
 	var pattern = regexp.MustCompile(`(https?://[^\s/$.?#].[^\s]+|[A-Za-z0-9-_:.]+)`)
@@ -28,6 +33,33 @@ func sanitizeString(str string) string {
 	return pattern.ReplaceAllString(str, "[identifier]: $1")
 }
 
+// abortResponse fails a response that has already started by closing the
+// connection, as the status can't be changed anymore. Ending the handler
+// would finish a chunked response cleanly, so that clients couldn't tell the
+// content was cut short. The panic must reach net/http, which closes the
+// connection without logging.
+func abortResponse() {
+	panic(http.ErrAbortHandler)
+}
+
+// requestScheme returns the scheme, http or https, that a request was sent
+// with, as seen by the client
+func requestScheme(c *gin.Context) string {
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		return proto
+	}
+	if c.Request.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// requestBaseURL returns the scheme and host that a request was sent to
+func requestBaseURL(c *gin.Context) string {
+	return requestScheme(c) + "://" + c.Request.Host
+}
+
 // Datasets serves a list of permitted datasets
 func Datasets(c *gin.Context) {
 	log.Debugf("request permitted datasets")
@@ -36,7 +68,38 @@ func Datasets(c *gin.Context) {
 	// generated by the authentication middleware
 	cache := middleware.GetCacheFromContext(c)
 
+	format := listingFormat(c)
+
+	switch c.Query("expand") {
+	case "":
+	case "info":
+		details, err := database.GetDatasetDetails(cache.Datasets)
+		if err != nil {
+			log.Errorf("database query failed for dataset details, reason %s", err)
+			c.String(http.StatusInternalServerError, "database error")
+
+			return
+		}
+		if format != gin.MIMEJSON {
+			writeRows(c, format, datasetColumns, details, datasetRecord)
+
+			return
+		}
+		c.JSON(http.StatusOK, details)
+
+		return
+	default:
+		c.String(http.StatusBadRequest, "expand must be info")
+
+		return
+	}
+
 	// Return response
+	if format != gin.MIMEJSON {
+		writeRows(c, format, []string{"datasetId"}, cache.Datasets, func(d string) []string { return []string{d} })
+
+		return
+	}
 	c.JSON(http.StatusOK, cache.Datasets)
 }
 
@@ -54,6 +117,9 @@ func find(datasetID string, datasets []string) bool {
 	return found
 }
 
+// maxFilesPageSize is the largest page of a file listing
+const maxFilesPageSize = 10000
+
 // getFiles returns files belonging to a dataset
 var getFiles = func(datasetID string, ctx *gin.Context) ([]*database.FileInfo, int, error) {
 
@@ -79,14 +145,16 @@ var getFiles = func(datasetID string, ctx *gin.Context) ([]*database.FileInfo, i
 	return nil, 404, errors.New("dataset not found")
 }
 
-// Files serves a list of files belonging to a dataset
+// Files serves a list of files belonging to a dataset, or the details of the
+// dataset when the path doesn't end with /files
 func Files(c *gin.Context) {
 
 	// get dataset parameter
 	dataset := c.Param("dataset")
 
+	// Paths without /files are for the dataset itself
 	if !strings.HasSuffix(dataset, "/files") {
-		c.String(http.StatusNotFound, "API path not found, maybe /files is missing")
+		datasetDetails(c)
 
 		return
 	}
@@ -94,14 +162,186 @@ func Files(c *gin.Context) {
 	// remove / prefix and /files suffix
 	dataset = strings.TrimPrefix(dataset, "/")
 	dataset = strings.TrimSuffix(dataset, "/files")
+	dataset = addDatasetScheme(dataset, c.Query("scheme"))
+
+	filter, err := fileFilter(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	// Listings in row formats are streamed, unless they're paged
+	format := listingFormat(c)
+	if format != gin.MIMEJSON && filter.Limit == 0 {
+		streamFiles(c, format, dataset, filter)
+
+		return
+	}
+
+	// Without paging and filters all files are listed, as before
+	if filter == (database.FileFilter{}) {
+		files, code, err := getFiles(dataset, c)
+		if err != nil {
+			c.String(code, err.Error())
+
+			return
+		}
+
+		c.JSON(http.StatusOK, files)
+
+		return
+	}
+
+	// Get a page of dataset files, with one more to see if there's a next page
+	limit := filter.Limit
+	if limit > 0 {
+		filter.Limit++
+	}
+	files, code, err := getFilesPage(dataset, filter, c)
+	if err != nil {
+		c.String(code, err.Error())
+
+		return
+	}
+
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+		query := c.Request.URL.Query()
+		query.Set("page_token", base64.RawURLEncoding.EncodeToString([]byte(files[limit-1].FileID)))
+		c.Header("Link", fmt.Sprintf("<%s%s?%s>; rel=\"next\"", requestBaseURL(c), c.Request.URL.EscapedPath(), query.Encode()))
+	}
+
+	if format != gin.MIMEJSON {
+		writeRows(c, format, fileColumns, files, fileRecord)
+
+		return
+	}
+	c.JSON(http.StatusOK, files)
+}
+
+// getFilesPage returns the files belonging to a dataset that match a filter
+var getFilesPage = func(datasetID string, filter database.FileFilter, ctx *gin.Context) ([]*database.FileInfo, int, error) {
+	cache := middleware.GetCacheFromContext(ctx)
+
+	log.Debugf("request to process a page of files for dataset %s", sanitizeString(datasetID))
+
+	if !find(datasetID, cache.Datasets) {
+		return nil, 404, errors.New("dataset not found")
+	}
+
+	files, err := database.GetFilesPage(datasetID, filter)
+	if err != nil {
+		log.Errorf("database query failed for dataset %s, reason %s", sanitizeString(datasetID), err)
+
+		return nil, 500, errors.New("database error")
+	}
+
+	return files, 200, nil
+}
 
-	// Get optional dataset scheme
-	// A scheme can be delivered separately in a query parameter
-	// as schemes may sometimes be problematic when they travel
-	// in the path. A client can conveniently split the scheme with "://"
-	// which results in 1 item if there is no scheme (e.g. EGAD) or 2 items
-	// if there was a scheme (e.g. DOI)
-	scheme := c.Query("scheme")
+// fileFilter reads the paging and filter parameters of a file listing
+func fileFilter(c *gin.Context) (database.FileFilter, error) {
+	filter := database.FileFilter{
+		Status:     c.Query("status"),
+		PathPrefix: c.Query("path_prefix"),
+		NameGlob:   c.Query("name"),
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxFilesPageSize {
+			return filter, fmt.Errorf("limit must be an integer between 1 and %d", maxFilesPageSize)
+		}
+		filter.Limit = n
+	}
+
+	if token := c.Query("page_token"); token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(after) == 0 {
+			return filter, errors.New("invalid page_token")
+		}
+		filter.After = string(after)
+	}
+
+	return filter, nil
+}
+
+// datasetDetails serves the details of a dataset
+func datasetDetails(c *gin.Context) {
+	dataset := strings.TrimPrefix(c.Param("dataset"), "/")
+	dataset = addDatasetScheme(dataset, c.Query("scheme"))
+
+	cache := middleware.GetCacheFromContext(c)
+	if !find(dataset, cache.Datasets) {
+		c.String(http.StatusNotFound, "dataset not found")
+
+		return
+	}
+
+	details, err := database.GetDatasetDetails([]string{dataset})
+	if err != nil {
+		log.Errorf("database query failed for dataset %s, reason %s", sanitizeString(dataset), err)
+		c.String(http.StatusInternalServerError, "database error")
+
+		return
+	}
+	if len(details) == 0 {
+		c.String(http.StatusNotFound, "dataset not found")
+
+		return
+	}
+
+	c.JSON(http.StatusOK, details[0])
+}
+
+// FileMetadata serves the metadata of a single file
+func FileMetadata(c *gin.Context) {
+	fileID := c.Param("fileid")
+
+	// Check user has permissions for this file (as part of a dataset)
+	dataset, err := database.CheckFilePermission(fileID)
+	if err != nil {
+		c.String(http.StatusNotFound, "file not found")
+
+		return
+	}
+
+	cache := middleware.GetCacheFromContext(c)
+	if !find(dataset, cache.Datasets) {
+		log.Debugf("user requested file metadata, but does not have permissions for dataset %s", dataset)
+		c.String(http.StatusUnauthorized, "unauthorised")
+
+		return
+	}
+
+	file, err := database.GetFileMetadata(fileID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "database error")
+
+		return
+	}
+
+	// Only the datasets that the user has access to are listed
+	file.DatasetID = dataset
+	datasets := []string{}
+	for _, d := range file.Datasets {
+		if find(d, cache.Datasets) {
+			datasets = append(datasets, d)
+		}
+	}
+	file.Datasets = datasets
+
+	c.JSON(http.StatusOK, file)
+}
+
+// addDatasetScheme adds an optional dataset scheme to a dataset name.
+// A scheme can be delivered separately in a query parameter
+// as schemes may sometimes be problematic when they travel
+// in the path. A client can conveniently split the scheme with "://"
+// which results in 1 item if there is no scheme (e.g. EGAD) or 2 items
+// if there was a scheme (e.g. DOI)
+func addDatasetScheme(dataset, scheme string) string {
 	schemeLogs := strings.ReplaceAll(scheme, "\n", "")
 	schemeLogs = strings.ReplaceAll(schemeLogs, "\r", "")
 
@@ -113,16 +353,7 @@ func Files(c *gin.Context) {
 		log.Debugf("new dataset=%s", datasetLogs)
 	}
 
-	// Get dataset files
-	files, code, err := getFiles(dataset, c)
-	if err != nil {
-		c.String(code, err.Error())
-
-		return
-	}
-
-	// Return response
-	c.JSON(http.StatusOK, files)
+	return dataset
 }
 
 // Download serves file contents as bytes
@@ -166,28 +397,65 @@ func Download(c *gin.Context) {
 		return
 	}
 
+	// Files sent in encrypted form get a new header on every request, so the
+	// decrypted checksum only identifies the plain file contents
+	clientKey := c.GetHeader("Client-Public-Key")
+	etag := ""
+	if clientKey == "" && fileDetails.DecryptedChecksum != "" {
+		etag = fmt.Sprintf("%q", fileDetails.DecryptedChecksum)
+		c.Header("ETag", etag)
+
+		digest := reprDigest(c.GetHeader("Want-Repr-Digest"), fileDetails.DecryptedChecksum, fileDetails.DecryptedChecksumType)
+		if digest != "" {
+			c.Header("Repr-Digest", digest)
+		}
+	}
+
+	lastModified, err := time.Parse(time.RFC3339, fileDetails.LastModified)
+	switch {
+	case err == nil:
+		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	case c.GetBool("S3"):
+		log.Errorf("failed to parse last modified time: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+
+		return
+	default:
+		log.Debugf("failed to parse last modified time: %v", err)
+	}
+
+	// Evaluate conditional requests before touching the archive
+	if code := CheckPreconditions(c.Request, etag, lastModified); code != 0 {
+		log.Debugf("conditional request for file %s answered with %d", fileID, code)
+		c.AbortWithStatus(code)
+
+		return
+	}
+
 	// Get archive file handle
-	file, err := Backend.NewFileReader(fileDetails.ArchivePath)
+	file, err := Backend.NewFileReadSeeker(c.Request.Context(), fileDetails.ArchivePath)
 	if err != nil {
 		log.Errorf("could not find archive file %s, %s", fileDetails.ArchivePath, err)
-		c.String(http.StatusInternalServerError, "archive error")
+		switch storage.ErrorKindOf(err) {
+		case storage.ErrorNotFound:
+			c.String(http.StatusNotFound, "file not found")
+		case storage.ErrorTransient:
+			// The archive has been retried already, so clients should wait
+			// a while before trying again
+			c.Header("Retry-After", "30")
+			c.String(http.StatusServiceUnavailable, "archive unavailable")
+		default:
+			c.String(http.StatusInternalServerError, "archive error")
+		}
 
 		return
 	}
+	defer file.Close()
 
 	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Accept-Ranges", "bytes")
 	if c.GetBool("S3") {
-		lastModified, err := time.Parse(time.RFC3339, fileDetails.LastModified)
-		if err != nil {
-			log.Errorf("failed to parse last modified time: %v", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-
-			return
-		}
-
 		c.Header("Content-Disposition", fmt.Sprintf("filename: %v", fileID))
-		c.Header("ETag", fileDetails.DecryptedChecksum)
-		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
 	}
 
 	if c.Request.Method == http.MethodHead {
@@ -195,17 +463,6 @@ func Download(c *gin.Context) {
 		return
 	}
 
-	hr := bytes.NewReader(fileDetails.Header)
-	mr := io.MultiReader(hr, file)
-	c4ghr, err := streaming.NewCrypt4GHReader(mr, *config.Config.App.Crypt4GHKey, nil)
-	if err != nil {
-		log.Errorf("could not prepare file for streaming, %s", err)
-		c.String(http.StatusInternalServerError, "file stream error")
-
-		return
-	}
-	defer c4ghr.Close()
-
 	// Get query params
 	qStart := c.DefaultQuery("startCoordinate", "0")
 	qEnd := c.DefaultQuery("endCoordinate", "0")
@@ -234,26 +491,158 @@ func Download(c *gin.Context) {
 		return
 	}
 
-	if start == 0 && end == 0 {
-		c.Header("Content-Length", fmt.Sprint(fileDetails.DecryptedSize))
+	var fileStream io.ReadSeeker
+	var fileSize int64
+
+	// A client that sends its public key gets the file in encrypted form.
+	// The stored header is re-encrypted for the client key and the archive
+	// body is passed through as is, so the data is never decrypted here.
+	if clientKey != "" {
+		publicKey, err := parsePublicKey(clientKey)
+		if err != nil {
+			log.Debugf("failed to parse client public key, %s", err)
+			c.String(http.StatusBadRequest, "bad public key")
+
+			return
+		}
+
+		newHeader, err := headers.ReEncryptHeader(fileDetails.Header, *config.Config.App.Crypt4GHKey, [][32]byte{publicKey})
+		if err != nil {
+			log.Errorf("failed to re-encrypt file header, %s", err)
+			c.String(http.StatusInternalServerError, "file header error")
+
+			return
+		}
+
+		fileStream = newArchiveStream(newHeader, file)
+		fileSize = int64(len(newHeader) + fileDetails.ArchiveSize)
 	} else {
+		// Seeking in the decrypted stream seeks in the archive file to the
+		// segment holding the position
+		c4ghr, err := streaming.NewCrypt4GHReader(newArchiveStream(fileDetails.Header, file), *config.Config.App.Crypt4GHKey, nil)
+		if err != nil {
+			log.Errorf("could not prepare file for streaming, %s", err)
+			c.String(http.StatusInternalServerError, "file stream error")
+
+			return
+		}
+		defer c4ghr.Close()
+
+		fileStream = c4ghr
+		fileSize = int64(fileDetails.DecryptedSize)
+	}
+
+	// A Range header is only used when no coordinates are given, and if an
+	// If-Range header is given, only for the same version of the file
+	var ranges []httpRange
+	rangeHeader := c.GetHeader("Range")
+	if rangeHeader != "" && start == 0 && end == 0 && ifRangeMatches(c.Request, etag, lastModified) {
+		ranges, err = parseRange(rangeHeader, fileSize)
+		switch {
+		case errors.Is(err, errUnsatisfiableRange):
+			log.Debugf("requested range %s is outside of file of size %d", rangeHeader, fileSize)
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+			c.String(http.StatusRequestedRangeNotSatisfiable, "requested range not satisfiable")
+
+			return
+		case err != nil:
+			// Malformed range headers are ignored and the full file is sent
+			log.Debugf("ignoring range header %s, %s", rangeHeader, err)
+			ranges = nil
+		}
+	}
+
+	// Partial content gets a Content-Digest trailer computed while sending,
+	// if the client accepts trailers. Trailers require a chunked response,
+	// so no Content-Length is sent in that case.
+	var writer io.Writer = c.Writer
+	var digestAlgorithm string
+	var digestHash hash.Hash
+	if len(ranges) > 0 && acceptsTrailers(c.Request) {
+		digestAlgorithm, digestHash = contentDigestHash(c.GetHeader("Want-Content-Digest"))
+		if digestHash != nil {
+			c.Header("Trailer", "Content-Digest")
+			writer = io.MultiWriter(c.Writer, digestHash)
+		}
+	}
+
+	switch {
+	case len(ranges) > 1:
+		mw := multipart.NewWriter(writer)
+		c.Header("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		c.Status(http.StatusPartialContent)
+
+		err = sendRanges(fileStream, mw, ranges, fileSize)
+	case len(ranges) == 1:
+		c.Header("Content-Range", ranges[0].contentRange(fileSize))
+		if digestHash == nil {
+			c.Header("Content-Length", fmt.Sprint(ranges[0].length))
+		}
+		c.Status(http.StatusPartialContent)
+
+		err = sendStream(fileStream, writer, ranges[0].start, ranges[0].start+ranges[0].length)
+	case start == 0 && end == 0:
+		c.Header("Content-Length", fmt.Sprint(fileSize))
+
+		// Complete decrypted files are verified against the stored checksum
+		// while they are sent
+		if clientKey == "" && fileDetails.DecryptedChecksum != "" {
+			verifier, err := newVerifyingReader(fileStream, fileSize, fileDetails.DecryptedChecksum, fileDetails.DecryptedChecksumType)
+			if err != nil {
+				log.Warnf("file %s can't be verified while streaming, %s", fileID, err)
+			} else {
+				fileStream = verifier
+			}
+		}
+
+		err = sendStream(fileStream, c.Writer, start, end)
+	default:
 		// Calculate how much we should read (if given)
 		togo := end - start
 		c.Header("Content-Length", fmt.Sprint(togo))
-	}
 
-	err = sendStream(c4ghr, c.Writer, start, end)
+		err = sendStream(fileStream, c.Writer, start, end)
+	}
 	if err != nil {
-		log.Errorf("error occurred while sending stream: %v", err)
+		if errors.Is(err, errChecksumMismatch) {
+			log.Errorf("corrupted archive file: checksum mismatch for file %s at archive path %s, download aborted", fileID, fileDetails.ArchivePath)
+		} else {
+			log.Errorf("error occurred while sending stream: %v", err)
+		}
+
+		// Once the response has started, the only way to signal the error
+		// is to close the connection, also for chunked responses without a
+		// Content-Length
+		if c.Writer.Written() {
+			abortResponse()
+		}
+
+		c.Writer.Header().Del("Content-Length")
+		c.Writer.Header().Del("Content-Range")
 		c.String(http.StatusInternalServerError, "an error occurred")
 
 		return
 	}
+
+	if digestHash != nil {
+		c.Writer.Header().Set("Content-Digest", formatDigest(digestAlgorithm, digestHash.Sum(nil)))
+	}
+}
+
+// parsePublicKey reads a Crypt4GH public key from the base64 encoded
+// contents of a public key file, as sent in the Client-Public-Key header
+var parsePublicKey = func(encodedKey string) ([32]byte, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return keys.ReadPublicKey(bytes.NewReader(keyBytes))
 }
 
 // sendStream
 // used from: https://github.com/neicnordic/crypt4gh/blob/master/examples/reader/main.go#L48C1-L113C1
-var sendStream = func(reader *streaming.Crypt4GHReader, writer http.ResponseWriter, start, end int64) error {
+var sendStream = func(reader io.ReadSeeker, writer io.Writer, start, end int64) error {
 
 	if start != 0 {
 		// We don't want to read from start, skip ahead to where we should be
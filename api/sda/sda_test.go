@@ -2,12 +2,25 @@ package sda
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	"github.com/neicnordic/crypt4gh/streaming"
+	"github.com/stretchr/testify/assert"
 
 	"github.com/neicnordic/sda-download/api/middleware"
 	"github.com/neicnordic/sda-download/internal/config"
@@ -320,6 +333,99 @@ func TestFiles_Success(t *testing.T) {
 
 }
 
+func TestFiles_Page(t *testing.T) {
+
+	// Save original to-be-mocked functions
+	originalGetFilesPage := getFilesPage
+	defer func() { getFilesPage = originalGetFilesPage }()
+
+	var gotFilter database.FileFilter
+	getFilesPage = func(datasetID string, filter database.FileFilter, ctx *gin.Context) ([]*database.FileInfo, int, error) {
+		gotFilter = filter
+		files := []*database.FileInfo{}
+		for _, id := range []string{"file3", "file4", "file5"} {
+			files = append(files, &database.FileInfo{FileID: id, DatasetID: datasetID})
+		}
+
+		return files[:min(len(files), filter.Limit)], 200, nil
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "https://example.org/metadata/datasets/dataset1/files?limit=2&page_token=ZmlsZTI&status=ready&path_prefix=dir/&name=*.bam", nil)
+	c.Params = []gin.Param{{Key: "dataset", Value: "/dataset1/files"}}
+
+	Files(c)
+	response := w.Result()
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, database.FileFilter{After: "file2", Limit: 3, Status: "ready", PathPrefix: "dir/", NameGlob: "*.bam"}, gotFilter)
+	assert.JSONEq(t, `[{"fileId":"file3","datasetId":"dataset1","displayFileName":"","filePath":"","fileName":"","fileSize":0,"decryptedFileSize":0,"decryptedFileChecksum":"","decryptedFileChecksumType":"","fileStatus":"","createdAt":"","lastModified":""},`+
+		`{"fileId":"file4","datasetId":"dataset1","displayFileName":"","filePath":"","fileName":"","fileSize":0,"decryptedFileSize":0,"decryptedFileChecksum":"","decryptedFileChecksumType":"","fileStatus":"","createdAt":"","lastModified":""}]`, string(body))
+	assert.Equal(t, `<https://example.org/metadata/datasets/dataset1/files?limit=2&name=%2A.bam&page_token=ZmlsZTQ&path_prefix=dir%2F&status=ready>; rel="next"`, response.Header.Get("Link"))
+
+	// The last page has no next link
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/metadata/datasets/dataset1/files?limit=3", nil)
+	c.Params = []gin.Param{{Key: "dataset", Value: "/dataset1/files"}}
+
+	Files(c)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get("Link"))
+}
+
+func TestFiles_BadPageParameters(t *testing.T) {
+	for _, query := range []string{"limit=0", "limit=abc", "limit=10001", "page_token=%21%21"} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/metadata/datasets/dataset1/files?"+query, nil)
+		c.Params = []gin.Param{{Key: "dataset", Value: "/dataset1/files"}}
+
+		Files(c)
+		assert.Equal(t, 400, w.Code, query)
+	}
+}
+
+func TestGetFilesPage(t *testing.T) {
+
+	// Save original to-be-mocked functions
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	originalGetFilesPageDB := database.GetFilesPage
+	defer func() {
+		middleware.GetCacheFromContext = originalGetCacheFromContext
+		database.GetFilesPage = originalGetFilesPageDB
+	}()
+
+	middleware.GetCacheFromContext = func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}}
+	}
+	database.GetFilesPage = func(datasetID string, filter database.FileFilter) ([]*database.FileInfo, error) {
+		if filter.Status == "broken" {
+			return nil, errors.New("something went wrong")
+		}
+
+		return []*database.FileInfo{{FileID: "file1"}}, nil
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	files, code, err := getFilesPage("dataset1", database.FileFilter{Limit: 1}, c)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Len(t, files, 1)
+
+	_, code, err = getFilesPage("dataset2", database.FileFilter{Limit: 1}, c)
+	assert.EqualError(t, err, "dataset not found")
+	assert.Equal(t, 404, code)
+
+	_, code, err = getFilesPage("dataset1", database.FileFilter{Status: "broken"}, c)
+	assert.EqualError(t, err, "database error")
+	assert.Equal(t, 500, code)
+}
+
 func TestDownload_Fail_FileNotFound(t *testing.T) {
 
 	// Save original to-be-mocked functions
@@ -480,6 +586,8 @@ func TestDownload_Fail_OpenFile(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
 
+	c.Request = httptest.NewRequest("GET", "/files/file1", nil)
+
 	// Test the outcomes of the handler
 	Download(c)
 	response := w.Result()
@@ -504,3 +612,396 @@ func TestDownload_Fail_OpenFile(t *testing.T) {
 	database.GetFile = originalGetFile
 
 }
+
+// failingReader is an archive where every file fails to open with err
+type failingReader struct {
+	storage.Reader
+	err error
+}
+
+func (r failingReader) NewFileReadSeeker(context.Context, string) (io.ReadSeekCloser, error) {
+	return nil, r.err
+}
+
+func TestDownload_Fail_ArchiveErrors(t *testing.T) {
+
+	mockFileDownload(t, []byte("this is a test file"))
+	mock[storage.Reader](t, &Backend, failingReader{err: &storage.Error{Kind: storage.ErrorNotFound, FilePath: "file1", Err: os.ErrNotExist}})
+	response, body := requestDownload(nil)
+	assert.Equal(t, 404, response.StatusCode)
+	assert.Equal(t, "file not found", string(body))
+
+	// Transient errors have been retried, so clients are asked to wait
+	Backend = failingReader{err: &storage.Error{Kind: storage.ErrorTransient, FilePath: "file1", Err: errors.New("slow down")}}
+	response, body = requestDownload(nil)
+	assert.Equal(t, 503, response.StatusCode)
+	assert.Equal(t, "30", response.Header.Get("Retry-After"))
+	assert.Equal(t, "archive unavailable", string(body))
+
+	Backend = failingReader{err: errors.New("access denied")}
+	response, body = requestDownload(nil)
+	assert.Equal(t, 500, response.StatusCode)
+	assert.Equal(t, "archive error", string(body))
+}
+
+// requestDownload runs the Download handler for a request with the given
+// headers and returns the response
+func requestDownload(requestHeaders map[string]string) (*http.Response, []byte) {
+	r := httptest.NewRequest("GET", "/files/file1", nil)
+	for k, v := range requestHeaders {
+		r.Header.Set(k, v)
+	}
+
+	response := serve(Download, r).Result()
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+
+	return response, body
+}
+
+func TestDownload_Encrypted(t *testing.T) {
+
+	data := []byte("this is a test file")
+	mockFileDownload(t, data)
+
+	clientPublicKey, clientPrivateKey, _ := keys.GenerateKeyPair()
+	var pemKey bytes.Buffer
+	_ = keys.WriteCrypt4GHX25519PublicKey(&pemKey, clientPublicKey)
+
+	response, body := requestDownload(map[string]string{"Client-Public-Key": base64.StdEncoding.EncodeToString(pemKey.Bytes())})
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, fmt.Sprint(len(body)), response.Header.Get("Content-Length"))
+
+	// The size is the file size given in listings
+	fileDetails, _ := database.GetFile("file1")
+	assert.Equal(t, len(fileDetails.Header)+fileDetails.ArchiveSize, len(body))
+
+	// The response should only be readable with the client key
+	_, err := streaming.NewCrypt4GHReader(bytes.NewReader(body), *config.Config.App.Crypt4GHKey, nil)
+	assert.Error(t, err, "archive key could read the encrypted download")
+
+	c4ghr, err := streaming.NewCrypt4GHReader(bytes.NewReader(body), clientPrivateKey, nil)
+	assert.NoError(t, err)
+	decrypted, err := io.ReadAll(c4ghr)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	// Encrypted downloads have no entity tag, but "*" matches any existing file
+	response, _ = requestDownload(map[string]string{"Client-Public-Key": base64.StdEncoding.EncodeToString(pemKey.Bytes()), "If-Match": "*"})
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Empty(t, response.Header.Get("ETag"))
+	response, _ = requestDownload(map[string]string{"Client-Public-Key": base64.StdEncoding.EncodeToString(pemKey.Bytes()), "If-Match": `"outdated"`})
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+
+	// A key that can't be parsed is a bad request
+	response, body = requestDownload(map[string]string{"Client-Public-Key": "not a key"})
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Equal(t, "bad public key", string(body))
+}
+
+// TestEncryptedHeaderSize checks that re-encrypted headers have the length
+// of the stored header, which the file size in listings relies on
+func TestEncryptedHeaderSize(t *testing.T) {
+	_, archiveKey, _ := keys.GenerateKeyPair()
+	clientPublicKey, _, _ := keys.GenerateKeyPair()
+	editList := &headers.DataEditListHeaderPacket{
+		PacketType:    headers.PacketType{PacketType: headers.DataEditList},
+		NumberLengths: 2,
+		Lengths:       []uint64{2, 5},
+	}
+
+	for _, dataEditList := range []*headers.DataEditListHeaderPacket{nil, editList} {
+		var buf bytes.Buffer
+		c4ghWriter, err := streaming.NewCrypt4GHWriterWithoutPrivateKey(&buf, [][32]byte{keys.DerivePublicKey(archiveKey)}, dataEditList)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, _ = c4ghWriter.Write([]byte("this is a test file"))
+		c4ghWriter.Close()
+
+		header, err := headers.ReadHeader(&buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		newHeader, err := headers.ReEncryptHeader(header, archiveKey, [][32]byte{clientPublicKey})
+		assert.NoError(t, err)
+		assert.Equal(t, len(header), len(newHeader))
+	}
+}
+
+func TestDownload_Range(t *testing.T) {
+
+	data := []byte("0123456789abcdefghij")
+	mockFileDownload(t, data)
+
+	// Single range
+	response, body := requestDownload(map[string]string{"Range": "bytes=2-5"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "bytes 2-5/20", response.Header.Get("Content-Range"))
+	assert.Equal(t, "4", response.Header.Get("Content-Length"))
+	assert.Equal(t, "bytes", response.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "2345", string(body))
+
+	// Suffix range
+	response, body = requestDownload(map[string]string{"Range": "bytes=-3"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "bytes 17-19/20", response.Header.Get("Content-Range"))
+	assert.Equal(t, "hij", string(body))
+
+	// Multiple ranges
+	response, body = requestDownload(map[string]string{"Range": "bytes=10-11,0-1"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for _, expected := range []struct{ contentRange, data string }{{"bytes 0-1/20", "01"}, {"bytes 10-11/20", "ab"}} {
+		part, err := mr.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, expected.contentRange, part.Header.Get("Content-Range"))
+		partData, _ := io.ReadAll(part)
+		assert.Equal(t, expected.data, string(partData))
+	}
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Unsatisfiable range
+	response, _ = requestDownload(map[string]string{"Range": "bytes=20-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, response.StatusCode)
+	assert.Equal(t, "bytes */20", response.Header.Get("Content-Range"))
+
+	// Malformed ranges are ignored
+	response, body = requestDownload(map[string]string{"Range": "bytes=5-2"})
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, data, body)
+}
+
+func TestDownload_Conditional(t *testing.T) {
+
+	data := []byte("0123456789abcdefghij")
+	mockFileDownload(t, data)
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+
+	response, body := requestDownload(nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, etag, response.Header.Get("ETag"))
+	assert.Equal(t, "Mon, 17 Apr 2023 14:40:12 GMT", response.Header.Get("Last-Modified"))
+	assert.Equal(t, data, body)
+
+	response, body = requestDownload(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, response.StatusCode)
+	assert.Empty(t, body)
+
+	response, _ = requestDownload(map[string]string{"If-Modified-Since": "Mon, 17 Apr 2023 14:40:12 GMT"})
+	assert.Equal(t, http.StatusNotModified, response.StatusCode)
+
+	response, _ = requestDownload(map[string]string{"If-Match": `"outdated"`})
+	assert.Equal(t, http.StatusPreconditionFailed, response.StatusCode)
+
+	// If-Range only keeps the range for the current version of the file
+	response, body = requestDownload(map[string]string{"Range": "bytes=0-1", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "01", string(body))
+
+	response, body = requestDownload(map[string]string{"Range": "bytes=0-1", "If-Range": `"outdated"`})
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, data, body)
+}
+
+func TestDownload_Fail_Checksum(t *testing.T) {
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	mockFileDownload(t, data)
+
+	// Make the stored checksum not match the archived file
+	getFile := database.GetFile
+	mock(t, &database.GetFile, func(fileID string) (*database.FileDownload, error) {
+		fileDetails, err := getFile(fileID)
+		fileDetails.DecryptedChecksum = fmt.Sprintf("%x", sha256.Sum256([]byte("other data")))
+
+		return fileDetails, err
+	})
+
+	response, body, err := fetch(Download, "/files/:fileid", "GET", "/files/file1", nil)
+	if !assert.NotNil(t, response) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, fmt.Sprint(len(data)), response.Header.Get("Content-Length"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, len(body), len(data), "corrupted file was sent in full")
+	assert.Equal(t, data[:len(body)], body)
+
+	// Ranges are not verified
+	response, body = requestDownload(map[string]string{"Range": "bytes=0-9"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, data[:10], body)
+}
+
+func TestDownload_Digest(t *testing.T) {
+
+	data := []byte("0123456789abcdefghij")
+	mockFileDownload(t, data)
+
+	sum := sha256.Sum256(data)
+	reprDigest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+	response, _ := requestDownload(nil)
+	assert.Equal(t, reprDigest, response.Header.Get("Repr-Digest"))
+
+	response, _ = requestDownload(map[string]string{"Want-Repr-Digest": "sha-256=0"})
+	assert.Equal(t, "", response.Header.Get("Repr-Digest"))
+
+	// Ranges get a Content-Digest trailer for the sent content
+	response, body := requestDownload(map[string]string{"Range": "bytes=2-5", "TE": "trailers"})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "", response.Header.Get("Content-Length"))
+	assert.Equal(t, "2345", string(body))
+	contentSum := sha256.Sum256(body)
+	assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(contentSum[:])+":", response.Trailer.Get("Content-Digest"))
+
+	// Without trailer support the Content-Length is kept
+	response, _ = requestDownload(map[string]string{"Range": "bytes=2-5"})
+	assert.Equal(t, "4", response.Header.Get("Content-Length"))
+	assert.Empty(t, response.Trailer)
+}
+
+func TestFileMetadata(t *testing.T) {
+
+	// Save original to-be-mocked functions
+	originalCheckFilePermission := database.CheckFilePermission
+	originalGetCacheFromContext := middleware.GetCacheFromContext
+	originalGetFileMetadata := database.GetFileMetadata
+	defer func() {
+		database.CheckFilePermission = originalCheckFilePermission
+		middleware.GetCacheFromContext = originalGetCacheFromContext
+		database.GetFileMetadata = originalGetFileMetadata
+	}()
+
+	database.CheckFilePermission = func(fileID string) (string, error) {
+		switch fileID {
+		case "file1", "file3":
+			return "dataset1", nil
+		case "file2":
+			return "dataset2", nil
+		default:
+			return "", errors.New("sql: no rows in result set")
+		}
+	}
+	middleware.GetCacheFromContext = func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1", "dataset3"}}
+	}
+	database.GetFileMetadata = func(fileID string) (*database.FileMetadata, error) {
+		if fileID == "file3" {
+			return nil, errors.New("something went wrong")
+		}
+
+		return &database.FileMetadata{
+			FileInfo:   database.FileInfo{FileID: fileID, FileSize: 184, DecryptedFileSize: 32, Status: "ready"},
+			HeaderSize: 124,
+			Checksums:  []database.Checksum{{Checksum: "hash", Type: "SHA256", Source: "UNENCRYPTED"}},
+			Datasets:   []string{"dataset1", "dataset2", "dataset3"},
+		}, nil
+	}
+
+	request := func(fileID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = []gin.Param{{Key: "fileid", Value: fileID}}
+		FileMetadata(c)
+
+		return w
+	}
+
+	w := request("file1")
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"fileId":"file1","datasetId":"dataset1","displayFileName":"","filePath":"","fileName":"",`+
+		`"fileSize":184,"decryptedFileSize":32,"decryptedFileChecksum":"","decryptedFileChecksumType":"",`+
+		`"fileStatus":"ready","createdAt":"","lastModified":"","headerSize":124,`+
+		`"checksums":[{"checksum":"hash","type":"SHA256","source":"UNENCRYPTED"}],"datasets":["dataset1","dataset3"]}`, w.Body.String())
+
+	w = request("file2")
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "unauthorised", w.Body.String())
+
+	w = request("file4")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "file not found", w.Body.String())
+
+	w = request("file3")
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "database error", w.Body.String())
+}
+
+func TestDatasetDetails(t *testing.T) {
+	mockDatasetDetails(t)
+
+	request := func(target, dataset string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", target, nil)
+		c.Params = []gin.Param{{Key: "dataset", Value: dataset}}
+		Files(c)
+
+		return w
+	}
+
+	w := request("/metadata/datasets/dataset1", "/dataset1")
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"datasetId":"dataset1","createdAt":"2023-01-01T10:00:00Z","releasedAt":"2023-02-01T10:00:00Z",`+
+		`"lastModified":"2023-01-15T10:00:00Z","fileCount":3,"totalFileSize":552,"totalDecryptedFileSize":96,`+
+		`"fileStatus":{"ready":3}}`, w.Body.String())
+
+	w = request("/metadata/datasets/doi.org/abc/123?scheme=https", "/doi.org/abc/123")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"datasetId":"https://doi.org/abc/123"`)
+
+	// Permitted, but not in the database
+	w = request("/metadata/datasets/dataset2", "/dataset2")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "dataset not found", w.Body.String())
+
+	w = request("/metadata/datasets/dataset3", "/dataset3")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "dataset not found", w.Body.String())
+
+	middleware.GetCacheFromContext = func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"broken"}}
+	}
+	w = request("/metadata/datasets/broken", "/broken")
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, "database error", w.Body.String())
+}
+
+func TestDatasets_ExpandInfo(t *testing.T) {
+	mockDatasetDetails(t)
+
+	request := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", target, nil)
+		Datasets(c)
+
+		return w
+	}
+
+	w := request("/metadata/datasets?expand=info")
+	assert.Equal(t, 200, w.Code)
+	details := []database.DatasetDetails{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	assert.Len(t, details, 2)
+	assert.Equal(t, "dataset1", details[0].DatasetID)
+	assert.Equal(t, "https://doi.org/abc/123", details[1].DatasetID)
+	assert.Equal(t, int64(3), details[1].FileCount)
+
+	w = request("/metadata/datasets?expand=files")
+	assert.Equal(t, 400, w.Code)
+
+	middleware.GetCacheFromContext = func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"broken"}}
+	}
+	w = request("/metadata/datasets?expand=info")
+	assert.Equal(t, 500, w.Code)
+}
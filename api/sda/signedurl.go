@@ -0,0 +1,88 @@
+package sda
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// SignedURL serves a short-lived signed URL for downloading a file, which can
+// be used without an access token
+func SignedURL(c *gin.Context) {
+	fileID := c.Param("fileid")
+
+	// Check user has permissions for this file (as part of a dataset)
+	dataset, err := database.CheckFilePermission(fileID)
+	if err != nil {
+		c.String(http.StatusNotFound, "file not found")
+
+		return
+	}
+	cache := middleware.GetCacheFromContext(c)
+	if !find(dataset, cache.Datasets) {
+		log.Debugf("user requested signed URL, but does not have permissions for dataset %s", dataset)
+		c.String(http.StatusUnauthorized, "unauthorised")
+
+		return
+	}
+
+	expiry := config.Config.App.SignedURLExpiry
+	if expiresIn := c.Query("expires_in"); expiresIn != "" {
+		seconds, err := strconv.Atoi(expiresIn)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > expiry {
+			c.String(http.StatusBadRequest, fmt.Sprintf("expires_in must be between 1 and %d seconds", int(expiry.Seconds())))
+
+			return
+		}
+		expiry = time.Duration(seconds) * time.Second
+	}
+
+	expiry = signedURLExpiry(c, expiry)
+	if expiry <= 0 {
+		c.String(http.StatusUnauthorized, "access token has expired")
+
+		return
+	}
+
+	start, end := c.Query("startCoordinate"), c.Query("endCoordinate")
+	for _, coordinate := range []string{start, end} {
+		if _, err := strconv.ParseInt(coordinate, 10, 64); coordinate != "" && err != nil {
+			c.String(http.StatusBadRequest, "coordinates must be integers")
+
+			return
+		}
+	}
+
+	expires := time.Now().Add(expiry)
+	c.JSON(http.StatusOK, gin.H{
+		"url":     signedFileURL(c, fileID, dataset, start, end, expires),
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// signedURLExpiry caps the lifetime of a URL signed for a request, so that it
+// doesn't outlive the token of the request
+func signedURLExpiry(c *gin.Context, expiry time.Duration) time.Duration {
+	cache := middleware.GetCacheFromContext(c)
+	if !cache.Expires.IsZero() {
+		expiry = min(expiry, time.Until(cache.Expires))
+	}
+
+	return expiry
+}
+
+// signedFileURL returns a URL for downloading a file in dataset, signed to be
+// valid until expires
+func signedFileURL(c *gin.Context, fileID, dataset, start, end string, expires time.Time) string {
+	query := middleware.SignURL("/files/"+fileID, dataset, start, end, expires)
+
+	return fmt.Sprintf("%s/files/%s?%s", requestBaseURL(c), url.PathEscape(fileID), query.Encode())
+}
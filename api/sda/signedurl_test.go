@@ -0,0 +1,83 @@
+package sda
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neicnordic/sda-download/api/middleware"
+	"github.com/neicnordic/sda-download/internal/config"
+	"github.com/neicnordic/sda-download/internal/session"
+)
+
+func requestSignedURL(fileID, query string) *httptest.ResponseRecorder {
+	return serve(SignedURL, httptest.NewRequest("GET", "/files/"+fileID+"/sign?"+query, nil), gin.Param{Key: "fileid", Value: fileID})
+}
+
+func TestSignedURL(t *testing.T) {
+	mockDrs(t)
+	mock(t, &config.Config.App.SigningKey, []byte("secret"))
+	mock(t, &config.Config.App.SignedURLExpiry, time.Hour)
+
+	w := requestSignedURL("file1", "expires_in=60&startCoordinate=0&endCoordinate=5")
+	assert.Equal(t, 200, w.Code)
+
+	var response struct {
+		URL     string `json:"url"`
+		Expires string `json:"expires"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	signed, err := url.Parse(response.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", signed.Host)
+	assert.Equal(t, "/files/file1", signed.Path)
+	assert.Equal(t, "dataset1", signed.Query().Get("dataset"))
+	assert.Equal(t, "5", signed.Query().Get("endCoordinate"))
+	assert.NotEmpty(t, signed.Query().Get("signature"))
+	expires, err := time.Parse(time.RFC3339, response.Expires)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expires, 5*time.Second)
+
+	// The URL doesn't outlive the token
+	tokenExpires := time.Now().Add(10 * time.Minute)
+	mock(t, &middleware.GetCacheFromContext, func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}, Expires: tokenExpires}
+	})
+	w = requestSignedURL("file1", "")
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	expires, err = time.Parse(time.RFC3339, response.Expires)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, tokenExpires, expires, 5*time.Second)
+
+	mock(t, &middleware.GetCacheFromContext, func(ctx *gin.Context) session.Cache {
+		return session.Cache{Datasets: []string{"dataset1"}, Expires: time.Now().Add(-time.Minute)}
+	})
+	w = requestSignedURL("file1", "")
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestSignedURL_Fail(t *testing.T) {
+	mockDrs(t)
+	mock(t, &config.Config.App.SignedURLExpiry, time.Hour)
+
+	for _, test := range []struct {
+		fileID string
+		query  string
+		code   int
+	}{
+		{"file4", "", 404},
+		{"file3", "", 401},
+		{"file1", "expires_in=0", 400},
+		{"file1", "expires_in=3601", 400},
+		{"file1", "startCoordinate=a", 400},
+	} {
+		w := requestSignedURL(test.fileID, test.query)
+		assert.Equal(t, test.code, w.Code, test.fileID+"?"+test.query)
+	}
+}
@@ -63,17 +63,37 @@ func init() {
 	}
 	session.SessionCache = sessionCache
 
-	backend, err := storage.NewBackend(conf.Archive)
+	// The archive is only read, never written to
+	backend, err := storage.NewReader(conf.Archive)
 	if err != nil {
 		log.Panicf("Error initiating storage backend, reason: %v", err)
 	}
-	sda.Backend = backend
+
+	// Files are read from the backup if the archive fails. Downloads work
+	// without it, so a backup that can't be reached is only logged.
+	var backup storage.Reader
+	if conf.Backup.Type != "" {
+		backup, err = storage.NewReader(conf.Backup)
+		if err != nil {
+			log.Errorf("Error initiating backup storage backend, continuing without it, reason: %v", err)
+			backup = nil
+		}
+	}
+	sda.Backend = storage.NewFailoverReader(backend, backup)
 }
 
 // main starts the web server
 func main() {
 	srv := api.Setup()
 
+	// Operator metrics are served on a listener of their own
+	if metrics := api.SetupMetrics(); metrics != nil {
+		log.Infof("Metrics are served at http://%s", metrics.Addr)
+		go func() {
+			log.Fatal(metrics.ListenAndServe())
+		}()
+	}
+
 	// Start the server
 	log.Info("(5/5) Starting web server")
 	if config.Config.App.ServerCert != "" && config.Config.App.ServerKey != "" {
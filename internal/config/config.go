@@ -34,6 +34,10 @@ type Map struct {
 	DB      DatabaseConfig
 	OIDC    OIDCConfig
 	Archive storage.Conf
+	// Backup is the optional backup copy of the archive, its Type is empty
+	// when not configured
+	Backup storage.Conf
+	S3     S3Config
 }
 
 type AppConfig struct {
@@ -60,6 +64,26 @@ type AppConfig struct {
 	// Selected middleware for authentication and authorizaton
 	// Optional. Default value is "default" for TokenMiddleware
 	Middleware string
+
+	// Key for signing download URLs
+	// Required. Must be the same on all instances serving the same archive
+	SigningKey []byte
+
+	// Maximum lifetime of signed download URLs
+	// Optional. Default value 1 hour
+	SignedURLExpiry time.Duration
+
+	// Maximum number of files in a bundle request
+	// Optional. Default value 1000
+	BundleMaxFiles int
+
+	// Port of the separate, plain HTTP, listener for operator metrics
+	// Optional. Default value 0, which doesn't serve metrics
+	MetricsPort int
+
+	// Hostname of the listener for operator metrics
+	// Optional. Default value 127.0.0.1
+	MetricsHost string
 }
 
 type SessionConfig struct {
@@ -86,6 +110,22 @@ type SessionConfig struct {
 	Name string
 }
 
+type S3Config struct {
+	// Lifetime of the access keys issued for the S3 interface
+	// Optional. Default value 1 hour
+	CredentialExpiry time.Duration
+
+	// Base domain for virtual-hosted-style requests to the S3 interface,
+	// where the bucket is given as <bucket>.<domain>
+	// Optional. Defaults to empty, for path-style requests only
+	Domain string
+
+	// Size in bytes of the parts that objects are split into for partNumber
+	// requests, as if they had been uploaded in parts
+	// Optional. Default value 8 MiB
+	PartSize int64
+}
+
 type TrustedISS struct {
 	ISS string `json:"iss"`
 	JKU string `json:"jku"`
@@ -164,6 +204,7 @@ func NewConfig() (*Map, error) {
 	}
 	requiredConfVars := []string{
 		"db.host", "db.user", "db.password", "db.database", "c4gh.filepath", "c4gh.passphrase", "oidc.configuration.url",
+		"app.signingkey",
 	}
 
 	if viper.GetString("archive.type") == S3 {
@@ -172,6 +213,12 @@ func NewConfig() (*Map, error) {
 		requiredConfVars = append(requiredConfVars, []string{"archive.location"}...)
 	}
 
+	if viper.GetString("backup.type") == S3 {
+		requiredConfVars = append(requiredConfVars, []string{"backup.url", "backup.accesskey", "backup.secretkey", "backup.bucket"}...)
+	} else if viper.GetString("backup.type") == POSIX {
+		requiredConfVars = append(requiredConfVars, []string{"backup.location"}...)
+	}
+
 	for _, s := range requiredConfVars {
 		if !viper.IsSet(s) || viper.GetString(s) == "" {
 			return nil, fmt.Errorf("%s not set", s)
@@ -199,8 +246,13 @@ func NewConfig() (*Map, error) {
 	c := &Map{}
 	c.applyDefaults()
 	c.sessionConfig()
+	err := c.s3Config()
+	if err != nil {
+		return nil, err
+	}
 	c.configArchive()
-	err := c.configureOIDC()
+	c.configBackup()
+	err = c.configureOIDC()
 	if err != nil {
 		return nil, err
 	}
@@ -223,11 +275,16 @@ func (c *Map) applyDefaults() {
 	viper.SetDefault("app.host", "0.0.0.0")
 	viper.SetDefault("app.port", 8080)
 	viper.SetDefault("app.middleware", "default")
+	viper.SetDefault("app.signedurlexpiry", 3600)
+	viper.SetDefault("app.bundlemaxfiles", 1000)
+	viper.SetDefault("app.metricshost", "127.0.0.1")
 	viper.SetDefault("session.expiration", -1)
 	viper.SetDefault("session.secure", true)
 	viper.SetDefault("session.httponly", true)
 	viper.SetDefault("log.level", "info")
 	viper.SetDefault("session.name", "sda_session_key")
+	viper.SetDefault("s3.credentialexpiry", 3600)
+	viper.SetDefault("s3.partsize", 8*1024*1024)
 }
 
 // configS3Storage populates and returns a S3Conf from the
@@ -245,6 +302,8 @@ func configS3Storage(prefix string) storage.S3Conf {
 	s3.Port = 443
 	s3.Region = "us-east-1"
 	s3.NonExistRetryTime = 2 * time.Minute
+	s3.RequestRetryTime = 5 * time.Second
+	s3.ReadAheadChunkSize = 8 * 1024 * 1024
 
 	if viper.IsSet(prefix + ".port") {
 		s3.Port = viper.GetInt(prefix + ".port")
@@ -258,10 +317,24 @@ func configS3Storage(prefix string) storage.S3Conf {
 		s3.Chunksize = viper.GetInt(prefix+".chunksize") * 1024 * 1024
 	}
 
+	// Seconds that transient errors are retried while serving a request
+	if viper.IsSet(prefix + ".retrytime") {
+		s3.RequestRetryTime = time.Duration(viper.GetInt(prefix+".retrytime")) * time.Second
+	}
+
 	if viper.IsSet(prefix + ".cacert") {
 		s3.Cacert = viper.GetString(prefix + ".cacert")
 	}
 
+	// Number of chunks of readaheadchunksize MiB fetched concurrently
+	if viper.IsSet(prefix + ".readahead") {
+		s3.ReadAhead = viper.GetInt(prefix + ".readahead")
+	}
+
+	if viper.IsSet(prefix + ".readaheadchunksize") {
+		s3.ReadAheadChunkSize = viper.GetInt64(prefix+".readaheadchunksize") * 1024 * 1024
+	}
+
 	return s3
 }
 
@@ -296,6 +369,19 @@ func (c *Map) configArchive() {
 	}
 }
 
+// configBackup provides configuration for the backup storage, which is
+// only used if backup.type is set
+func (c *Map) configBackup() {
+	switch viper.GetString("backup.type") {
+	case S3:
+		c.Backup.Type = S3
+		c.Backup.S3 = configS3Storage("backup")
+	case POSIX:
+		c.Backup.Type = POSIX
+		c.Backup.Posix.Location = viper.GetString("backup.location")
+	}
+}
+
 // appConfig sets required settings
 func (c *Map) appConfig() error {
 	c.App.Host = viper.GetString("app.host")
@@ -303,6 +389,10 @@ func (c *Map) appConfig() error {
 	c.App.ServerCert = viper.GetString("app.servercert")
 	c.App.ServerKey = viper.GetString("app.serverkey")
 	c.App.Middleware = viper.GetString("app.middleware")
+	c.App.SignedURLExpiry = time.Duration(viper.GetInt("app.signedurlexpiry")) * time.Second
+	c.App.BundleMaxFiles = viper.GetInt("app.bundlemaxfiles")
+	c.App.MetricsHost = viper.GetString("app.metricshost")
+	c.App.MetricsPort = viper.GetInt("app.metricsport")
 
 	if c.App.Port != 443 && c.App.Port != 8080 {
 		c.App.Port = viper.GetInt("app.port")
@@ -316,6 +406,8 @@ func (c *Map) appConfig() error {
 		return err
 	}
 
+	c.App.SigningKey = []byte(viper.GetString("app.signingkey"))
+
 	if !slices.Contains(availableMiddlewares, c.App.Middleware) {
 		err := fmt.Errorf("app.middleware value=%v is not one of allowed values=%v", c.App.Middleware, availableMiddlewares)
 
@@ -334,6 +426,18 @@ func (c *Map) sessionConfig() {
 	c.Session.Name = viper.GetString("session.name")
 }
 
+// s3Config controls the S3 interface
+func (c *Map) s3Config() error {
+	c.S3.CredentialExpiry = time.Duration(viper.GetInt("s3.credentialexpiry")) * time.Second
+	c.S3.Domain = strings.ToLower(strings.Trim(viper.GetString("s3.domain"), "."))
+	c.S3.PartSize = viper.GetInt64("s3.partsize")
+	if c.S3.PartSize < 1 {
+		return fmt.Errorf("s3.partsize value=%d must be positive", c.S3.PartSize)
+	}
+
+	return nil
+}
+
 // configDatabase provides configuration for the database
 func (c *Map) configDatabase() error {
 	db := DatabaseConfig{}
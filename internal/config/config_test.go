@@ -15,6 +15,7 @@ import (
 
 var requiredConfVars = []string{
 	"db.host", "db.user", "db.password", "db.database", "c4gh.filepath", "c4gh.passphrase", "oidc.configuration.url",
+	"app.signingkey",
 }
 
 type TestSuite struct {
@@ -29,6 +30,7 @@ func (suite *TestSuite) SetupTest() {
 	viper.Set("c4gh.filepath", "test")
 	viper.Set("c4gh.passphrase", "test")
 	viper.Set("oidc.configuration.url", "test")
+	viper.Set("app.signingkey", "test")
 }
 
 func (suite *TestSuite) TearDownTest() {
@@ -87,6 +89,29 @@ func (suite *TestSuite) TestAppConfig() {
 	assert.Equal(suite.T(), 1234, c.App.Port)
 	assert.Equal(suite.T(), "test", c.App.ServerCert)
 	assert.Equal(suite.T(), "test", c.App.ServerKey)
+	assert.Equal(suite.T(), []byte("test"), c.App.SigningKey)
+
+	viper.Set("app.signingkey", "secret")
+	viper.Set("app.signedurlexpiry", 600)
+	c = &Map{}
+	err = c.appConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []byte("secret"), c.App.SigningKey)
+	assert.Equal(suite.T(), 600*time.Second, c.App.SignedURLExpiry)
+
+	viper.Set("app.bundlemaxfiles", 50)
+	c = &Map{}
+	err = c.appConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 50, c.App.BundleMaxFiles)
+
+	viper.Set("app.metricshost", "0.0.0.0")
+	viper.Set("app.metricsport", 9090)
+	c = &Map{}
+	err = c.appConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "0.0.0.0", c.App.MetricsHost)
+	assert.Equal(suite.T(), 9090, c.App.MetricsPort)
 }
 
 func (suite *TestSuite) TestArchiveConfig() {
@@ -99,6 +124,32 @@ func (suite *TestSuite) TestArchiveConfig() {
 
 }
 
+func (suite *TestSuite) TestBackupConfig() {
+	// No backup unless its type is set
+	c := &Map{}
+	c.configBackup()
+	assert.Equal(suite.T(), "", c.Backup.Type)
+
+	viper.Set("backup.type", S3)
+	viper.Set("backup.url", "https://backup.example.org")
+	viper.Set("backup.bucket", "backup")
+	c.configBackup()
+	assert.Equal(suite.T(), S3, c.Backup.Type)
+	assert.Equal(suite.T(), "https://backup.example.org", c.Backup.S3.URL)
+	assert.Equal(suite.T(), "backup", c.Backup.S3.Bucket)
+
+	// A backup in S3 needs its credentials
+	_, err := NewConfig()
+	assert.EqualError(suite.T(), err, "backup.accesskey not set")
+
+	viper.Set("backup.type", POSIX)
+	viper.Set("backup.location", "/backup")
+	c = &Map{}
+	c.configBackup()
+	assert.Equal(suite.T(), POSIX, c.Backup.Type)
+	assert.Equal(suite.T(), "/backup", c.Backup.Posix.Location)
+}
+
 func (suite *TestSuite) TestSessionConfig() {
 
 	viper.Set("session.expiration", 3600)
@@ -117,6 +168,42 @@ func (suite *TestSuite) TestSessionConfig() {
 
 }
 
+func (suite *TestSuite) TestS3Config() {
+	viper.Set("s3.credentialexpiry", 600)
+	viper.Set("s3.domain", "Download.Example.org.")
+	viper.Set("s3.partsize", 1024)
+
+	c := &Map{}
+	assert.NoError(suite.T(), c.s3Config())
+	assert.Equal(suite.T(), 600*time.Second, c.S3.CredentialExpiry)
+	assert.Equal(suite.T(), "download.example.org", c.S3.Domain)
+	assert.Equal(suite.T(), int64(1024), c.S3.PartSize)
+
+	viper.Set("s3.partsize", 0)
+	assert.Error(suite.T(), c.s3Config())
+}
+
+func (suite *TestSuite) TestConfigS3Storage() {
+	viper.Set("archive.url", "https://archive.example.org")
+	viper.Set("archive.chunksize", 16)
+
+	s3 := configS3Storage("archive")
+	assert.Equal(suite.T(), 16*1024*1024, s3.Chunksize)
+	assert.Equal(suite.T(), 0, s3.ReadAhead)
+	assert.Equal(suite.T(), int64(8*1024*1024), s3.ReadAheadChunkSize)
+	assert.Equal(suite.T(), 5*time.Second, s3.RequestRetryTime)
+	assert.Equal(suite.T(), 2*time.Minute, s3.NonExistRetryTime)
+
+	viper.Set("archive.readahead", 4)
+	viper.Set("archive.readaheadchunksize", 2)
+	viper.Set("archive.retrytime", 20)
+
+	s3 = configS3Storage("archive")
+	assert.Equal(suite.T(), 4, s3.ReadAhead)
+	assert.Equal(suite.T(), int64(2*1024*1024), s3.ReadAheadChunkSize)
+	assert.Equal(suite.T(), 20*time.Second, s3.RequestRetryTime)
+}
+
 func (suite *TestSuite) TestDatabaseConfig() {
 
 	// Test error on missing SSL vars
@@ -5,13 +5,14 @@ import (
 	"encoding/hex"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/neicnordic/sda-download/internal/config"
 	log "github.com/sirupsen/logrus"
 
-	// enables postgres driver
-	_ "github.com/lib/pq"
+	// enables postgres driver, and is used for array parameters
+	"github.com/lib/pq"
 )
 
 // DB is exported for other packages
@@ -39,11 +40,38 @@ type FileInfo struct {
 	LastModified              string `json:"lastModified"`
 }
 
+// Checksum is a checksum of a file as stored in sda.checksums
+type Checksum struct {
+	Checksum string `json:"checksum"`
+	Type     string `json:"type"`
+	Source   string `json:"source,omitempty"`
+}
+
+// FileMetadata is returned by the single file metadata endpoint
+type FileMetadata struct {
+	FileInfo
+	HeaderSize int64      `json:"headerSize"`
+	Checksums  []Checksum `json:"checksums"`
+	Datasets   []string   `json:"datasets"`
+}
+
 type DatasetInfo struct {
 	DatasetID string `json:"datasetId"`
 	CreatedAt string `json:"createdAt"`
 }
 
+// DatasetDetails is returned by the dataset metadata endpoint, with
+// aggregates of the files in the dataset
+type DatasetDetails struct {
+	DatasetInfo
+	ReleasedAt             string           `json:"releasedAt,omitempty"`
+	LastModified           string           `json:"lastModified,omitempty"`
+	FileCount              int64            `json:"fileCount"`
+	TotalFileSize          int64            `json:"totalFileSize"`
+	TotalDecryptedFileSize int64            `json:"totalDecryptedFileSize"`
+	FileStatus             map[string]int64 `json:"fileStatus"`
+}
+
 // dbRetryTimes is the number of times to retry the same function if it fails
 var dbRetryTimes = 3
 
@@ -160,13 +188,18 @@ func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
 	files := []*FileInfo{}
 	db := dbs.DB
 
+	// The archive file size is the size of the file body without the header,
+	// so the header size is added to give the size of the whole crypt4gh
+	// file. Archive headers have a single recipient, and re-encrypting them
+	// for the client key keeps the same packets, so encrypted downloads get a
+	// header of the stored (hex encoded) length.
 	const query = `
 		SELECT files.stable_id AS id,
 			datasets.stable_id AS dataset_id,
 			reverse(split_part(reverse(files.submission_file_path::text), '/'::text, 1)) AS display_file_name,
 			files.submission_file_path AS file_path,
 			files.archive_file_path AS file_name,
-			files.archive_file_size AS file_size,
+			files.archive_file_size + length(files.header) / 2 AS file_size,
 			files.decrypted_file_size,
 			sha.checksum AS decrypted_file_checksum,
 			sha.type AS decrypted_file_checksum_type,
@@ -204,16 +237,6 @@ func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
 			return nil, err
 		}
 
-		// NOTE FOR ENCRYPTED DOWNLOAD
-		// As of now, encrypted download is not supported. When implementing encrypted download, note that
-		// local_ega_ebi.file:file_size is the size of the file body in the archive without the header,
-		// so the user needs to know the size of the header when downloading in encrypted format.
-		// A way to get this could be:
-		// fd := GetFile()
-		// fi.FileSize = fi.FileSize + len(fd.Header)
-		// But if the header is re-encrypted or a completely new header is generated, the length
-		// needs to be conveyd to the user in some other way.
-
 		// Add structs to array
 		files = append(files, fi)
 	}
@@ -221,6 +244,270 @@ func (dbs *SQLdb) getFiles(datasetID string) ([]*FileInfo, error) {
 	return files, nil
 }
 
+// FileFilter selects a page of the files of a dataset. Empty fields don't
+// filter.
+type FileFilter struct {
+	// After is the file ID that the page starts after
+	After string
+	// Limit is the largest number of files returned, 0 meaning no limit
+	Limit int
+	// Status is the status of the files
+	Status string
+	// PathPrefix is the start of the file paths
+	PathPrefix string
+	// NameGlob is a pattern of the display file names, where * matches any
+	// characters and ? matches a single character
+	NameGlob string
+}
+
+// GetFilesPage retrieves the files of a dataset matching a filter, ordered
+// by file ID
+var GetFilesPage = func(datasetID string, filter FileFilter) ([]*FileInfo, error) {
+	var (
+		r     []*FileInfo = nil
+		err   error       = nil
+		count int         = 0
+	)
+
+	for count < dbRetryTimes {
+		r, err = DB.getFilesPage(datasetID, filter)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return r, err
+}
+
+// getFilesPage is the actual function performing work for GetFilesPage
+func (dbs *SQLdb) getFilesPage(datasetID string, filter FileFilter) ([]*FileInfo, error) {
+	files := []*FileInfo{}
+	err := dbs.streamFiles(datasetID, filter, func(fi *FileInfo) error {
+		files = append(files, fi)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// StreamFiles passes the files of a dataset matching a filter, ordered by
+// file ID, to a function one at a time as they are read from the database
+var StreamFiles = func(datasetID string, filter FileFilter, each func(*FileInfo) error) error {
+	var (
+		err   error = nil
+		count int   = 0
+		rows  int   = 0
+	)
+
+	counted := func(fi *FileInfo) error {
+		rows++
+
+		return each(fi)
+	}
+
+	for count < dbRetryTimes {
+		err = DB.streamFiles(datasetID, filter, counted)
+		// Files that were passed on can't be taken back, so only failed
+		// queries are retried
+		if err != nil && rows == 0 {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return err
+}
+
+// streamFiles is the actual function performing work for StreamFiles
+func (dbs *SQLdb) streamFiles(datasetID string, filter FileFilter, each func(*FileInfo) error) error {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.DB
+
+	// file_size is the size of the whole crypt4gh file, as in getFiles
+	const query = `
+		SELECT files.stable_id AS id,
+			datasets.stable_id AS dataset_id,
+			reverse(split_part(reverse(files.submission_file_path::text), '/'::text, 1)) AS display_file_name,
+			files.submission_file_path AS file_path,
+			files.archive_file_path AS file_name,
+			files.archive_file_size + length(files.header) / 2 AS file_size,
+			files.decrypted_file_size,
+			sha.checksum AS decrypted_file_checksum,
+			sha.type AS decrypted_file_checksum_type,
+			log.event AS status,
+			files.created_at,
+			files.last_modified
+		FROM sda.files
+		JOIN sda.file_dataset ON file_id = files.id
+		JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+		LEFT JOIN (SELECT file_id, (ARRAY_AGG(event ORDER BY started_at DESC))[1] AS event FROM sda.file_event_log GROUP BY file_id) log ON files.id = log.file_id
+		LEFT JOIN (SELECT file_id, checksum, type FROM sda.checksums WHERE source = 'UNENCRYPTED') sha ON files.id = sha.file_id
+		WHERE datasets.stable_id = $1
+			AND ($2 = '' OR files.stable_id > $2)
+			AND ($3 = '' OR log.event = $3)
+			AND ($4 = '' OR files.submission_file_path LIKE $4)
+			AND ($5 = '' OR reverse(split_part(reverse(files.submission_file_path::text), '/'::text, 1)) LIKE $5)
+		ORDER BY files.stable_id
+		LIMIT $6;
+		`
+
+	pathPattern := ""
+	if filter.PathPrefix != "" {
+		pathPattern = escapeLike(filter.PathPrefix) + "%"
+	}
+	namePattern := ""
+	if filter.NameGlob != "" {
+		namePattern = globToLike(filter.NameGlob)
+	}
+	// LIMIT NULL returns all rows
+	var limit any
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+
+	rows, err := db.Query(query, datasetID, filter.After, filter.Status, pathPattern, namePattern, limit)
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		fi := &FileInfo{}
+		err := rows.Scan(&fi.FileID, &fi.DatasetID, &fi.DisplayFileName, &fi.FilePath, &fi.FileName,
+			&fi.FileSize, &fi.DecryptedFileSize, &fi.DecryptedFileChecksum,
+			&fi.DecryptedFileChecksumType, &fi.Status, &fi.CreatedAt, &fi.LastModified)
+		if err != nil {
+			log.Error(err)
+
+			return err
+		}
+		if err := each(fi); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ObjectInfo is a file of a dataset as listed in the S3 API
+type ObjectInfo struct {
+	// Key is the submission file path without the user part and the .c4gh
+	// extension
+	Key               string
+	DecryptedFileSize int64
+	LastModified      string
+}
+
+// ObjectFilter selects a page of the objects of a dataset
+type ObjectFilter struct {
+	// After is the key that the page starts after
+	After string
+	// Prefix is the start of the keys
+	Prefix string
+	// Limit is the largest number of objects returned
+	Limit int
+}
+
+// GetObjectsPage retrieves the objects of a dataset matching a filter,
+// ordered by key byte by byte
+var GetObjectsPage = func(datasetID string, filter ObjectFilter) ([]*ObjectInfo, error) {
+	var (
+		r     []*ObjectInfo = nil
+		err   error         = nil
+		count int           = 0
+	)
+
+	for count < dbRetryTimes {
+		r, err = DB.getObjectsPage(datasetID, filter)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return r, err
+}
+
+// getObjectsPage is the actual function performing work for GetObjectsPage
+func (dbs *SQLdb) getObjectsPage(datasetID string, filter ObjectFilter) ([]*ObjectInfo, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	objects := []*ObjectInfo{}
+	db := dbs.DB
+
+	// Keys are compared with the C collation, to be ordered like the S3 API
+	// orders them
+	const query = `
+		SELECT key, decrypted_file_size, last_modified FROM (
+			SELECT regexp_replace(regexp_replace(files.submission_file_path, '\.c4gh$', ''), '^[^/]*/', '') AS key,
+				files.decrypted_file_size,
+				files.last_modified
+			FROM sda.files
+			JOIN sda.file_dataset ON file_id = files.id
+			JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+			WHERE datasets.stable_id = $1
+		) objects
+		WHERE key COLLATE "C" > $2
+			AND ($3 = '' OR key LIKE $3)
+		ORDER BY key COLLATE "C"
+		LIMIT $4;
+		`
+
+	keyPattern := ""
+	if filter.Prefix != "" {
+		keyPattern = escapeLike(filter.Prefix) + "%"
+	}
+
+	rows, err := db.Query(query, datasetID, filter.After, keyPattern, filter.Limit)
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		oi := &ObjectInfo{}
+		err := rows.Scan(&oi.Key, &oi.DecryptedFileSize, &oi.LastModified)
+		if err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		objects = append(objects, oi)
+	}
+
+	return objects, rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// globToLike converts a glob pattern with * and ? wildcards to a LIKE
+// pattern
+func globToLike(glob string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(glob))
+}
+
 // CheckDataset checks if dataset name exists
 var CheckDataset = func(dataset string) (bool, error) {
 	var (
@@ -295,6 +582,117 @@ func (dbs *SQLdb) getDatasetInfo(datasetID string) (*DatasetInfo, error) {
 	return dataset, nil
 }
 
+// GetDatasetDetails returns the details of the given datasets that exist, in
+// the order of the datasets
+var GetDatasetDetails = func(datasetIDs []string) ([]*DatasetDetails, error) {
+	var (
+		d     []*DatasetDetails = nil
+		err   error             = nil
+		count int               = 0
+	)
+
+	for count < dbRetryTimes {
+		d, err = DB.getDatasetDetails(datasetIDs)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return d, err
+}
+
+// getDatasetDetails is the actual function performing work for
+// GetDatasetDetails
+func (dbs *SQLdb) getDatasetDetails(datasetIDs []string) ([]*DatasetDetails, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.DB
+	const datasetQuery = `
+		SELECT datasets.stable_id,
+			datasets.created_at,
+			(SELECT MAX(event_date) FROM sda.dataset_event_log WHERE dataset_id = datasets.stable_id AND event = 'released') AS released_at,
+			MAX(files.last_modified) AS last_modified,
+			COUNT(files.id) AS file_count,
+			COALESCE(SUM(files.archive_file_size + length(files.header) / 2), 0) AS total_file_size,
+			COALESCE(SUM(files.decrypted_file_size), 0) AS total_decrypted_file_size
+		FROM sda.datasets
+		LEFT JOIN sda.file_dataset ON file_dataset.dataset_id = datasets.id
+		LEFT JOIN sda.files ON file_dataset.file_id = files.id
+		WHERE datasets.stable_id = ANY($1)
+		GROUP BY datasets.id;`
+
+	// nolint:rowserrcheck
+	rows, err := db.Query(datasetQuery, pq.Array(datasetIDs))
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := map[string]*DatasetDetails{}
+	for rows.Next() {
+		var releasedAt, lastModified sql.NullString
+		d := &DatasetDetails{FileStatus: map[string]int64{}}
+		err := rows.Scan(&d.DatasetID, &d.CreatedAt, &releasedAt, &lastModified,
+			&d.FileCount, &d.TotalFileSize, &d.TotalDecryptedFileSize)
+		if err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		d.ReleasedAt = releasedAt.String
+		d.LastModified = lastModified.String
+		found[d.DatasetID] = d
+	}
+
+	// Files without events have the status "unknown"
+	const statusQuery = `
+		SELECT datasets.stable_id, COALESCE(log.event, 'unknown') AS status, COUNT(*)
+		FROM sda.files
+		JOIN sda.file_dataset ON file_id = files.id
+		JOIN sda.datasets ON file_dataset.dataset_id = datasets.id
+		LEFT JOIN (SELECT file_id, (ARRAY_AGG(event ORDER BY started_at DESC))[1] AS event FROM sda.file_event_log GROUP BY file_id) log ON files.id = log.file_id
+		WHERE datasets.stable_id = ANY($1)
+		GROUP BY datasets.stable_id, log.event;`
+
+	// nolint:rowserrcheck
+	statusRows, err := db.Query(statusQuery, pq.Array(datasetIDs))
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	defer statusRows.Close()
+
+	for statusRows.Next() {
+		var datasetID, status string
+		var count int64
+		if err := statusRows.Scan(&datasetID, &status, &count); err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		if d, ok := found[datasetID]; ok {
+			d.FileStatus[status] += count
+		}
+	}
+
+	datasets := []*DatasetDetails{}
+	for _, datasetID := range datasetIDs {
+		if d, ok := found[datasetID]; ok {
+			datasets = append(datasets, d)
+			delete(found, datasetID)
+		}
+	}
+
+	return datasets, nil
+}
+
 // GetDatasetFileInfo returns information on a file given a dataset ID and an
 // upload file path
 var GetDatasetFileInfo = func(datasetID, filePath string) (*FileInfo, error) {
@@ -418,12 +816,15 @@ func (dbs *SQLdb) checkFilePermission(fileID string) (string, error) {
 
 // FileDownload details are used for downloading a file
 type FileDownload struct {
-	ArchivePath       string
-	ArchiveSize       int
-	DecryptedSize     int
-	DecryptedChecksum string
-	LastModified      string
-	Header            []byte
+	ArchivePath           string
+	ArchiveSize           int
+	DecryptedSize         int
+	DecryptedChecksum     string
+	DecryptedChecksumType string
+	LastModified          string
+	Header                []byte
+	// FilePath is the path the file was uploaded to
+	FilePath string
 }
 
 // GetFile retrieves the file header
@@ -459,8 +860,10 @@ func (dbs *SQLdb) getFile(fileID string) (*FileDownload, error) {
 			   f.archive_file_size,
 			   f.decrypted_file_size,
 			   dc.checksum AS decrypted_checksum,
+			   dc.type AS decrypted_checksum_type,
 			   f.last_modified,
-			   f.header
+			   f.header,
+			   f.submission_file_path
 		FROM sda.files f
 		LEFT JOIN (SELECT file_id, checksum, type
 			FROM sda.checksums
@@ -471,7 +874,8 @@ func (dbs *SQLdb) getFile(fileID string) (*FileDownload, error) {
 	fd := &FileDownload{}
 	var hexString string
 	err := db.QueryRow(query, fileID).Scan(&fd.ArchivePath, &fd.ArchiveSize,
-		&fd.DecryptedSize, &fd.DecryptedChecksum, &fd.LastModified, &hexString)
+		&fd.DecryptedSize, &fd.DecryptedChecksum, &fd.DecryptedChecksumType,
+		&fd.LastModified, &hexString, &fd.FilePath)
 	if err != nil {
 		log.Errorf("could not retrieve details for file %s, reason %s", sanitizeString(fileID), err)
 
@@ -488,6 +892,174 @@ func (dbs *SQLdb) getFile(fileID string) (*FileDownload, error) {
 	return fd, nil
 }
 
+// GetFileChecksums returns all checksums of the decrypted content of a file
+var GetFileChecksums = func(fileID string) ([]Checksum, error) {
+	var (
+		r     []Checksum
+		err   error
+		count int
+	)
+	for count < dbRetryTimes {
+		r, err = DB.getFileChecksums(fileID)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return r, err
+}
+
+// getFileChecksums is the actual function performing work for GetFileChecksums
+func (dbs *SQLdb) getFileChecksums(fileID string) ([]Checksum, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.DB
+	const query = `
+		SELECT checksums.checksum, checksums.type
+		FROM sda.checksums
+		JOIN sda.files ON checksums.file_id = files.id
+		WHERE files.stable_id = $1 AND checksums.source = 'UNENCRYPTED';`
+
+	// nolint:rowserrcheck
+	rows, err := db.Query(query, fileID)
+	if err != nil {
+		log.Errorf("could not retrieve checksums for file %s, reason %s", sanitizeString(fileID), err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []Checksum{}
+	for rows.Next() {
+		var c Checksum
+		if err := rows.Scan(&c.Checksum, &c.Type); err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		checksums = append(checksums, c)
+	}
+
+	return checksums, nil
+}
+
+// GetFileMetadata returns the metadata of a file, with the checksums of all
+// sources and all datasets that the file belongs to
+var GetFileMetadata = func(fileID string) (*FileMetadata, error) {
+	var (
+		r     *FileMetadata = nil
+		err   error         = nil
+		count int           = 0
+	)
+
+	for count < dbRetryTimes {
+		r, err = DB.getFileMetadata(fileID)
+		if err != nil {
+			count++
+
+			continue
+		}
+
+		break
+	}
+
+	return r, err
+}
+
+// getFileMetadata is the actual function performing work for GetFileMetadata
+func (dbs *SQLdb) getFileMetadata(fileID string) (*FileMetadata, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	file := &FileMetadata{Checksums: []Checksum{}, Datasets: []string{}}
+	db := dbs.DB
+
+	const fileQuery = `
+		SELECT files.stable_id AS id,
+			reverse(split_part(reverse(files.submission_file_path::text), '/'::text, 1)) AS display_file_name,
+			files.submission_file_path AS file_path,
+			files.archive_file_path AS file_name,
+			files.archive_file_size + length(files.header) / 2 AS file_size,
+			files.decrypted_file_size,
+			length(files.header) / 2 AS header_size,
+			sha.checksum AS decrypted_file_checksum,
+			sha.type AS decrypted_file_checksum_type,
+			log.event AS status,
+			files.created_at,
+			files.last_modified
+		FROM sda.files
+		LEFT JOIN (SELECT file_id, (ARRAY_AGG(event ORDER BY started_at DESC))[1] AS event FROM sda.file_event_log GROUP BY file_id) log ON files.id = log.file_id
+		LEFT JOIN (SELECT file_id, checksum, type FROM sda.checksums WHERE source = 'UNENCRYPTED') sha ON files.id = sha.file_id
+		WHERE files.stable_id = $1;`
+
+	err := db.QueryRow(fileQuery, fileID).Scan(&file.FileID, &file.DisplayFileName,
+		&file.FilePath, &file.FileName, &file.FileSize, &file.DecryptedFileSize,
+		&file.HeaderSize, &file.DecryptedFileChecksum, &file.DecryptedFileChecksumType,
+		&file.Status, &file.CreatedAt, &file.LastModified)
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	const checksumQuery = `
+		SELECT checksums.checksum, checksums.type, checksums.source
+		FROM sda.checksums
+		JOIN sda.files ON checksums.file_id = files.id
+		WHERE files.stable_id = $1
+		ORDER BY checksums.source, checksums.type;`
+
+	// nolint:rowserrcheck
+	rows, err := db.Query(checksumQuery, fileID)
+	if err != nil {
+		log.Errorf("could not retrieve checksums for file %s, reason %s", sanitizeString(fileID), err)
+
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Checksum
+		if err := rows.Scan(&c.Checksum, &c.Type, &c.Source); err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		file.Checksums = append(file.Checksums, c)
+	}
+
+	const datasetQuery = `
+		SELECT datasets.stable_id FROM sda.file_dataset
+		JOIN sda.datasets ON dataset_id = datasets.id
+		JOIN sda.files ON file_id = files.id
+		WHERE files.stable_id = $1
+		ORDER BY datasets.stable_id;`
+
+	// nolint:rowserrcheck
+	datasetRows, err := db.Query(datasetQuery, fileID)
+	if err != nil {
+		log.Errorf("could not retrieve datasets for file %s, reason %s", sanitizeString(fileID), err)
+
+		return nil, err
+	}
+	defer datasetRows.Close()
+
+	for datasetRows.Next() {
+		var dataset string
+		if err := datasetRows.Scan(&dataset); err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+		file.Datasets = append(file.Datasets, dataset)
+	}
+
+	return file, nil
+}
+
 // Close terminates the connection to the database
 func (dbs *SQLdb) Close() {
 	db := dbs.DB
@@ -360,20 +360,24 @@ func TestGetFile(t *testing.T) {
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
 		expected := &FileDownload{
-			ArchivePath:       "file.txt",
-			ArchiveSize:       32,
-			DecryptedSize:     1024,
-			DecryptedChecksum: "sha256checksum",
-			LastModified:      "now",
-			Header:            []byte{171, 193, 35},
+			ArchivePath:           "file.txt",
+			ArchiveSize:           32,
+			DecryptedSize:         1024,
+			DecryptedChecksum:     "sha256checksum",
+			DecryptedChecksumType: "SHA256",
+			LastModified:          "now",
+			Header:                []byte{171, 193, 35},
+			FilePath:              "user/file.txt.c4gh",
 		}
 		query := `
 		SELECT f.archive_file_path,
 			   f.archive_file_size,
 			   f.decrypted_file_size,
 			   dc.checksum AS decrypted_checksum,
+			   dc.type AS decrypted_checksum_type,
 			   f.last_modified,
-			   f.header
+			   f.header,
+			   f.submission_file_path
 		FROM sda.files f
 		LEFT JOIN \(SELECT file_id, checksum, type
 			FROM sda.checksums
@@ -384,9 +388,11 @@ func TestGetFile(t *testing.T) {
 		mock.ExpectQuery(query).
 			WithArgs("file1").
 			WillReturnRows(sqlmock.NewRows([]string{"file_path", "archive_file_size",
-				"decrypted_file_size", "decrypted_checksum", "last_modified", "header"}).AddRow(
+				"decrypted_file_size", "decrypted_checksum", "decrypted_checksum_type",
+				"last_modified", "header", "submission_file_path"}).AddRow(
 				expected.ArchivePath, expected.ArchiveSize, expected.DecryptedSize,
-				expected.DecryptedChecksum, expected.LastModified, "abc123"))
+				expected.DecryptedChecksum, expected.DecryptedChecksumType,
+				expected.LastModified, "abc123", expected.FilePath))
 
 		x, err := testDb.getFile("file1")
 		assert.Equal(t, expected, x, "did not get expected file details")
@@ -429,7 +435,7 @@ func TestGetFiles(t *testing.T) {
 				reverse\(split_part\(reverse\(files.submission_file_path::text\), '/'::text, 1\)\) AS display_file_name,
 				files.submission_file_path AS file_path,
 				files.archive_file_path AS file_name,
-				files.archive_file_size AS file_size,
+				files.archive_file_size \+ length\(files.header\) / 2 AS file_size,
 				files.decrypted_file_size,
 				sha.checksum AS decrypted_file_checksum,
 				sha.type AS decrypted_file_checksum_type,
@@ -470,3 +476,268 @@ func TestGetFiles(t *testing.T) {
 
 	log.SetOutput(os.Stdout)
 }
+
+func TestGetFilesPage(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		fileInfo := &FileInfo{
+			FileID:                    "file2",
+			DatasetID:                 "dataset1",
+			DisplayFileName:           "file_1.bam",
+			FilePath:                  "dir/sub_dir/file_1.bam",
+			FileName:                  "urn:file2",
+			FileSize:                  60,
+			DecryptedFileSize:         32,
+			DecryptedFileChecksum:     "hash",
+			DecryptedFileChecksumType: "sha256",
+			Status:                    "ready",
+			CreatedAt:                 "a while ago",
+			LastModified:              "now",
+		}
+		query := `
+			WHERE datasets.stable_id = \$1
+				AND \(\$2 = '' OR files.stable_id > \$2\)
+				AND \(\$3 = '' OR log.event = \$3\)
+				AND \(\$4 = '' OR files.submission_file_path LIKE \$4\)
+				AND \(\$5 = '' OR reverse\(split_part\(reverse\(files.submission_file_path::text\), '/'::text, 1\)\) LIKE \$5\)
+			ORDER BY files.stable_id
+			LIMIT \$6;
+		`
+		mock.ExpectQuery(query).
+			WithArgs("dataset1", "file1", "ready", `dir/sub\_dir/%`, `%\_1.bam`, 10).
+			WillReturnRows(sqlmock.NewRows([]string{"file_id", "dataset_id",
+				"display_file_name", "file_path", "file_name", "file_size",
+				"decrypted_file_size", "decrypted_file_checksum",
+				"decrypted_file_checksum_type", "file_status", "created_at",
+				"last_modified"}).AddRow(fileInfo.FileID, fileInfo.DatasetID,
+				fileInfo.DisplayFileName, fileInfo.FilePath, fileInfo.FileName,
+				fileInfo.FileSize, fileInfo.DecryptedFileSize,
+				fileInfo.DecryptedFileChecksum, fileInfo.DecryptedFileChecksumType,
+				fileInfo.Status, fileInfo.CreatedAt, fileInfo.LastModified))
+
+		x, err := testDb.getFilesPage("dataset1", FileFilter{
+			After:      "file1",
+			Limit:      10,
+			Status:     "ready",
+			PathPrefix: "dir/sub_dir/",
+			NameGlob:   "*_1.bam",
+		})
+		assert.Equal(t, []*FileInfo{fileInfo}, x, "did not get expected file details")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getFilesPage failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("ORDER BY files.stable_id").
+			WithArgs("dataset1", "", "", "", "", nil).
+			WillReturnRows(sqlmock.NewRows([]string{"file_id"}))
+
+		x, err := testDb.getFilesPage("dataset1", FileFilter{})
+		assert.Equal(t, []*FileInfo{}, x, "did not get expected file details")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getFilesPage without filters failed unexpectedly")
+}
+
+func TestStreamFiles(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		rows := sqlmock.NewRows([]string{"file_id", "dataset_id",
+			"display_file_name", "file_path", "file_name", "file_size",
+			"decrypted_file_size", "decrypted_file_checksum",
+			"decrypted_file_checksum_type", "file_status", "created_at",
+			"last_modified"})
+		for _, id := range []string{"file1", "file2", "file3"} {
+			rows.AddRow(id, "dataset1", "file.txt", "dir/file.txt", "urn:"+id, 60, 32, "hash", "sha256", "ready", "a while ago", "now")
+		}
+		mock.ExpectQuery("ORDER BY files.stable_id").
+			WithArgs("dataset1", "", "", "", "", nil).
+			WillReturnRows(rows)
+
+		// Streaming stops when a file can't be passed on
+		seen := []string{}
+		err := testDb.streamFiles("dataset1", FileFilter{}, func(fi *FileInfo) error {
+			seen = append(seen, fi.FileID)
+			if len(seen) == 2 {
+				return errors.New("client gone")
+			}
+
+			return nil
+		})
+		assert.EqualError(t, err, "client gone")
+		assert.Equal(t, []string{"file1", "file2"}, seen)
+
+		return nil
+	})
+
+	assert.Nil(t, r, "streamFiles failed unexpectedly")
+}
+
+func TestGetObjectsPage(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		query := `
+			WHERE key COLLATE "C" > \$2
+				AND \(\$3 = '' OR key LIKE \$3\)
+			ORDER BY key COLLATE "C"
+			LIMIT \$4;
+		`
+		mock.ExpectQuery(query).
+			WithArgs("dataset1", "dir/a", `dir/sub\_dir/%`, 3).
+			WillReturnRows(sqlmock.NewRows([]string{"key", "decrypted_file_size", "last_modified"}).
+				AddRow("dir/sub_dir/b", 32, "now").
+				AddRow("dir/sub_dir/c", 64, "later"))
+
+		x, err := testDb.getObjectsPage("dataset1", ObjectFilter{After: "dir/a", Prefix: "dir/sub_dir/", Limit: 3})
+		assert.Equal(t, []*ObjectInfo{
+			{Key: "dir/sub_dir/b", DecryptedFileSize: 32, LastModified: "now"},
+			{Key: "dir/sub_dir/c", DecryptedFileSize: 64, LastModified: "later"},
+		}, x, "did not get expected objects")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getObjectsPage failed unexpectedly")
+}
+
+func TestGetFileMetadata(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		expected := &FileMetadata{
+			FileInfo: FileInfo{
+				FileID:                    "file1",
+				DisplayFileName:           "file.txt",
+				FilePath:                  "dir/file.txt",
+				FileName:                  "urn:file1",
+				FileSize:                  184,
+				DecryptedFileSize:         32,
+				DecryptedFileChecksum:     "hash",
+				DecryptedFileChecksumType: "SHA256",
+				Status:                    "ready",
+				CreatedAt:                 "a while ago",
+				LastModified:              "now",
+			},
+			HeaderSize: 124,
+			Checksums: []Checksum{
+				{Checksum: "archived", Type: "SHA256", Source: "ARCHIVED"},
+				{Checksum: "hash", Type: "SHA256", Source: "UNENCRYPTED"},
+			},
+			Datasets: []string{"dataset1", "dataset2"},
+		}
+
+		mock.ExpectQuery(`length\(files.header\) / 2 AS header_size`).
+			WithArgs("file1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "display_file_name",
+				"file_path", "file_name", "file_size", "decrypted_file_size",
+				"header_size", "decrypted_file_checksum", "decrypted_file_checksum_type",
+				"status", "created_at", "last_modified"}).
+				AddRow("file1", "file.txt", "dir/file.txt", "urn:file1", 184, 32,
+					124, "hash", "SHA256", "ready", "a while ago", "now"))
+		mock.ExpectQuery(`SELECT checksums.checksum, checksums.type, checksums.source`).
+			WithArgs("file1").
+			WillReturnRows(sqlmock.NewRows([]string{"checksum", "type", "source"}).
+				AddRow("archived", "SHA256", "ARCHIVED").
+				AddRow("hash", "SHA256", "UNENCRYPTED"))
+		mock.ExpectQuery(`SELECT datasets.stable_id FROM sda.file_dataset`).
+			WithArgs("file1").
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).
+				AddRow("dataset1").
+				AddRow("dataset2"))
+
+		x, err := testDb.getFileMetadata("file1")
+		assert.Equal(t, expected, x, "did not get expected file metadata")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getFileMetadata failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(`length\(files.header\) / 2 AS header_size`).
+			WithArgs("file2").
+			WillReturnError(sql.ErrNoRows)
+
+		x, err := testDb.getFileMetadata("file2")
+		assert.Nil(t, x)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		return nil
+	})
+
+	assert.Nil(t, r, "getFileMetadata of a missing file failed unexpectedly")
+}
+
+func TestGetDatasetDetails(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		expected := []*DatasetDetails{
+			{
+				DatasetInfo: DatasetInfo{DatasetID: "dataset2", CreatedAt: "2023-01-01T10:00:00Z"},
+				FileStatus:  map[string]int64{},
+			},
+			{
+				DatasetInfo:            DatasetInfo{DatasetID: "dataset1", CreatedAt: "2023-01-01T10:00:00Z"},
+				ReleasedAt:             "2023-02-01T10:00:00Z",
+				LastModified:           "2023-01-15T10:00:00Z",
+				FileCount:              3,
+				TotalFileSize:          552,
+				TotalDecryptedFileSize: 96,
+				FileStatus:             map[string]int64{"ready": 2, "unknown": 1},
+			},
+		}
+
+		mock.ExpectQuery(`COUNT\(files.id\) AS file_count`).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "created_at",
+				"released_at", "last_modified", "file_count", "total_file_size",
+				"total_decrypted_file_size"}).
+				AddRow("dataset1", "2023-01-01T10:00:00Z", "2023-02-01T10:00:00Z", "2023-01-15T10:00:00Z", 3, 552, 96).
+				AddRow("dataset2", "2023-01-01T10:00:00Z", nil, nil, 0, 0, 0))
+		mock.ExpectQuery(`COALESCE\(log.event, 'unknown'\) AS status`).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "status", "count"}).
+				AddRow("dataset1", "ready", 2).
+				AddRow("dataset1", "unknown", 1))
+
+		x, err := testDb.getDatasetDetails([]string{"dataset2", "dataset3", "dataset1"})
+		assert.Equal(t, expected, x, "did not get expected dataset details")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getDatasetDetails failed unexpectedly")
+}
+
+func TestGlobToLike(t *testing.T) {
+	assert.Equal(t, "%.bam", globToLike("*.bam"))
+	assert.Equal(t, "file\\_\\%_.txt", globToLike("file_%?.txt"))
+	assert.Equal(t, `a\\b%`, globToLike(`a\b*`))
+}
+
+func TestGetFileChecksums(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		expected := []Checksum{
+			{Checksum: "sha256checksum", Type: "SHA256"},
+			{Checksum: "md5checksum", Type: "MD5"},
+		}
+		query := `
+		SELECT checksums.checksum, checksums.type
+		FROM sda.checksums
+		JOIN sda.files ON checksums.file_id = files.id
+		WHERE files.stable_id = \$1 AND checksums.source = 'UNENCRYPTED';`
+
+		mock.ExpectQuery(query).
+			WithArgs("file1").
+			WillReturnRows(sqlmock.NewRows([]string{"checksum", "type"}).
+				AddRow(expected[0].Checksum, expected[0].Type).
+				AddRow(expected[1].Checksum, expected[1].Type))
+
+		x, err := testDb.getFileChecksums("file1")
+		assert.Equal(t, expected, x, "did not get expected checksums")
+
+		return err
+	})
+
+	assert.Nil(t, r, "getFileChecksums failed unexpectedly")
+}
@@ -0,0 +1,346 @@
+package htsget
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// chunk is a range of virtual file offsets of a BGZF compressed file, where
+// the upper 48 bits are the offset of a block and the lower 16 bits the
+// offset inside the uncompressed block
+type chunk struct {
+	beg, end uint64
+}
+
+// binningRef holds the bins, and for BAI and TBI the linear index, of a
+// reference
+type binningRef struct {
+	bins   map[uint32][]chunk
+	linear []uint64
+}
+
+// BinningIndex is a BAI, TBI or CSI index of a BGZF compressed file
+type BinningIndex struct {
+	minShift int
+	depth    int
+	refs     []binningRef
+	names    []string
+	offsets  offsets
+	fileSize int64
+}
+
+// ReadBAI parses a BAI index of a BAM file of the given size
+func ReadBAI(r io.Reader, fileSize int64) (*BinningIndex, error) {
+	br := &binaryReader{r: r}
+	if magic := br.bytes(4); br.err == nil && !bytes.Equal(magic, []byte("BAI\x01")) {
+		return nil, errors.New("not a BAI index")
+	}
+
+	idx := &BinningIndex{minShift: 14, depth: 5, fileSize: fileSize}
+	if err := idx.readRefs(br, br.count(), false); err != nil {
+		return nil, fmt.Errorf("failed to read BAI index, %w", err)
+	}
+
+	return idx, nil
+}
+
+// ReadTBI parses a TBI index of a BGZF compressed file of the given size
+func ReadTBI(r io.Reader, fileSize int64) (*BinningIndex, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TBI index, %w", err)
+	}
+	defer gz.Close()
+
+	br := &binaryReader{r: gz}
+	if magic := br.bytes(4); br.err == nil && !bytes.Equal(magic, []byte("TBI\x01")) {
+		return nil, errors.New("not a TBI index")
+	}
+
+	idx := &BinningIndex{minShift: 14, depth: 5, fileSize: fileSize}
+	nRef := br.count()
+	idx.names = br.tabixNames()
+	if err := idx.readRefs(br, nRef, false); err != nil {
+		return nil, fmt.Errorf("failed to read TBI index, %w", err)
+	}
+
+	return idx, nil
+}
+
+// ReadCSI parses a CSI index of a BGZF compressed file of the given size
+func ReadCSI(r io.Reader, fileSize int64) (*BinningIndex, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSI index, %w", err)
+	}
+	defer gz.Close()
+
+	br := &binaryReader{r: gz}
+	if magic := br.bytes(4); br.err == nil && !bytes.Equal(magic, []byte("CSI\x01")) {
+		return nil, errors.New("not a CSI index")
+	}
+
+	idx := &BinningIndex{minShift: int(br.int32()), depth: int(br.int32()), fileSize: fileSize}
+	if br.err == nil && (idx.minShift < 0 || idx.depth < 0 || idx.minShift+3*idx.depth > 62) {
+		return nil, errors.New("invalid CSI index parameters")
+	}
+
+	// Indexes of tabix compatible files hold the reference names in the
+	// auxiliary data
+	aux := br.bytes(br.count())
+	if len(aux) >= 28 {
+		idx.names = (&binaryReader{r: bytes.NewReader(aux)}).tabixNames()
+	}
+
+	if err := idx.readRefs(br, br.count(), true); err != nil {
+		return nil, fmt.Errorf("failed to read CSI index, %w", err)
+	}
+
+	return idx, nil
+}
+
+// readRefs reads the bins and linear indexes of the references
+func (idx *BinningIndex) readRefs(br *binaryReader, nRef int, csi bool) error {
+	var known []int64
+	for i := 0; i < nRef && br.err == nil; i++ {
+		ref := binningRef{bins: map[uint32][]chunk{}}
+		nBin := br.count()
+		for j := 0; j < nBin && br.err == nil; j++ {
+			bin := br.uint32()
+			if csi {
+				known = append(known, int64(br.uint64()>>16))
+			}
+			nChunk := br.count()
+			for k := 0; k < nChunk && br.err == nil; k++ {
+				ref.bins[bin] = append(ref.bins[bin], chunk{beg: br.uint64(), end: br.uint64()})
+			}
+		}
+		if !csi {
+			nIntv := br.count()
+			for j := 0; j < nIntv && br.err == nil; j++ {
+				offset := br.uint64()
+				ref.linear = append(ref.linear, offset)
+				known = append(known, int64(offset>>16))
+			}
+		}
+		idx.refs = append(idx.refs, ref)
+	}
+	if br.err != nil {
+		return br.err
+	}
+
+	// The pseudo bin holds statistics of the reference, where only the first
+	// chunk has real offsets
+	for _, ref := range idx.refs {
+		if pseudo, ok := ref.bins[idx.pseudoBin()]; ok {
+			ref.bins[idx.pseudoBin()] = pseudo[:1]
+		}
+		for _, chunks := range ref.bins {
+			for _, c := range chunks {
+				known = append(known, int64(c.beg>>16), int64(c.end>>16))
+			}
+		}
+	}
+	idx.offsets = newOffsets(known)
+
+	return nil
+}
+
+// pseudoBin returns the number of the bin holding reference statistics
+func (idx *BinningIndex) pseudoBin() uint32 {
+	return uint32(((1<<(3*idx.depth+3))-1)/7 + 1)
+}
+
+// ReferenceNames returns the reference names of TBI indexes and CSI indexes
+// of tabix compatible files, or nil if the index has no names
+func (idx *BinningIndex) ReferenceNames() []string {
+	return idx.names
+}
+
+// Ranges implements Index for the BinningIndex
+func (idx *BinningIndex) Ranges(refID int, beg, end int64) []ByteRange {
+	if refID < 0 || refID >= len(idx.refs) {
+		return nil
+	}
+	ref := idx.refs[refID]
+
+	maxPos := int64(1) << (idx.minShift + 3*idx.depth)
+	if end <= 0 || end > maxPos {
+		end = maxPos
+	}
+	if beg < 0 {
+		beg = 0
+	}
+	if beg >= end {
+		return nil
+	}
+
+	// Chunks ending before the first record overlapping the start of the
+	// region can be skipped
+	var minOffset uint64
+	if i := int(beg >> idx.minShift); i < len(ref.linear) {
+		minOffset = ref.linear[i]
+	}
+
+	var ranges []ByteRange
+	for bin, chunks := range ref.bins {
+		binBeg, binEnd, ok := idx.binRegion(bin)
+		if !ok || binBeg >= end || binEnd <= beg {
+			continue
+		}
+		for _, c := range chunks {
+			if r, ok := idx.byteRange(c); ok && c.end > minOffset {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+
+	return mergeRanges(ranges)
+}
+
+// UnmappedRanges implements Index for the BinningIndex
+func (idx *BinningIndex) UnmappedRanges() []ByteRange {
+	start := int64(-1)
+	idx.eachChunk(func(c chunk) {
+		if end := int64(c.end >> 16); end > start {
+			start = end
+		}
+	})
+	if start < 0 || start >= idx.fileSize {
+		return nil
+	}
+
+	return []ByteRange{{Start: start, End: idx.fileSize}}
+}
+
+// HeaderEnd implements Index for the BinningIndex
+func (idx *BinningIndex) HeaderEnd() int64 {
+	end := idx.fileSize
+	idx.eachChunk(func(c chunk) {
+		if beg := int64(c.beg >> 16); beg < end {
+			end = beg
+		}
+	})
+
+	return end
+}
+
+// eachChunk calls f for every chunk of the index, except the pseudo bins
+func (idx *BinningIndex) eachChunk(f func(c chunk)) {
+	for _, ref := range idx.refs {
+		for bin, chunks := range ref.bins {
+			if bin == idx.pseudoBin() {
+				continue
+			}
+			for _, c := range chunks {
+				f(c)
+			}
+		}
+	}
+}
+
+// byteRange returns the range of compressed blocks holding a chunk. A chunk
+// ending inside a block needs the whole block, which ends where the next
+// known block starts. Chunks of no data have no range.
+func (idx *BinningIndex) byteRange(c chunk) (ByteRange, bool) {
+	r := ByteRange{Start: int64(c.beg >> 16), End: int64(c.end >> 16)}
+	if c.end&0xffff != 0 {
+		r.End = idx.offsets.next(r.End, idx.fileSize)
+	}
+
+	return r, r.End > r.Start
+}
+
+// binRegion returns the region covered by a bin, where the bins of level l
+// are numbered from (8^l-1)/7 and cover 2^(minShift+3*(depth-l)) positions
+// each. The pseudo bin and invalid bins have no region.
+func (idx *BinningIndex) binRegion(bin uint32) (int64, int64, bool) {
+	first := uint64(0)
+	for l := 0; l <= idx.depth; l++ {
+		count := uint64(1) << (3 * l)
+		if uint64(bin) < first+count {
+			size := int64(1) << (idx.minShift + 3*(idx.depth-l))
+			beg := int64(uint64(bin)-first) * size
+
+			return beg, beg + size, true
+		}
+		first += count
+	}
+
+	return 0, 0, false
+}
+
+// binaryReader reads little-endian values, keeping the first error
+type binaryReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *binaryReader) bytes(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+
+	// Sizes come from the file, so the buffer only grows with the data read
+	buf, err := io.ReadAll(io.LimitReader(b.r, int64(n)))
+	switch {
+	case err != nil:
+		b.err = err
+	case len(buf) < n:
+		b.err = io.ErrUnexpectedEOF
+	}
+
+	return buf
+}
+
+func (b *binaryReader) int32() int32 {
+	return int32(b.uint32())
+}
+
+func (b *binaryReader) uint32() uint32 {
+	buf := b.bytes(4)
+	if b.err != nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(buf)
+}
+
+func (b *binaryReader) uint64() uint64 {
+	buf := b.bytes(8)
+	if b.err != nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(buf)
+}
+
+// count reads a non-negative 32-bit count
+func (b *binaryReader) count() int {
+	n := b.int32()
+	if n < 0 && b.err == nil {
+		b.err = errors.New("negative count")
+	}
+	if b.err != nil {
+		return 0
+	}
+
+	return int(n)
+}
+
+// tabixNames reads the tabix meta data, returning the reference names
+func (b *binaryReader) tabixNames() []string {
+	// format, col_seq, col_beg, col_end, meta and skip
+	b.bytes(6 * 4)
+	names := b.bytes(b.count())
+	if b.err != nil || len(names) == 0 {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(string(names), "\x00"), "\x00")
+}
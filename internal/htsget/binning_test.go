@@ -0,0 +1,148 @@
+package htsget
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// indexBuffer builds binary index data for tests
+type indexBuffer struct {
+	bytes.Buffer
+}
+
+func (b *indexBuffer) put(values ...any) *indexBuffer {
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			b.WriteString(s)
+
+			continue
+		}
+		_ = binary.Write(b, binary.LittleEndian, v)
+	}
+
+	return b
+}
+
+// gzipped returns data compressed as a single gzip member
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(data)
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func voffset(block, offset uint64) uint64 {
+	return block<<16 | offset
+}
+
+func TestReadBAI(t *testing.T) {
+	var b indexBuffer
+	b.put("BAI\x01", int32(2))
+	// The first reference has two 16kb bins, and statistics in the pseudo bin
+	b.put(int32(3),
+		uint32(4681), int32(1), voffset(100, 0), voffset(200, 50),
+		uint32(4682), int32(1), voffset(200, 50), voffset(300, 0),
+		uint32(37450), int32(2), voffset(100, 0), voffset(300, 0), uint64(10), uint64(0))
+	b.put(int32(2), voffset(100, 0), voffset(200, 50))
+	// The second reference has all records in the top level bin
+	b.put(int32(1), uint32(0), int32(1), voffset(300, 0), voffset(400, 10))
+	b.put(int32(1), voffset(300, 0))
+
+	idx, err := ReadBAI(bytes.NewReader(b.Bytes()), 500)
+	assert.NoError(t, err)
+	assert.Nil(t, idx.ReferenceNames())
+
+	// The block where a chunk ends is included up to the next known block
+	assert.Equal(t, []ByteRange{{100, 300}}, idx.Ranges(0, 0, 100))
+	assert.Equal(t, []ByteRange{{200, 300}}, idx.Ranges(0, 16384, 0))
+	assert.Equal(t, []ByteRange{{100, 300}}, idx.Ranges(0, 0, 0))
+	assert.Equal(t, []ByteRange{{300, 500}}, idx.Ranges(1, 1000, 2000))
+	assert.Nil(t, idx.Ranges(2, 0, 0))
+
+	assert.Equal(t, int64(100), idx.HeaderEnd())
+	assert.Equal(t, []ByteRange{{400, 500}}, idx.UnmappedRanges())
+
+	// Chunks whose offsets collapse to the start of a block hold no data
+	b.Reset()
+	b.put("BAI\x01", int32(1))
+	b.put(int32(2),
+		uint32(4681), int32(1), voffset(100, 0), voffset(100, 0),
+		uint32(4682), int32(1), voffset(100, 0), voffset(200, 0))
+	b.put(int32(0))
+
+	idx, err = ReadBAI(bytes.NewReader(b.Bytes()), 300)
+	assert.NoError(t, err)
+	assert.Nil(t, idx.Ranges(0, 0, 100))
+	assert.Equal(t, []ByteRange{{100, 200}}, idx.Ranges(0, 0, 0))
+
+	_, err = ReadBAI(bytes.NewReader([]byte("BAM\x01")), 500)
+	assert.Error(t, err)
+
+	_, err = ReadBAI(bytes.NewReader(b.Bytes()[:30]), 500)
+	assert.Error(t, err)
+}
+
+func TestReadTBI(t *testing.T) {
+	var b indexBuffer
+	b.put("TBI\x01", int32(2), int32(2), int32(1), int32(2), int32(0), int32('#'), int32(0))
+	b.put(int32(10), "chr1\x00chr2\x00")
+	b.put(int32(1), uint32(4681), int32(1), voffset(50, 0), voffset(80, 5))
+	b.put(int32(1), voffset(50, 0))
+	b.put(int32(1), uint32(4682), int32(1), voffset(80, 5), voffset(90, 0))
+	b.put(int32(0))
+
+	idx, err := ReadTBI(bytes.NewReader(gzipped(b.Bytes())), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr1", "chr2"}, idx.ReferenceNames())
+	assert.Equal(t, []ByteRange{{50, 90}}, idx.Ranges(0, 0, 1000))
+	assert.Equal(t, []ByteRange{{80, 90}}, idx.Ranges(1, 16384, 20000))
+	assert.Nil(t, idx.Ranges(1, 0, 16384))
+
+	_, err = ReadTBI(bytes.NewReader(b.Bytes()), 100)
+	assert.Error(t, err)
+}
+
+func TestReadCSI(t *testing.T) {
+	var b indexBuffer
+	b.put("CSI\x01", int32(14), int32(5), int32(0), int32(1))
+	b.put(int32(1), uint32(4681), voffset(60, 0), int32(1), voffset(60, 0), voffset(70, 1))
+
+	idx, err := ReadCSI(bytes.NewReader(gzipped(b.Bytes())), 90)
+	assert.NoError(t, err)
+	assert.Nil(t, idx.ReferenceNames())
+	assert.Equal(t, []ByteRange{{60, 90}}, idx.Ranges(0, 100, 200))
+	assert.Nil(t, idx.Ranges(0, 20000, 30000))
+	assert.Equal(t, int64(60), idx.HeaderEnd())
+
+	// A CSI index of a tabix compatible file holds the reference names
+	var aux indexBuffer
+	aux.put(int32(2), int32(1), int32(2), int32(0), int32('#'), int32(0), int32(5), "chr1\x00")
+	b.Reset()
+	b.put("CSI\x01", int32(14), int32(6), int32(aux.Len()), aux.String(), int32(1))
+	b.put(int32(1), uint32(0), voffset(60, 0), int32(1), voffset(60, 0), voffset(70, 1))
+
+	idx, err = ReadCSI(bytes.NewReader(gzipped(b.Bytes())), 90)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr1"}, idx.ReferenceNames())
+	assert.Equal(t, []ByteRange{{60, 90}}, idx.Ranges(0, 1<<30, 0))
+
+	b.Reset()
+	b.put("CSI\x01", int32(14), int32(50))
+	_, err = ReadCSI(bytes.NewReader(gzipped(b.Bytes())), 90)
+	assert.Error(t, err)
+}
+
+func TestMergeRanges(t *testing.T) {
+	assert.Equal(t, []ByteRange{{0, 20}, {30, 40}}, mergeRanges([]ByteRange{{30, 40}, {10, 20}, {0, 10}, {5, 15}}))
+	assert.Empty(t, mergeRanges(nil))
+
+	// Empty ranges can't be requested, so they are dropped
+	assert.Equal(t, []ByteRange{{30, 40}}, mergeRanges([]ByteRange{{50, 50}, {30, 40}, {20, 20}}))
+	assert.Empty(t, mergeRanges([]ByteRange{{20, 20}}))
+}
@@ -0,0 +1,110 @@
+package htsget
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// craiEntry is a slice of a CRAM file as listed in a CRAI index
+type craiEntry struct {
+	refID           int
+	start, span     int64
+	containerOffset int64
+}
+
+// CRAIIndex is a CRAI index of a CRAM file
+type CRAIIndex struct {
+	entries    []craiEntry
+	containers offsets
+	fileSize   int64
+}
+
+// ReadCRAI parses a CRAI index of a CRAM file of the given size
+func ReadCRAI(r io.Reader, fileSize int64) (*CRAIIndex, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRAI index, %w", err)
+	}
+	defer gz.Close()
+
+	idx := &CRAIIndex{fileSize: fileSize}
+	var known []int64
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		// Each line holds the reference id, alignment start and span, and
+		// the offsets of the container and slice and the size of the slice
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid CRAI line %q", scanner.Text())
+		}
+		var values [4]int64
+		for i := range values {
+			values[i], err = strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CRAI line %q", scanner.Text())
+			}
+		}
+
+		idx.entries = append(idx.entries, craiEntry{refID: int(values[0]), start: values[1], span: values[2], containerOffset: values[3]})
+		known = append(known, values[3])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CRAI index, %w", err)
+	}
+	idx.containers = newOffsets(known)
+
+	return idx, nil
+}
+
+// Ranges implements Index for the CRAIIndex
+func (idx *CRAIIndex) Ranges(refID int, beg, end int64) []ByteRange {
+	var ranges []ByteRange
+	for _, e := range idx.entries {
+		if e.refID != refID {
+			continue
+		}
+
+		// Alignment starts are 1-based
+		if end > 0 && e.start-1 >= end || e.start-1+e.span <= beg {
+			continue
+		}
+		ranges = append(ranges, idx.containerRange(e.containerOffset))
+	}
+
+	return mergeRanges(ranges)
+}
+
+// UnmappedRanges implements Index for the CRAIIndex
+func (idx *CRAIIndex) UnmappedRanges() []ByteRange {
+	var ranges []ByteRange
+	for _, e := range idx.entries {
+		if e.refID == -1 {
+			ranges = append(ranges, idx.containerRange(e.containerOffset))
+		}
+	}
+
+	return mergeRanges(ranges)
+}
+
+// HeaderEnd implements Index for the CRAIIndex
+func (idx *CRAIIndex) HeaderEnd() int64 {
+	if len(idx.containers) == 0 {
+		return idx.fileSize
+	}
+
+	return idx.containers[0]
+}
+
+// containerRange returns the range of the container at offset, which ends
+// where the next container starts
+func (idx *CRAIIndex) containerRange(offset int64) ByteRange {
+	return ByteRange{Start: offset, End: idx.containers.next(offset, idx.fileSize)}
+}
@@ -0,0 +1,32 @@
+package htsget
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCRAI(t *testing.T) {
+	data := "0\t1\t100\t1000\t10\t50\n" +
+		"0\t101\t100\t2000\t10\t50\n" +
+		"1\t1\t50\t3000\t10\t50\n" +
+		"-1\t0\t0\t4000\t10\t50\n"
+
+	idx, err := ReadCRAI(bytes.NewReader(gzipped([]byte(data))), 5000)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []ByteRange{{1000, 2000}}, idx.Ranges(0, 0, 50))
+	assert.Equal(t, []ByteRange{{2000, 3000}}, idx.Ranges(0, 150, 0))
+	assert.Equal(t, []ByteRange{{1000, 3000}}, idx.Ranges(0, 0, 0))
+	assert.Equal(t, []ByteRange{{3000, 4000}}, idx.Ranges(1, 0, 0))
+	assert.Empty(t, idx.Ranges(1, 50, 100))
+	assert.Equal(t, []ByteRange{{4000, 5000}}, idx.UnmappedRanges())
+	assert.Equal(t, int64(1000), idx.HeaderEnd())
+
+	_, err = ReadCRAI(bytes.NewReader(gzipped([]byte("0\t1\t100\n"))), 5000)
+	assert.Error(t, err)
+
+	_, err = ReadCRAI(bytes.NewReader([]byte(data)), 5000)
+	assert.Error(t, err)
+}
@@ -0,0 +1,247 @@
+package htsget
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BGZFEOF is the empty block marking the end of a BGZF compressed file
+var BGZFEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// CRAMEOFSize is the size of the container marking the end of a CRAM 3 file
+const CRAMEOFSize = 38
+
+// ReadBAMReferences reads the reference names from the header of a BAM file
+func ReadBAMReferences(r io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read BAM header, %w", err)
+	}
+	defer gz.Close()
+
+	br := &binaryReader{r: gz}
+	if magic := br.bytes(4); br.err == nil && !bytes.Equal(magic, []byte("BAM\x01")) {
+		return nil, errors.New("not a BAM file")
+	}
+
+	// The SAM header text is followed by the binary reference list, which
+	// defines the reference ids
+	br.bytes(br.count())
+	nRef := br.count()
+	var names []string
+	for i := 0; i < nRef && br.err == nil; i++ {
+		name := br.bytes(br.count())
+		br.int32()
+		names = append(names, strings.TrimSuffix(string(name), "\x00"))
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("failed to read BAM header, %w", br.err)
+	}
+
+	return names, nil
+}
+
+// ReadVCFReferences reads the contig names from the header of a BGZF
+// compressed VCF file
+func ReadVCFReferences(r io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VCF header, %w", err)
+	}
+	defer gz.Close()
+
+	var text strings.Builder
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() && strings.HasPrefix(scanner.Text(), "#") {
+		text.WriteString(scanner.Text() + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read VCF header, %w", err)
+	}
+
+	return vcfContigs(text.String()), nil
+}
+
+// ReadBCFReferences reads the contig names from the header of a BCF file
+func ReadBCFReferences(r io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read BCF header, %w", err)
+	}
+	defer gz.Close()
+
+	br := &binaryReader{r: gz}
+	if magic := br.bytes(5); br.err == nil && !bytes.HasPrefix(magic, []byte("BCF\x02")) {
+		return nil, errors.New("not a BCF file")
+	}
+	text := br.bytes(int(br.uint32()))
+	if br.err != nil {
+		return nil, fmt.Errorf("failed to read BCF header, %w", br.err)
+	}
+
+	return vcfContigs(string(text)), nil
+}
+
+// vcfContigs returns the ids of the contig lines of a VCF header, in order
+func vcfContigs(header string) []string {
+	var names []string
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "##contig=<") {
+			continue
+		}
+		for _, field := range strings.Split(strings.TrimSuffix(line[len("##contig=<"):], ">"), ",") {
+			if id, found := strings.CutPrefix(field, "ID="); found {
+				names = append(names, id)
+
+				break
+			}
+		}
+	}
+
+	return names
+}
+
+// ReadCRAMReferences reads the reference names from the SAM header of a CRAM
+// file, along with the major version of the file format
+func ReadCRAMReferences(r io.Reader) ([]string, int, error) {
+	br := &binaryReader{r: bufio.NewReader(r)}
+
+	// The file definition is followed by the header container, which holds
+	// the SAM header in its first block
+	definition := br.bytes(26)
+	if br.err == nil && !bytes.HasPrefix(definition, []byte("CRAM")) {
+		return nil, 0, errors.New("not a CRAM file")
+	}
+	if br.err != nil {
+		return nil, 0, fmt.Errorf("failed to read CRAM header, %w", br.err)
+	}
+	major := int(definition[4])
+
+	br.int32()
+	for i := 0; i < 4; i++ {
+		br.itf8()
+	}
+	br.ltf8()
+	br.ltf8()
+	br.itf8()
+	for n := br.itf8(); n > 0 && br.err == nil; n-- {
+		br.itf8()
+	}
+	if major >= 3 {
+		br.uint32()
+	}
+
+	method := br.bytes(2)
+	br.itf8()
+	size := br.itf8()
+	br.itf8()
+	data := br.bytes(size)
+	if br.err != nil {
+		return nil, major, fmt.Errorf("failed to read CRAM header, %w", br.err)
+	}
+
+	switch method[0] {
+	case 0:
+	case 1:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, major, fmt.Errorf("failed to read CRAM header, %w", err)
+		}
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, major, fmt.Errorf("failed to read CRAM header, %w", err)
+		}
+	default:
+		return nil, major, fmt.Errorf("unsupported CRAM header compression %d", method[0])
+	}
+
+	hr := &binaryReader{r: bytes.NewReader(data)}
+	text := hr.bytes(hr.count())
+	if hr.err != nil {
+		return nil, major, fmt.Errorf("failed to read CRAM header, %w", hr.err)
+	}
+
+	return samReferences(string(text)), major, nil
+}
+
+// samReferences returns the names of the @SQ lines of a SAM header, in order
+func samReferences(header string) []string {
+	var names []string
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "@SQ\t") {
+			continue
+		}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			if name, found := strings.CutPrefix(field, "SN:"); found {
+				names = append(names, name)
+
+				break
+			}
+		}
+	}
+
+	return names
+}
+
+// itf8 reads a CRAM variable length integer of up to 32 bits, where the
+// number of leading one bits of the first byte gives the number of bytes
+// following it
+func (b *binaryReader) itf8() int {
+	first := b.bytes(1)
+	if b.err != nil {
+		return 0
+	}
+
+	var n int
+	for n = 0; n < 4 && first[0]&(0x80>>n) != 0; n++ {
+	}
+	rest := b.bytes(n)
+	if b.err != nil {
+		return 0
+	}
+
+	if n == 4 {
+		// The last byte only contributes its lower four bits
+		return int(first[0]&0x0f)<<28 | int(rest[0])<<20 | int(rest[1])<<12 | int(rest[2])<<4 | int(rest[3]&0x0f)
+	}
+	value := int(first[0] & (0xff >> (n + 1)))
+	for _, c := range rest {
+		value = value<<8 | int(c)
+	}
+
+	return value
+}
+
+// ltf8 reads a CRAM variable length integer of up to 64 bits
+func (b *binaryReader) ltf8() int64 {
+	first := b.bytes(1)
+	if b.err != nil {
+		return 0
+	}
+
+	var n int
+	for n = 0; n < 8 && first[0]&(0x80>>n) != 0; n++ {
+	}
+	rest := b.bytes(n)
+	if b.err != nil {
+		return 0
+	}
+
+	var value int64
+	if n < 8 {
+		value = int64(first[0] & (0xff >> (n + 1)))
+	}
+	for _, c := range rest {
+		value = value<<8 | int64(c)
+	}
+
+	return value
+}
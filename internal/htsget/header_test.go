@@ -0,0 +1,96 @@
+package htsget
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBAMReferences(t *testing.T) {
+	var b indexBuffer
+	text := "@HD\tVN:1.6\n@SQ\tSN:chr1\tLN:100\n@SQ\tSN:chr2\tLN:200\n"
+	b.put("BAM\x01", int32(len(text)), text, int32(2))
+	b.put(int32(5), "chr1\x00", int32(100), int32(5), "chr2\x00", int32(200))
+
+	names, err := ReadBAMReferences(bytes.NewReader(append(gzipped(b.Bytes()), BGZFEOF...)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr1", "chr2"}, names)
+
+	_, err = ReadBAMReferences(bytes.NewReader(gzipped([]byte("BAI\x01"))))
+	assert.Error(t, err)
+}
+
+func TestReadVCFReferences(t *testing.T) {
+	vcf := "##fileformat=VCFv4.2\n##contig=<ID=chr1,length=100>\n##contig=<ID=chrX>\n" +
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\nchr1\t1\t.\tA\tC\t.\t.\t.\n"
+
+	names, err := ReadVCFReferences(bytes.NewReader(gzipped([]byte(vcf))))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr1", "chrX"}, names)
+
+	var b indexBuffer
+	b.put("BCF\x02\x02", uint32(len(vcf)), vcf)
+	names, err = ReadBCFReferences(bytes.NewReader(gzipped(b.Bytes())))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr1", "chrX"}, names)
+
+	_, err = ReadBCFReferences(bytes.NewReader(gzipped([]byte(vcf))))
+	assert.Error(t, err)
+}
+
+func TestReadCRAMReferences(t *testing.T) {
+	text := "@HD\tVN:1.6\n@SQ\tSN:chr1\tLN:100\n" + strings.Repeat("@CO\tpadding\n", 10) + "@SQ\tSN:chr2\tLN:200\n"
+
+	for _, method := range []byte{0, 1} {
+		var data indexBuffer
+		data.put(int32(len(text)), text)
+		block := data.Bytes()
+		if method == 1 {
+			block = gzipped(block)
+		}
+
+		var b indexBuffer
+		b.put("CRAM\x03\x00", strings.Repeat("x", 20))
+		// Container header with the length, reference, start, span and number
+		// of records, the record counter and bases, the number of blocks, no
+		// landmarks and the checksum
+		b.put(int32(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(1), uint8(0), uint32(0))
+		// Block with compression method, content type and id, sizes, data
+		// and checksum, with two byte itf8 sizes
+		b.put(method, uint8(0), uint8(0))
+		b.put(uint8(0x80|len(block)>>8), uint8(len(block)), uint8(0x80|len(data.Bytes())>>8), uint8(len(data.Bytes())))
+		b.put(string(block), uint32(0))
+
+		names, version, err := ReadCRAMReferences(bytes.NewReader(b.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, version)
+		assert.Equal(t, []string{"chr1", "chr2"}, names)
+	}
+
+	_, _, err := ReadCRAMReferences(bytes.NewReader([]byte("BAM\x01")))
+	assert.Error(t, err)
+}
+
+func TestITF8(t *testing.T) {
+	for _, test := range []struct {
+		data  []byte
+		value int
+	}{
+		{[]byte{0x7f}, 0x7f},
+		{[]byte{0x81, 0x02}, 0x102},
+		{[]byte{0xc1, 0x02, 0x03}, 0x10203},
+		{[]byte{0xe1, 0x02, 0x03, 0x04}, 0x1020304},
+		{[]byte{0xf1, 0x02, 0x03, 0x04, 0x05}, 0x10203045},
+	} {
+		br := &binaryReader{r: bytes.NewReader(test.data)}
+		assert.Equal(t, test.value, br.itf8())
+		assert.NoError(t, br.err)
+	}
+
+	br := &binaryReader{r: bytes.NewReader([]byte{0xff, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})}
+	assert.Equal(t, int64(0x0102030405060708), br.ltf8())
+	br = &binaryReader{r: bytes.NewReader([]byte{0x81, 0x02})}
+	assert.Equal(t, int64(0x102), br.ltf8())
+}
@@ -0,0 +1,89 @@
+// Package htsget translates genomic regions to byte ranges of BAM, CRAM, VCF
+// and BCF files, using the BAI, CSI, TBI and CRAI index formats.
+package htsget
+
+import (
+	"sort"
+
+	"golang.org/x/exp/slices"
+)
+
+// ByteRange is the half-open range [Start, End) of bytes of a file
+type ByteRange struct {
+	Start, End int64
+}
+
+// Index translates genomic regions to byte ranges of an indexed file
+type Index interface {
+	// Ranges returns the byte ranges holding the records of reference refID
+	// overlapping the 0-based half-open region [beg, end). An end of 0 or
+	// less means the end of the reference.
+	Ranges(refID int, beg, end int64) []ByteRange
+	// UnmappedRanges returns the byte ranges holding unplaced unmapped
+	// records, which are stored after all other records
+	UnmappedRanges() []ByteRange
+	// HeaderEnd returns the offset where the file header ends and the first
+	// record starts
+	HeaderEnd() int64
+}
+
+// Names is implemented by indexes that hold the names of the references,
+// which otherwise have to be read from the header of the indexed file
+type Names interface {
+	ReferenceNames() []string
+}
+
+// mergeRanges sorts byte ranges and merges ranges that overlap or are
+// adjacent to each other. Empty ranges are dropped, as they can't be
+// requested.
+func mergeRanges(ranges []ByteRange) []ByteRange {
+	ranges = slices.DeleteFunc(ranges, func(r ByteRange) bool { return r.End <= r.Start })
+	if len(ranges) == 0 {
+		return ranges
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := []ByteRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		current := &merged[len(merged)-1]
+		if r.Start > current.End {
+			merged = append(merged, r)
+
+			continue
+		}
+		if r.End > current.End {
+			current.End = r.End
+		}
+	}
+
+	return merged
+}
+
+// offsets is a sorted list of known record block starts of a file, used to
+// find the end of the block starting at an offset
+type offsets []int64
+
+// newOffsets returns the sorted unique offsets of a list
+func newOffsets(list []int64) offsets {
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+	unique := offsets{}
+	for i, o := range list {
+		if i == 0 || o != list[i-1] {
+			unique = append(unique, o)
+		}
+	}
+
+	return unique
+}
+
+// next returns the first offset after offset, or fileSize if there is none
+func (o offsets) next(offset, fileSize int64) int64 {
+	i := sort.Search(len(o), func(i int) bool { return o[i] > offset })
+	if i == len(o) || o[i] > fileSize {
+		return fileSize
+	}
+
+	return o[i]
+}
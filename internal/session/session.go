@@ -1,6 +1,9 @@
 package session
 
 import (
+	"sync"
+	"time"
+
 	"github.com/dgraph-io/ristretto"
 	"github.com/google/uuid"
 	"github.com/neicnordic/sda-download/internal/config"
@@ -20,6 +23,9 @@ var SessionCache *ristretto.Cache
 // Cache.Datasets==[]string{...}, session exists, user has permissions
 type Cache struct {
 	Datasets []string
+	// Expires is when the token the session was started with expires, or
+	// the zero time if that isn't known
+	Expires time.Time
 }
 
 // InitialiseSessionCache creates a cache manager that stores keys and values in memory
@@ -57,7 +63,7 @@ var Get = func(key string) (Cache, bool) {
 	if exists {
 		// the storage is unaware of cached types, so if an item is found
 		// we must assert it is the expected interface type (Cache)
-		cached = cachedItem.(Cache)
+		cached, exists = cachedItem.(Cache)
 	}
 	log.Debugf("cache response, exists=%t, cached=%v", exists, cached)
 
@@ -93,3 +99,52 @@ var NewSessionKey = func() string {
 
 	return sessionKey
 }
+
+// Credential holds the secret key and dataset permissions bound to an S3
+// access key
+type Credential struct {
+	SecretKey string
+	Datasets  []string
+}
+
+// storedCredential is a credential with the time it expires
+type storedCredential struct {
+	Credential
+	expires time.Time
+}
+
+// credentials holds the S3 credentials. Unlike the session cache, it never
+// drops a credential before it expires, as the credential would then stop
+// working while the client still holds it.
+var credentials = struct {
+	sync.Mutex
+	entries map[string]storedCredential
+}{entries: map[string]storedCredential{}}
+
+// GetCredential returns the S3 credential of accessKey, unless it has expired
+var GetCredential = func(accessKey string) (Credential, bool) {
+	credentials.Lock()
+	defer credentials.Unlock()
+
+	stored, exists := credentials.entries[accessKey]
+	if !exists || time.Now().After(stored.expires) {
+		return Credential{}, false
+	}
+
+	return stored.Credential, true
+}
+
+// SetCredential stores an S3 credential for ttl, removing the credentials
+// that have expired
+var SetCredential = func(accessKey string, credential Credential, ttl time.Duration) {
+	credentials.Lock()
+	defer credentials.Unlock()
+
+	now := time.Now()
+	for key, stored := range credentials.entries {
+		if now.After(stored.expires) {
+			delete(credentials.entries, key)
+		}
+	}
+	credentials.entries[accessKey] = storedCredential{Credential: credential, expires: now.Add(ttl)}
+}
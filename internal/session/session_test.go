@@ -78,3 +78,34 @@ func TestGetSetCache_NotFound(t *testing.T) {
 	}
 
 }
+
+func TestGetSetCredential(t *testing.T) {
+
+	// Initialise a cache for testing
+	cache, _ := InitialiseSessionCache()
+	SessionCache = cache
+
+	SetCredential("access", Credential{SecretKey: "secret", Datasets: []string{"dataset1"}}, time.Minute)
+	credential, exists := GetCredential("access")
+	if !exists || credential.SecretKey != "secret" || strings.Join(credential.Datasets, "") != "dataset1" {
+		t.Errorf("TestGetSetCredential failed, got %v, exists=%t", credential, exists)
+	}
+
+	// Credentials are not sessions, and sessions are not credentials
+	if _, exists := Get("access"); exists {
+		t.Error("TestGetSetCredential failed, credential returned as a session")
+	}
+	if _, exists := GetCredential("missing"); exists {
+		t.Error("TestGetSetCredential failed, found missing credential")
+	}
+
+	// Expired credentials are not returned, and are removed by later sets
+	SetCredential("expired", Credential{SecretKey: "secret"}, -time.Second)
+	if _, exists := GetCredential("expired"); exists {
+		t.Error("TestGetSetCredential failed, found expired credential")
+	}
+	SetCredential("other", Credential{SecretKey: "secret"}, time.Minute)
+	if _, exists := credentials.entries["expired"]; exists {
+		t.Error("TestGetSetCredential failed, expired credential not removed")
+	}
+}
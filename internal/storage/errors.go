@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorKind tells whether a failed storage operation is worth retrying
+type ErrorKind int
+
+const (
+	// ErrorPermanent is an error that retrying won't fix
+	ErrorPermanent ErrorKind = iota
+	// ErrorNotFound is a file that doesn't exist
+	ErrorNotFound
+	// ErrorTransient is an error that may go away, such as throttling,
+	// server errors and network errors
+	ErrorTransient
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorNotFound:
+		return "not found"
+	case ErrorTransient:
+		return "transient"
+	default:
+		return "permanent"
+	}
+}
+
+// Error is a classified error from a storage backend
+type Error struct {
+	Kind     ErrorKind
+	FilePath string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("storage error (%s) for %s: %v", e.Kind, e.FilePath, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKindOf returns the kind of a storage error, errors that aren't
+// classified being permanent
+func ErrorKindOf(err error) ErrorKind {
+	var storageErr *Error
+	if errors.As(err, &storageErr) {
+		return storageErr.Kind
+	}
+
+	return ErrorPermanent
+}
+
+// classifyError wraps an error from a backend in an Error of its kind
+func classifyError(filePath string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var storageErr *Error
+	if errors.As(err, &storageErr) {
+		return err
+	}
+
+	return &Error{Kind: errorKind(err), FilePath: filePath, Err: err}
+}
+
+// errorKind classifies S3 and file system errors
+func errorKind(err error) ErrorKind {
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrorNotFound
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorPermanent
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorTransient
+	}
+
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		switch status := requestFailure.StatusCode(); {
+		case status == http.StatusNotFound:
+			return ErrorNotFound
+		case status == http.StatusTooManyRequests, status >= http.StatusInternalServerError:
+			return ErrorTransient
+		}
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrorNotFound
+		case request.CanceledErrorCode:
+			return ErrorPermanent
+		case "SlowDown":
+			return ErrorTransient
+		}
+		if request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr) {
+			return ErrorTransient
+		}
+	}
+
+	return ErrorPermanent
+}
+
+// retryBaseDelay and retryMaxDelay bound the backoff between retries
+var (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// retry runs an operation until it succeeds, fails with an error that isn't
+// transient, or has been retried for retryTime. The delay between attempts
+// grows exponentially, with jitter so that failing requests don't retry in
+// step.
+func retry(ctx context.Context, filePath string, retryTime time.Duration, operation func() error) error {
+	start := time.Now()
+	delay := retryBaseDelay
+
+	for {
+		err := classifyError(filePath, operation())
+		if err == nil || ErrorKindOf(err) != ErrorTransient {
+			return err
+		}
+
+		// Sleep between half and all of the delay
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) // #nosec G404 jitter needs no crypto
+		if time.Since(start)+sleep > retryTime {
+			return err
+		}
+		log.Debugf("retrying storage operation on %s in %v after %v", filePath, sleep, err)
+
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return classifyError(filePath, ctx.Err())
+		}
+		delay = min(2*delay, retryMaxDelay)
+	}
+}
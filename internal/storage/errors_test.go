@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKind(t *testing.T) {
+	_, pathErr := os.Open("/this/does/not/exist")
+
+	for _, test := range []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{pathErr, ErrorNotFound},
+		{awserr.New("NoSuchKey", "The specified key does not exist.", nil), ErrorNotFound},
+		{awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "id"), ErrorNotFound},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "id"), ErrorTransient},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id"), ErrorTransient},
+		{awserr.New("Throttling", "Rate exceeded", nil), ErrorTransient},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection refused")), ErrorTransient},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, ErrorTransient},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"), ErrorPermanent},
+		{awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled), ErrorPermanent},
+		{context.Canceled, ErrorPermanent},
+		{errors.New("something else"), ErrorPermanent},
+	} {
+		err := classifyError("file", test.err)
+		assert.Equal(t, test.kind, ErrorKindOf(err), test.err.Error())
+		assert.ErrorIs(t, err, test.err)
+	}
+
+	assert.Nil(t, classifyError("file", nil))
+	assert.Equal(t, ErrorPermanent, ErrorKindOf(errors.New("not classified")))
+}
+
+func TestRetry(t *testing.T) {
+	originalBase, originalMax := retryBaseDelay, retryMaxDelay
+	defer func() { retryBaseDelay, retryMaxDelay = originalBase, originalMax }()
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 4*time.Millisecond
+
+	transient := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id")
+
+	// Transient errors are retried until the operation succeeds
+	attempts := 0
+	err := retry(context.Background(), "file", time.Second, func() error {
+		attempts++
+		if attempts < 3 {
+			return transient
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// Other errors fail at once
+	attempts = 0
+	err = retry(context.Background(), "file", time.Second, func() error {
+		attempts++
+
+		return awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	})
+	assert.Equal(t, ErrorNotFound, ErrorKindOf(err))
+	assert.Equal(t, 1, attempts)
+
+	// Transient errors are given up on after the retry time
+	start := time.Now()
+	err = retry(context.Background(), "file", 20*time.Millisecond, func() error {
+		return transient
+	})
+	assert.Equal(t, ErrorTransient, ErrorKindOf(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Cancelling stops retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	retryBaseDelay = time.Second
+	err = retry(ctx, "file", time.Minute, func() error {
+		return transient
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, ErrorPermanent, ErrorKindOf(err))
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readCounts counts the files read from each copy: "archive" and "backup"
+// for files opened in either, and "failover" for files moved to the backup
+// while being read
+var readCounts = expvar.NewMap("storage_reads")
+
+// failoverReader reads files from the archive, and from the backup copy
+// when the archive fails
+type failoverReader struct {
+	archive Reader
+	backup  Reader
+}
+
+// NewFailoverReader returns a Reader that reads files from the archive, but
+// falls back to the backup when a file can't be opened or read there. Reads
+// that fail part way through continue in the backup at the same offset, so
+// the copies must hold the same bytes. The archive is returned as is if
+// there is no backup.
+func NewFailoverReader(archive, backup Reader) Reader {
+	if backup == nil {
+		return archive
+	}
+
+	return &failoverReader{archive: archive, backup: backup}
+}
+
+// GetFileSize returns the size of the file in the archive, or in the backup
+// if the archive fails
+func (fr *failoverReader) GetFileSize(ctx context.Context, filePath string) (int64, error) {
+	size, err := fr.archive.GetFileSize(ctx, filePath)
+	if err == nil {
+		return size, nil
+	}
+
+	log.Warnf("failed to get size of %s in the archive, trying the backup: %v", filePath, err)
+	size, backupErr := fr.backup.GetFileSize(ctx, filePath)
+	if backupErr != nil {
+		return 0, failoverError(err, backupErr)
+	}
+
+	return size, nil
+}
+
+// NewFileReader returns a reader of the file that fails over to the backup
+func (fr *failoverReader) NewFileReader(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	return openFailover(ctx, fr, filePath, func(r Reader) (io.ReadCloser, error) {
+		return r.NewFileReader(ctx, filePath)
+	})
+}
+
+// NewFileReadSeeker returns a read seeker of the file that fails over to the
+// backup
+func (fr *failoverReader) NewFileReadSeeker(ctx context.Context, filePath string) (io.ReadSeekCloser, error) {
+	file, err := openFailover(ctx, fr, filePath, func(r Reader) (io.ReadCloser, error) {
+		return r.NewFileReadSeeker(ctx, filePath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &failoverSeekFile{file}, nil
+}
+
+// openFailover opens a file in the archive, or in the backup if that fails
+func openFailover(ctx context.Context, fr *failoverReader, filePath string, open func(Reader) (io.ReadCloser, error)) (*failoverFile, error) {
+	file, err := open(fr.archive)
+	if err == nil {
+		readCounts.Add("archive", 1)
+
+		return &failoverFile{ctx: ctx, backup: fr.backup, filePath: filePath, file: file}, nil
+	}
+
+	log.Warnf("failed to open %s in the archive, trying the backup: %v", filePath, err)
+	file, backupErr := open(fr.backup)
+	if backupErr != nil {
+		log.Errorf("failed to open %s in the backup: %v", filePath, backupErr)
+
+		return nil, failoverError(err, backupErr)
+	}
+	readCounts.Add("backup", 1)
+
+	return &failoverFile{ctx: ctx, filePath: filePath, file: file}, nil
+}
+
+// failoverError picks the error of a file that failed in both copies. The
+// backup error is only used if it's transient, as the file may then be
+// readable again soon.
+func failoverError(archiveErr, backupErr error) error {
+	if ErrorKindOf(backupErr) == ErrorTransient {
+		return backupErr
+	}
+
+	return archiveErr
+}
+
+// failoverFile is a file read from the archive that moves to the backup if
+// a read fails. The backup is nil once the file is read from the backup.
+type failoverFile struct {
+	ctx      context.Context
+	backup   Reader
+	filePath string
+	file     io.ReadCloser
+	pos      int64
+}
+
+// Read implements io.Reader for the failoverFile
+func (f *failoverFile) Read(p []byte) (int, error) {
+	n, err := f.file.Read(p)
+	f.pos += int64(n)
+	if err == nil || errors.Is(err, io.EOF) || f.backup == nil {
+		return n, err
+	}
+
+	if failoverErr := f.failover(err); failoverErr != nil {
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+
+	return f.Read(p)
+}
+
+// failover opens the backup at the current offset
+func (f *failoverFile) failover(err error) error {
+	log.Warnf("reading %s from the archive failed at %d, continuing from the backup: %v", f.filePath, f.pos, err)
+
+	file, err := f.backup.NewFileReadSeeker(f.ctx, f.filePath)
+	if err != nil {
+		log.Errorf("failed to open %s in the backup: %v", f.filePath, err)
+
+		return err
+	}
+	if _, err = file.Seek(f.pos, io.SeekStart); err != nil {
+		log.Errorf("failed to seek %s in the backup: %v", f.filePath, err)
+		_ = file.Close()
+
+		return err
+	}
+
+	_ = f.file.Close()
+	f.file = file
+	f.backup = nil
+	readCounts.Add("failover", 1)
+
+	return nil
+}
+
+// Close implements io.Closer for the failoverFile
+func (f *failoverFile) Close() error {
+	return f.file.Close()
+}
+
+// failoverSeekFile is a failoverFile opened as a read seeker
+type failoverSeekFile struct {
+	*failoverFile
+}
+
+// Seek implements io.Seeker for the failoverSeekFile
+func (f *failoverSeekFile) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := f.file.(io.Seeker)
+	if !ok {
+		return f.pos, errors.New("file is not seekable")
+	}
+
+	pos, err := seeker.Seek(offset, whence)
+	if err != nil {
+		return f.pos, err
+	}
+	f.pos = pos
+
+	return pos, nil
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenReader is an archive whose files fail after failAfter bytes
+type brokenReader struct {
+	Reader
+	failAfter int64
+}
+
+func (r brokenReader) NewFileReader(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	return r.NewFileReadSeeker(ctx, filePath)
+}
+
+func (r brokenReader) NewFileReadSeeker(ctx context.Context, filePath string) (io.ReadSeekCloser, error) {
+	file, err := r.Reader.NewFileReadSeeker(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &brokenFile{ReadSeekCloser: file, left: r.failAfter}, nil
+}
+
+type brokenFile struct {
+	io.ReadSeekCloser
+	left int64
+}
+
+func (f *brokenFile) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, &Error{Kind: ErrorTransient, Err: errors.New("connection reset")}
+	}
+	n, err := f.ReadSeekCloser.Read(p[:min(int64(len(p)), f.left)])
+	f.left -= int64(n)
+
+	return n, err
+}
+
+// newPosixCopy returns a posix backend holding data as name
+func newPosixCopy(t *testing.T, name string, data []byte) Reader {
+	t.Helper()
+
+	dir := t.TempDir()
+	if data != nil {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("failed to write %s, %v", name, err)
+		}
+	}
+	reader, err := NewReader(Conf{Type: posixType, Posix: posixConf{Location: dir}})
+	if err != nil {
+		t.Fatalf("failed to create posix backend, %v", err)
+	}
+
+	return reader
+}
+
+// readCount returns the number of files read from a copy
+func readCount(name string) int64 {
+	if count, ok := readCounts.Get(name).(*expvar.Int); ok {
+		return count.Value()
+	}
+
+	return 0
+}
+
+func TestNewFailoverReader(t *testing.T) {
+	archive := newPosixCopy(t, "file", []byte("data"))
+	assert.Equal(t, archive, NewFailoverReader(archive, nil))
+	assert.IsType(t, &failoverReader{}, NewFailoverReader(archive, archive))
+}
+
+func TestFailoverReader(t *testing.T) {
+	data := []byte("the same bytes in the archive and the backup")
+	backup := newPosixCopy(t, "file", data)
+
+	// Files missing from the archive are read from the backup
+	fr := NewFailoverReader(newPosixCopy(t, "file", nil), backup)
+	backupReads := readCount("backup")
+
+	size, err := fr.GetFileSize(context.Background(), "file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	reader, err := fr.NewFileReader(context.Background(), "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	read, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+	reader.Close()
+	assert.Equal(t, backupReads+1, readCount("backup"))
+
+	// Files missing from both are not found
+	_, err = fr.GetFileSize(context.Background(), "missing")
+	assert.Equal(t, ErrorNotFound, ErrorKindOf(err))
+	_, err = fr.NewFileReadSeeker(context.Background(), "missing")
+	assert.Equal(t, ErrorNotFound, ErrorKindOf(err))
+
+	// Files are read from the archive when it works
+	fr = NewFailoverReader(newPosixCopy(t, "file", data), newPosixCopy(t, "file", []byte("not this")))
+	archiveReads := readCount("archive")
+
+	seeker, err := fr.NewFileReadSeeker(context.Background(), "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = seeker.Seek(4, io.SeekStart)
+	assert.NoError(t, err)
+	read, err = io.ReadAll(seeker)
+	assert.NoError(t, err)
+	assert.Equal(t, data[4:], read)
+	seeker.Close()
+	assert.Equal(t, archiveReads+1, readCount("archive"))
+}
+
+func TestFailoverReader_MidStream(t *testing.T) {
+	data := []byte("the same bytes in the archive and the backup")
+	archive := newPosixCopy(t, "file", data)
+	fr := NewFailoverReader(brokenReader{Reader: archive, failAfter: 10}, newPosixCopy(t, "file", data))
+
+	for _, open := range []func() (io.ReadCloser, error){
+		func() (io.ReadCloser, error) { return fr.NewFileReader(context.Background(), "file") },
+		func() (io.ReadCloser, error) { return fr.NewFileReadSeeker(context.Background(), "file") },
+	} {
+		failovers := readCount("failover")
+
+		reader, err := open()
+		if !assert.NoError(t, err) {
+			return
+		}
+		read, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, data, read)
+		reader.Close()
+		assert.Equal(t, failovers+1, readCount("failover"))
+	}
+
+	// Reads continue from the seeked position in the backup
+	seeker, err := fr.NewFileReadSeeker(context.Background(), "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = seeker.Seek(5, io.SeekStart)
+	assert.NoError(t, err)
+	read, err := io.ReadAll(seeker)
+	assert.NoError(t, err)
+	assert.Equal(t, data[5:], read)
+	seeker.Close()
+
+	// Readers that aren't opened as seekers can't be seeked
+	reader, err := fr.NewFileReader(context.Background(), "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, ok := reader.(io.Seeker)
+	assert.False(t, ok)
+	reader.Close()
+
+	// Files missing from the backup fail with the archive error
+	fr = NewFailoverReader(brokenReader{Reader: archive, failAfter: 10}, newPosixCopy(t, "file", nil))
+	reader, err = fr.NewFileReader(context.Background(), "file")
+	if !assert.NoError(t, err) {
+		return
+	}
+	read, err = io.ReadAll(reader)
+	assert.Equal(t, ErrorTransient, ErrorKindOf(err))
+	assert.Equal(t, data[:10], read)
+	reader.Close()
+}
+
+func TestFailoverError(t *testing.T) {
+	notFound := &Error{Kind: ErrorNotFound}
+	transient := &Error{Kind: ErrorTransient}
+	permanent := &Error{Kind: ErrorPermanent}
+
+	assert.Equal(t, transient, failoverError(notFound, transient))
+	assert.Equal(t, transient, failoverError(transient, notFound))
+	assert.Equal(t, notFound, failoverError(notFound, permanent))
+	assert.Equal(t, permanent, failoverError(permanent, notFound))
+}
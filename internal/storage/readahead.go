@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// chunk is a part of an object fetched by a readAheadReader
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// readAheadReader reads an S3 object with several ranged requests at once.
+// Chunks are fetched concurrently and passed on in order, and at most
+// ReadAhead chunks are fetched ahead of the one being read, which bounds the
+// memory used.
+type readAheadReader struct {
+	chunks  chan chan chunk
+	cancel  context.CancelFunc
+	current []byte
+	err     error
+}
+
+// newReadAheadReader starts reading an object of the given size from the
+// offset start, until ctx ends or the reader is closed
+func newReadAheadReader(ctx context.Context, sb *s3Backend, filePath string, start, size int64) *readAheadReader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &readAheadReader{
+		chunks: make(chan chan chunk, sb.Conf.ReadAhead),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(r.chunks)
+
+		for offset := start; offset < size; offset += sb.Conf.ReadAheadChunkSize {
+			result := make(chan chunk, 1)
+			select {
+			case r.chunks <- result:
+			case <-ctx.Done():
+				return
+			}
+
+			length := min(sb.Conf.ReadAheadChunkSize, size-offset)
+			go func(offset int64) {
+				data, err := sb.getRange(ctx, filePath, offset, length)
+				result <- chunk{data: data, err: err}
+			}(offset)
+		}
+	}()
+
+	return r
+}
+
+// Read implements io.Reader for the readAheadReader
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		result, ok := <-r.chunks
+		if !ok {
+			r.err = io.EOF
+
+			continue
+		}
+		next := <-result
+		r.current, r.err = next.data, next.err
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+
+	return n, nil
+}
+
+// Close implements io.Closer for the readAheadReader, stopping the fetching
+// of chunks
+func (r *readAheadReader) Close() error {
+	r.cancel()
+	r.current = nil
+	if r.err == nil {
+		r.err = io.ErrClosedPipe
+	}
+
+	return nil
+}
+
+// getRange fetches length bytes of an object from the offset
+func (sb *s3Backend) getRange(ctx context.Context, filePath string, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	err := retry(ctx, filePath, sb.Conf.RequestRetryTime, func() error {
+		object, err := sb.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(filePath),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		})
+		if err != nil {
+			return err
+		}
+		defer object.Body.Close()
+
+		if _, err := io.ReadFull(object.Body, data); err != nil {
+			return fmt.Errorf("failed to read %d bytes at %d of %s: %w", length, offset, filePath, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return data, nil
+}
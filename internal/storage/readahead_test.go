@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAheadBackend returns an s3 backend reading in chunks of chunkSize,
+// with a file of the given size written to it
+func readAheadBackend(t *testing.T, filePath string, size int, chunkSize int64) (*s3Backend, []byte) {
+	t.Helper()
+
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	if err != nil {
+		t.Fatalf("Backend failed, %v", err)
+	}
+	s3back := backend.(*s3Backend)
+
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	writer, err := s3back.NewFileWriter(filePath)
+	assert.Nil(t, err, "s3 NewFileWriter failed when it shouldn't")
+	_, err = writer.Write(data)
+	assert.Nil(t, err, "Failure when writing to s3 writer")
+	writer.Close()
+	waitForUpload(t, s3back, filePath)
+
+	conf := *s3back.Conf
+	conf.ReadAhead = 3
+	conf.ReadAheadChunkSize = chunkSize
+	s3back.Conf = &conf
+
+	return s3back, data
+}
+
+func TestReadAhead(t *testing.T) {
+	s3back, data := readAheadBackend(t, "readahead", 100000, 7000)
+
+	reader, err := s3back.NewFileReader(context.Background(), "readahead")
+	assert.Nil(t, err, "s3 NewFileReader failed when it should work")
+	assert.IsType(t, &readAheadReader{}, reader)
+	readBack, err := io.ReadAll(reader)
+	assert.Nil(t, err, "reading ahead failed")
+	assert.Equal(t, data, readBack, "did not read back data as expected")
+	reader.Close()
+
+	readSeeker, err := s3back.NewFileReadSeeker(context.Background(), "readahead")
+	assert.Nil(t, err, "s3 NewFileReadSeeker failed when it should work")
+	defer readSeeker.Close()
+
+	_, err = readSeeker.Seek(50001, io.SeekStart)
+	assert.Nil(t, err, "seeking failed")
+	readBack, err = io.ReadAll(readSeeker)
+	assert.Nil(t, err, "reading ahead after seeking failed")
+	assert.Equal(t, data[50001:], readBack, "did not read back data as expected")
+
+	_, err = readSeeker.Seek(10, io.SeekStart)
+	assert.Nil(t, err, "seeking back failed")
+	readBack = make([]byte, 20)
+	_, err = io.ReadFull(readSeeker, readBack)
+	assert.Nil(t, err, "reading ahead after seeking back failed")
+	assert.Equal(t, data[10:30], readBack, "did not read back data as expected")
+
+	// Small ranges are read with a single request of at most one chunk
+	_, readingAhead := readSeeker.(*s3SeekableReader).body.(*readAheadReader)
+	assert.False(t, readingAhead, "read ahead for a small range")
+
+	// Reading goes on ahead after the first chunk
+	readBack = make([]byte, 20000)
+	_, err = io.ReadFull(readSeeker, readBack)
+	assert.Nil(t, err, "reading past the first chunk failed")
+	assert.Equal(t, data[30:20030], readBack, "did not read back data as expected")
+	assert.IsType(t, &readAheadReader{}, readSeeker.(*s3SeekableReader).body)
+}
+
+func TestReadAhead_Close(t *testing.T) {
+	s3back, data := readAheadBackend(t, "readahead-close", 50000, 1000)
+
+	reader, err := s3back.NewFileReader(context.Background(), "readahead-close")
+	assert.Nil(t, err, "s3 NewFileReader failed when it should work")
+
+	readBack := make([]byte, 10)
+	_, err = io.ReadFull(reader, readBack)
+	assert.Nil(t, err, "reading ahead failed")
+	assert.Equal(t, data[:10], readBack)
+
+	reader.Close()
+	_, err = reader.Read(readBack)
+	assert.NotNil(t, err, "reading worked after closing")
+}
+
+func TestReadAhead_Fail(t *testing.T) {
+	s3back, _ := readAheadBackend(t, "readahead-fail", 10, 1000)
+
+	// The object is shorter than the reader expects
+	reader := newReadAheadReader(context.Background(), s3back, "readahead-fail", 0, 2000)
+	defer reader.Close()
+	_, err := io.ReadAll(reader)
+	assert.NotNil(t, err, "reading ahead worked when it should not")
+
+	reader = newReadAheadReader(context.Background(), s3back, s3DoesNotExist, 0, 100)
+	defer reader.Close()
+	_, err = io.ReadAll(reader)
+	assert.NotNil(t, err, "reading ahead worked when it should not")
+}
@@ -2,14 +2,17 @@
 package storage
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,13 +26,25 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Reader defines the methods for reading files, which is all a read-only
+// backend has. Requests for a file, and their retries, stop when ctx ends.
+type Reader interface {
+	GetFileSize(ctx context.Context, filePath string) (int64, error)
+	NewFileReader(ctx context.Context, filePath string) (io.ReadCloser, error)
+	NewFileReadSeeker(ctx context.Context, filePath string) (io.ReadSeekCloser, error)
+}
+
 // Backend defines methods to be implemented by PosixBackend and S3Backend
 type Backend interface {
-	GetFileSize(filePath string) (int64, error)
-	NewFileReader(filePath string) (io.ReadCloser, error)
+	Reader
 	NewFileWriter(filePath string) (io.WriteCloser, error)
 }
 
+// readOnlyBackend hides the write methods of a backend
+type readOnlyBackend struct {
+	Reader
+}
+
 // Conf is a wrapper for the storage config
 type Conf struct {
 	Type  string
@@ -57,6 +72,28 @@ func NewBackend(config Conf) (Backend, error) {
 	}
 }
 
+// NewReader initiates a read-only storage backend. S3 buckets are only
+// checked for existence, so credentials that can only get objects and list
+// the bucket are enough.
+func NewReader(config Conf) (Reader, error) {
+	switch config.Type {
+	case "s3":
+		sb, err := newS3Reader(config.S3)
+		if err != nil {
+			return nil, err
+		}
+
+		return readOnlyBackend{sb}, nil
+	default:
+		pb, err := newPosixBackend(config.Posix)
+		if err != nil {
+			return nil, err
+		}
+
+		return readOnlyBackend{pb}, nil
+	}
+}
+
 func newPosixBackend(config posixConf) (*posixBackend, error) {
 	fileInfo, err := os.Stat(config.Location)
 
@@ -72,7 +109,7 @@ func newPosixBackend(config posixConf) (*posixBackend, error) {
 }
 
 // NewFileReader returns an io.Reader instance
-func (pb *posixBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+func (pb *posixBackend) NewFileReader(_ context.Context, filePath string) (io.ReadCloser, error) {
 	if pb == nil {
 		return nil, fmt.Errorf("Invalid posixBackend")
 	}
@@ -81,7 +118,23 @@ func (pb *posixBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
 	if err != nil {
 		log.Error(err)
 
-		return nil, err
+		return nil, classifyError(filePath, err)
+	}
+
+	return file, nil
+}
+
+// NewFileReadSeeker returns an io.ReadSeeker instance
+func (pb *posixBackend) NewFileReadSeeker(_ context.Context, filePath string) (io.ReadSeekCloser, error) {
+	if pb == nil {
+		return nil, fmt.Errorf("Invalid posixBackend")
+	}
+
+	file, err := os.Open(filepath.Join(filepath.Clean(pb.Location), filePath))
+	if err != nil {
+		log.Error(err)
+
+		return nil, classifyError(filePath, err)
 	}
 
 	return file, nil
@@ -104,7 +157,7 @@ func (pb *posixBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 }
 
 // GetFileSize returns the size of the file
-func (pb *posixBackend) GetFileSize(filePath string) (int64, error) {
+func (pb *posixBackend) GetFileSize(_ context.Context, filePath string) (int64, error) {
 	if pb == nil {
 		return 0, fmt.Errorf("Invalid posixBackend")
 	}
@@ -113,7 +166,7 @@ func (pb *posixBackend) GetFileSize(filePath string) (int64, error) {
 	if err != nil {
 		log.Error(err)
 
-		return 0, err
+		return 0, classifyError(filePath, err)
 	}
 
 	return stat.Size(), nil
@@ -137,13 +190,24 @@ type S3Conf struct {
 	UploadConcurrency int
 	Chunksize         int
 	Cacert            string
+	// NonExistRetryTime is how long the bucket is retried on startup. It
+	// doesn't apply to the requests made while serving files.
 	NonExistRetryTime time.Duration
+	// RequestRetryTime is how long transient errors are retried while
+	// serving a request, which is kept short as the client is waiting
+	RequestRetryTime time.Duration
+	// ReadAhead is the number of chunks fetched concurrently when reading
+	// objects, where 0 reads objects in a single request
+	ReadAhead          int
+	ReadAheadChunkSize int64
 }
 
-func newS3Backend(config S3Conf) (*s3Backend, error) {
+// newS3Session creates the session of an S3 backend
+func newS3Session(config S3Conf) *session.Session {
 	s3Transport := transportConfigS3(config)
 	client := http.Client{Transport: s3Transport}
-	s3Session := session.Must(session.NewSession(
+
+	return session.Must(session.NewSession(
 		&aws.Config{
 			Endpoint:         aws.String(fmt.Sprintf("%s:%d", config.URL, config.Port)),
 			Region:           aws.String(config.Region),
@@ -153,6 +217,17 @@ func newS3Backend(config S3Conf) (*s3Backend, error) {
 			Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
 		},
 	))
+}
+
+// newS3Client creates the client of an S3 backend. The client doesn't retry
+// failed requests itself, as they are retried within the retry time of each
+// operation.
+func newS3Client(s3Session *session.Session) *s3.S3 {
+	return s3.New(s3Session, aws.NewConfig().WithMaxRetries(0))
+}
+
+func newS3Backend(config S3Conf) (*s3Backend, error) {
+	s3Session := newS3Session(config)
 
 	// Attempt to create a bucket, but we really expect an error here
 	// (BucketAlreadyOwnedByYou)
@@ -177,11 +252,14 @@ func newS3Backend(config S3Conf) (*s3Backend, error) {
 			u.Concurrency = config.UploadConcurrency
 			u.LeavePartsOnError = false
 		}),
-		Client: s3.New(s3Session),
+		Client: newS3Client(s3Session),
 		Conf:   &config}
 
-	_, err = sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
+	err = retry(context.Background(), config.Bucket, config.NonExistRetryTime, func() error {
+		_, err := sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
 
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -189,31 +267,50 @@ func newS3Backend(config S3Conf) (*s3Backend, error) {
 	return sb, nil
 }
 
+// newS3Reader creates an S3 backend without an uploader, for a bucket that
+// must exist
+func newS3Reader(config S3Conf) (*s3Backend, error) {
+	sb := &s3Backend{
+		Bucket: config.Bucket,
+		Client: newS3Client(newS3Session(config)),
+		Conf:   &config}
+
+	err := retry(context.Background(), config.Bucket, config.NonExistRetryTime, func() error {
+		_, err := sb.Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(config.Bucket)})
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s is not accessible: %w", config.Bucket, err)
+	}
+
+	return sb, nil
+}
+
 // NewFileReader returns an io.Reader instance
-func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
+func (sb *s3Backend) NewFileReader(ctx context.Context, filePath string) (io.ReadCloser, error) {
 	if sb == nil {
 		return nil, fmt.Errorf("Invalid s3Backend")
 	}
 
-	r, err := sb.Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(sb.Bucket),
-		Key:    aws.String(filePath),
-	})
+	if sb.readAhead() {
+		size, err := sb.GetFileSize(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
 
-	retryTime := 2 * time.Minute
-	if sb.Conf != nil {
-		retryTime = sb.Conf.NonExistRetryTime
+		return newReadAheadReader(ctx, sb, filePath, 0, size), nil
 	}
 
-	start := time.Now()
-	for err != nil && time.Since(start) < retryTime {
-		r, err = sb.Client.GetObject(&s3.GetObjectInput{
+	var r *s3.GetObjectOutput
+	err := retry(ctx, filePath, sb.Conf.RequestRetryTime, func() (err error) {
+		r, err = sb.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 			Bucket: aws.String(sb.Bucket),
 			Key:    aws.String(filePath),
 		})
-		time.Sleep(1 * time.Second)
-	}
 
+		return err
+	})
 	if err != nil {
 		log.Error(err)
 
@@ -223,6 +320,130 @@ func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
 	return r.Body, nil
 }
 
+// readAhead tells if objects are read with concurrent requests
+func (sb *s3Backend) readAhead() bool {
+	return sb.Conf != nil && sb.Conf.ReadAhead > 0 && sb.Conf.ReadAheadChunkSize > 0
+}
+
+// NewFileReadSeeker returns an io.ReadSeeker instance, which reads from
+// where it's seeked to with ranged requests
+func (sb *s3Backend) NewFileReadSeeker(ctx context.Context, filePath string) (io.ReadSeekCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+
+	size, err := sb.GetFileSize(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3SeekableReader{ctx: ctx, backend: sb, filePath: filePath, size: size}, nil
+}
+
+// s3SeekableReader reads an S3 object from any position. The object is
+// requested from the current position on the first read after a seek. With
+// read-ahead, the first chunk after a seek is read with a single request,
+// and read-ahead only starts if reading goes on past it, so that reads of
+// small ranges don't prefetch the rest of the object.
+type s3SeekableReader struct {
+	ctx      context.Context
+	backend  *s3Backend
+	filePath string
+	size     int64
+	pos      int64
+	// seeked is the position of the last seek
+	seeked int64
+	body   io.ReadCloser
+}
+
+// Read implements io.Reader for the s3SeekableReader
+func (r *s3SeekableReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil && r.backend.readAhead() && r.pos-r.seeked >= r.backend.Conf.ReadAheadChunkSize {
+		r.body = newReadAheadReader(r.ctx, r.backend, r.filePath, r.pos, r.size)
+	}
+	if r.body == nil {
+		objectRange := fmt.Sprintf("bytes=%d-", r.pos)
+		if r.backend.readAhead() {
+			objectRange += strconv.FormatInt(r.seeked+r.backend.Conf.ReadAheadChunkSize-1, 10)
+		}
+
+		var object *s3.GetObjectOutput
+		err := retry(r.ctx, r.filePath, r.backend.Conf.RequestRetryTime, func() (err error) {
+			object, err = r.backend.Client.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+				Bucket: aws.String(r.backend.Bucket),
+				Key:    aws.String(r.filePath),
+				Range:  aws.String(objectRange),
+			})
+
+			return err
+		})
+		if err != nil {
+			log.Error(err)
+
+			return 0, err
+		}
+		r.body = object.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	// The first chunk ends before the object does, and the rest is read
+	// ahead
+	if errors.Is(err, io.EOF) && r.pos < r.size {
+		_ = r.body.Close()
+		r.body = nil
+		if n == 0 {
+			return r.Read(p)
+		}
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek implements io.Seeker for the s3SeekableReader
+func (r *s3SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return r.pos, fmt.Errorf("negative position %d", pos)
+	}
+
+	if pos != r.pos {
+		if r.body != nil {
+			_ = r.body.Close()
+			r.body = nil
+		}
+		r.seeked = pos
+	}
+	r.pos = pos
+
+	return r.pos, nil
+}
+
+// Close implements io.Closer for the s3SeekableReader
+func (r *s3SeekableReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
+
 // NewFileWriter uploads the contents of an io.Reader to a S3 bucket
 func (sb *s3Backend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 	if sb == nil {
@@ -248,33 +469,19 @@ func (sb *s3Backend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 }
 
 // GetFileSize returns the size of a specific object
-func (sb *s3Backend) GetFileSize(filePath string) (int64, error) {
+func (sb *s3Backend) GetFileSize(ctx context.Context, filePath string) (int64, error) {
 	if sb == nil {
 		return 0, fmt.Errorf("Invalid s3Backend")
 	}
 
-	r, err := sb.Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(sb.Bucket),
-		Key:    aws.String(filePath)})
-
-	start := time.Now()
-
-	retryTime := 2 * time.Minute
-	if sb.Conf != nil {
-		retryTime = sb.Conf.NonExistRetryTime
-	}
-
-	// Retry on error up to five minutes to allow for
-	// "slow writes' or s3 eventual consistency
-	for err != nil && time.Since(start) < retryTime {
-		r, err = sb.Client.HeadObject(&s3.HeadObjectInput{
+	var r *s3.HeadObjectOutput
+	err := retry(ctx, filePath, sb.Conf.RequestRetryTime, func() (err error) {
+		r, err = sb.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 			Bucket: aws.String(sb.Bucket),
 			Key:    aws.String(filePath)})
 
-		time.Sleep(1 * time.Second)
-
-	}
-
+		return err
+	})
 	if err != nil {
 		log.Errorln(err)
 
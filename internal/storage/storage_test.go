@@ -2,7 +2,9 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
@@ -37,7 +39,10 @@ var testS3Conf = S3Conf{
 	10,
 	5 * 1024 * 1024,
 	"../../README.md",
-	2 * time.Second}
+	2 * time.Second,
+	time.Second,
+	0,
+	0}
 
 var testConf = Conf{posixType, testS3Conf, testPosixConf}
 
@@ -152,7 +157,7 @@ func TestPosixBackend(t *testing.T) {
 
 	log.SetOutput(os.Stdout)
 
-	reader, err := backend.NewFileReader(writable)
+	reader, err := backend.NewFileReader(context.Background(), writable)
 	assert.Nil(t, err, "posix NewFileReader failed when it should work")
 	assert.NotNil(t, reader, "Got a nil reader for posix")
 
@@ -169,20 +174,22 @@ func TestPosixBackend(t *testing.T) {
 	assert.Equal(t, writeData, readBackBuffer[:readBack], "did not read back data as expected")
 	assert.Nil(t, err, "unexpected error when reading back data")
 
-	size, err := backend.GetFileSize(writable)
+	checkReadSeeker(t, backend, writable)
+
+	size, err := backend.GetFileSize(context.Background(), writable)
 	assert.Nil(t, err, "posix NewFileReader failed when it should work")
 	assert.NotNil(t, size, "Got a nil size for posix")
 
 	log.SetOutput(&buf)
 
-	reader, err = backend.NewFileReader(posixDoesNotExist)
+	reader, err = backend.NewFileReader(context.Background(), posixDoesNotExist)
 	assert.NotNil(t, err, "posix NewFileReader worked when it should not")
 	assert.Nil(t, reader, "Got a non-nil reader for posix")
 	assert.NotZero(t, buf.Len(), "Expected warning missing")
 
 	buf.Reset()
 
-	_, err = backend.GetFileSize(posixDoesNotExist) // nolint
+	_, err = backend.GetFileSize(context.Background(), posixDoesNotExist) // nolint
 	assert.NotNil(t, err, "posix GetFileSize worked when it should not")
 	assert.NotZero(t, buf.Len(), "Expected warning missing")
 
@@ -252,15 +259,19 @@ func TestS3Fail(t *testing.T) {
 	assert.NotNil(t, err, "Backend worked when it should not")
 
 	var dummyBackend *s3Backend
-	reader, err := dummyBackend.NewFileReader("/")
+	reader, err := dummyBackend.NewFileReader(context.Background(), "/")
 	assert.NotNil(t, err, "NewFileReader worked when it should not")
 	assert.Nil(t, reader, "Got a Reader when expected not to")
 
+	readSeeker, err := dummyBackend.NewFileReadSeeker(context.Background(), "/")
+	assert.NotNil(t, err, "NewFileReadSeeker worked when it should not")
+	assert.Nil(t, readSeeker, "Got a ReadSeeker when expected not to")
+
 	writer, err := dummyBackend.NewFileWriter("/")
 	assert.NotNil(t, err, "NewFileWriter worked when it should not")
 	assert.Nil(t, writer, "Got a Writer when expected not to")
 
-	_, err = dummyBackend.GetFileSize("/")
+	_, err = dummyBackend.GetFileSize(context.Background(), "/")
 	assert.NotNil(t, err, "GetFileSize worked when it should not")
 }
 
@@ -283,15 +294,19 @@ func TestPOSIXFail(t *testing.T) {
 	assert.Nil(t, backEnd, "Got a backend when expected not to")
 
 	var dummyBackend *posixBackend
-	reader, err := dummyBackend.NewFileReader("/")
+	reader, err := dummyBackend.NewFileReader(context.Background(), "/")
 	assert.NotNil(t, err, "NewFileReader worked when it should not")
 	assert.Nil(t, reader, "Got a Reader when expected not to")
 
+	readSeeker, err := dummyBackend.NewFileReadSeeker(context.Background(), "/")
+	assert.NotNil(t, err, "NewFileReadSeeker worked when it should not")
+	assert.Nil(t, readSeeker, "Got a ReadSeeker when expected not to")
+
 	writer, err := dummyBackend.NewFileWriter("/")
 	assert.NotNil(t, err, "NewFileWriter worked when it should not")
 	assert.Nil(t, writer, "Got a Writer when expected not to")
 
-	_, err = dummyBackend.GetFileSize("/")
+	_, err = dummyBackend.GetFileSize(context.Background(), "/")
 	assert.NotNil(t, err, "GetFileSize worked when it should not")
 }
 
@@ -317,12 +332,13 @@ func TestS3Backend(t *testing.T) {
 	assert.Nil(t, err, "Failure when writing to s3 writer")
 	assert.Equal(t, len(writeData), written, "Did not write all writeData")
 	writer.Close()
+	waitForUpload(t, s3back, s3Creatable)
 
-	reader, err := s3back.NewFileReader(s3Creatable)
+	reader, err := s3back.NewFileReader(context.Background(), s3Creatable)
 	assert.Nil(t, err, "s3 NewFileReader failed when it should work")
 	assert.NotNil(t, reader, "Got a nil reader for s3")
 
-	size, err := s3back.GetFileSize(s3Creatable)
+	size, err := s3back.GetFileSize(context.Background(), s3Creatable)
 	assert.Nil(t, err, "s3 GetFileSize failed when it should work")
 	assert.Equal(t, int64(len(writeData)), size, "Got an incorrect file size")
 
@@ -342,23 +358,165 @@ func TestS3Backend(t *testing.T) {
 		assert.Nil(t, err, "unexpected error when reading back data")
 	}
 
+	checkReadSeeker(t, backend, s3Creatable)
+
 	buf.Reset()
 
 	log.SetOutput(&buf)
 
 	if !testing.Short() {
-		_, err = backend.GetFileSize(s3DoesNotExist)
+		_, err = backend.GetFileSize(context.Background(), s3DoesNotExist)
 		assert.NotNil(t, err, "s3 GetFileSize worked when it should not")
 		assert.NotZero(t, buf.Len(), "Expected warning missing")
 
 		buf.Reset()
 
-		reader, err = backend.NewFileReader(s3DoesNotExist)
+		reader, err = backend.NewFileReader(context.Background(), s3DoesNotExist)
 		assert.NotNil(t, err, "s3 NewFileReader worked when it should not")
 		assert.Nil(t, reader, "Got a non-nil reader for s3")
 		assert.NotZero(t, buf.Len(), "Expected warning missing")
+
+		buf.Reset()
+
+		readSeeker, err := backend.NewFileReadSeeker(context.Background(), s3DoesNotExist)
+		assert.NotNil(t, err, "s3 NewFileReadSeeker worked when it should not")
+		assert.Nil(t, readSeeker, "Got a non-nil read seeker for s3")
+		assert.NotZero(t, buf.Len(), "Expected warning missing")
 	}
 
 	log.SetOutput(os.Stdout)
 
 }
+
+// checkReadSeeker checks that a file holding writeData can be read from
+// where it's seeked to
+func checkReadSeeker(t *testing.T, backend Backend, filePath string) {
+	reader, err := backend.NewFileReadSeeker(context.Background(), filePath)
+	assert.Nil(t, err, "NewFileReadSeeker failed when it should work")
+	if reader == nil {
+		t.Error("read seeker that should be usable is not, bailing out")
+
+		return
+	}
+	defer reader.Close()
+
+	pos, err := reader.Seek(5, io.SeekStart)
+	assert.Nil(t, err, "seeking failed")
+	assert.Equal(t, int64(5), pos)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err, "reading after seeking failed")
+	assert.Equal(t, "is a test", string(data))
+
+	_, err = reader.Seek(0, io.SeekStart)
+	assert.Nil(t, err, "seeking back failed")
+	data = make([]byte, 4)
+	_, err = io.ReadFull(reader, data)
+	assert.Nil(t, err, "reading after seeking back failed")
+	assert.Equal(t, "this", string(data))
+
+	_, err = reader.Seek(-4, io.SeekEnd)
+	assert.Nil(t, err, "seeking from the end failed")
+	data, err = io.ReadAll(reader)
+	assert.Nil(t, err, "reading after seeking from the end failed")
+	assert.Equal(t, "test", string(data))
+
+	_, err = reader.Seek(-1, io.SeekStart)
+	assert.NotNil(t, err, "seeking before the start worked when it should not")
+}
+
+func TestReader(t *testing.T) {
+	testConf.Type = posixType
+	reader, err := NewReader(testConf)
+	assert.Nil(t, err, "read-only posix backend failed")
+	_, writable := reader.(Backend)
+	assert.False(t, writable, "read-only posix backend can write")
+
+	tmp := testConf.Posix.Location
+	testConf.Posix.Location = "/thisdoesnotexist"
+	_, err = NewReader(testConf)
+	assert.NotNil(t, err, "read-only posix backend worked when it should not")
+	testConf.Posix.Location = tmp
+
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	assert.Nil(t, err, "Backend failed")
+	writer, err := backend.NewFileWriter("readonly")
+	assert.Nil(t, err, "s3 NewFileWriter failed when it shouldn't")
+	_, err = writer.Write(writeData)
+	assert.Nil(t, err, "Failure when writing to s3 writer")
+	writer.Close()
+	waitForUpload(t, backend.(*s3Backend), "readonly")
+
+	reader, err = NewReader(testConf)
+	assert.Nil(t, err, "read-only s3 backend failed")
+	_, writable = reader.(Backend)
+	assert.False(t, writable, "read-only s3 backend can write")
+
+	fileReader, err := reader.NewFileReader(context.Background(), "readonly")
+	assert.Nil(t, err, "read-only s3 NewFileReader failed when it should work")
+	if fileReader != nil {
+		readBack, err := io.ReadAll(fileReader)
+		assert.Nil(t, err, "unexpected error when reading back data")
+		assert.Equal(t, writeData, readBack, "did not read back data as expected")
+		fileReader.Close()
+	}
+
+	// Missing buckets aren't created
+	conf := testConf
+	conf.S3.Bucket = "missing"
+	_, err = NewReader(conf)
+	assert.NotNil(t, err, "read-only s3 backend worked for a missing bucket")
+
+	_, err = backend.(*s3Backend).Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("missing")})
+	assert.NotNil(t, err, "read-only s3 backend created a bucket")
+}
+
+// waitForUpload waits for the upload of an s3 writer, which goes on after
+// the writer is closed, to finish
+func waitForUpload(t *testing.T, sb *s3Backend, filePath string) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, err := sb.Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(filePath)}); err == nil {
+			return
+		}
+	}
+	t.Fatalf("upload of %s didn't finish", filePath)
+}
+
+func TestRequestRetryTime(t *testing.T) {
+	originalBase := retryBaseDelay
+	defer func() { retryBaseDelay = originalBase }()
+	retryBaseDelay = 10 * time.Millisecond
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	// Requests give up long before the startup retry time
+	conf := testConf.S3
+	conf.URL = "http://127.0.0.1"
+	conf.Port, _ = strconv.Atoi(unavailable.URL[strings.LastIndex(unavailable.URL, ":")+1:])
+	conf.NonExistRetryTime = time.Hour
+	conf.RequestRetryTime = 50 * time.Millisecond
+	sb := &s3Backend{Bucket: conf.Bucket, Client: newS3Client(newS3Session(conf)), Conf: &conf}
+
+	start := time.Now()
+	_, err := sb.GetFileSize(context.Background(), "file")
+	assert.Equal(t, ErrorTransient, ErrorKindOf(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Retrying stops when the request ends
+	conf.RequestRetryTime = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = sb.GetFileSize(ctx, "file")
+	assert.Error(t, err)
+	_, err = sb.NewFileReader(ctx, "file")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -133,6 +133,20 @@ var GetToken = func(headers http.Header) (string, int, error) {
 	return token, 0, nil
 }
 
+// GetTokenExpiry returns the expiry time of a JWT access token, or the zero
+// time for opaque tokens and tokens without expiry. The token must have been
+// verified already, as it is parsed without checking the signature.
+func GetTokenExpiry(token string) time.Time {
+	parsedToken, err := jwt.Parse([]byte(token), jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		log.Debugf("could not parse token expiry, %s", err)
+
+		return time.Time{}
+	}
+
+	return parsedToken.Expiration()
+}
+
 type JKU struct {
 	URL string `json:"jku"`
 }
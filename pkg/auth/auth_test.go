@@ -7,7 +7,10 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/neicnordic/sda-download/internal/config"
 	"github.com/neicnordic/sda-download/pkg/request"
 	"github.com/stretchr/testify/assert"
@@ -242,6 +245,20 @@ func TestGetToken_Success(t *testing.T) {
 
 }
 
+func TestGetTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	token, _ := jwt.NewBuilder().Expiration(exp).Build()
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.HS256, []byte("secret")))
+	assert.NoError(t, err)
+	assert.True(t, exp.Equal(GetTokenExpiry(string(signed))))
+
+	// Expired tokens are parsed too, and opaque tokens have no known expiry
+	token, _ = jwt.NewBuilder().Expiration(time.Now().Add(-time.Minute)).Build()
+	signed, _ = jwt.Sign(token, jwt.WithKey(jwa.HS256, []byte("secret")))
+	assert.False(t, GetTokenExpiry(string(signed)).IsZero())
+	assert.True(t, GetTokenExpiry("opaque").IsZero())
+}
+
 func TestGetVisas_Fail_MakeRequest(t *testing.T) {
 
 	// Save original to-be-mocked functions